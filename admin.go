@@ -0,0 +1,55 @@
+package fastdfs
+
+import (
+	"context"
+	"errors"
+)
+
+var ErrAdminDisabled = errors.New("admin operations are disabled, set Config.EnableAdmin")
+
+// DeleteStorage removes the storage with storageIP (or its storage id) from
+// groupName on every tracker, e.g. to decommission a node for good. The
+// storage has to be offline; trackers refuse to delete an online one and
+// that error is returned. Trackers that don't know the storage are skipped.
+// This is an admin operation and fails with ErrAdminDisabled unless the
+// client was created with EnableAdmin.
+func (this *FastDFSClient) DeleteStorage(groupName string, storageIP string) error {
+	if !this.cfg.EnableAdmin {
+		return ErrAdminDisabled
+	}
+	if err := this.acquireOp(context.Background()); err != nil {
+		return err
+	}
+	defer this.releaseOp()
+
+	if !this.groupAllowed(groupName) {
+		return ErrGroupNotAllowed
+	}
+
+	// every tracker keeps its own view of the storages
+	deleted := false
+	opts := this.poolOpts
+	opts.minConns, opts.maxConns, opts.warmUp = 0, 1, false
+	for _, endpoint := range this.pool.endpoints {
+		pool, err := newConnectionPool([]string{endpoint}, opts)
+		if err != nil {
+			return err
+		}
+		tc := &TrackerClient{pool: pool, slowThreshold: this.cfg.SlowThreshold, log: this.log}
+		err = tc.trackerDeleteStorage(groupName, storageIP)
+		pool.Close()
+
+		var errno Errno
+		if errors.As(err, &errno) && errno.status == enoent {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		deleted = true
+	}
+	if !deleted {
+		return Errno{enoent}
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package fastdfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+var ErrNotAppenderFile = errors.New("not an appender file")
+
+var ErrTruncateGrows = errors.New("truncated size is larger than the file")
+
+// appenderTarget is where commands changing an appender file go: the
+// storage the tracker routes updates of the file to.
+type appenderTarget struct {
+	tc             *TrackerClient
+	store          *StorageClient
+	storeServ      *StorageServer
+	remoteFilename string
+}
+
+// appenderTarget fails with ErrNotAppenderFile, without a round trip, if
+// remoteFileId isn't an appender file. The tracker query gives up when ctx
+// ends.
+func (this *FastDFSClient) appenderTarget(ctx context.Context, remoteFileId string) (*appenderTarget, error) {
+	tmp, err := this.splitRemoteFileId(remoteFileId)
+	if err != nil {
+		return nil, err
+	}
+	groupName, remoteFilename := tmp[0], tmp[1]
+
+	meta, err := DecodeFileIdMeta(remoteFileId)
+	if err != nil {
+		return nil, err
+	}
+	if !meta.IsAppender {
+		return nil, fmt.Errorf("%w: %s", ErrNotAppenderFile, remoteFileId)
+	}
+
+	tc := this.trackerClientContext(ctx)
+	storeServ, err := tc.trackerQueryStorageUpdate(groupName, remoteFilename)
+	if err != nil {
+		return nil, err
+	}
+	storagePool, err := this.getStoragePool(storeServ.ipAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &appenderTarget{tc, this.storageClient(storagePool), storeServ, remoteFilename}, nil
+}
+
+// ModifyByBuffer overwrites the bytes of the appender file remoteFileId at
+// offset with buffer, growing the file if it reaches past the end. It
+// fails with ErrNotAppenderFile for other files.
+func (this *FastDFSClient) ModifyByBuffer(remoteFileId string, buffer []byte, offset int64) error {
+	return this.modify(remoteFileId, bytes.NewReader(buffer), int64(len(buffer)), offset)
+}
+
+// ModifyByFilename is ModifyByBuffer with the content of localFilename,
+// streamed from the file.
+func (this *FastDFSClient) ModifyByFilename(localFilename string, remoteFileId string, offset int64) error {
+	file, err := os.Open(localFilename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	return this.modify(remoteFileId, file, fileInfo.Size(), offset)
+}
+
+func (this *FastDFSClient) modify(remoteFileId string, r io.Reader, size int64, offset int64) error {
+	if offset < 0 {
+		return fmt.Errorf("invalid modify offset %d", offset)
+	}
+	if err := this.acquireOp(context.Background()); err != nil {
+		return err
+	}
+	defer this.releaseOp()
+
+	ctx := context.Background()
+	t, err := this.appenderTarget(ctx, remoteFileId)
+	if err != nil {
+		return err
+	}
+	return t.store.storageModifyFile(ctx, t.tc, t.storeServ, t.remoteFilename, offset, r, size)
+}
+
+// AppendByBuffer appends buffer to the appender file remoteFileId. It fails
+// with ErrNotAppenderFile for other files.
+func (this *FastDFSClient) AppendByBuffer(remoteFileId string, buffer []byte) error {
+	return this.AppendByReader(remoteFileId, bytes.NewReader(buffer), int64(len(buffer)))
+}
+
+// AppendByReader appends exactly size bytes read from r, streaming them. If
+// r ends early the append is aborted with ErrShortUpload and the file is
+// left unchanged.
+func (this *FastDFSClient) AppendByReader(remoteFileId string, r io.Reader, size int64) error {
+	if size < 0 {
+		return fmt.Errorf("invalid append size %d", size)
+	}
+	if err := this.acquireOp(context.Background()); err != nil {
+		return err
+	}
+	defer this.releaseOp()
+
+	ctx := context.Background()
+	t, err := this.appenderTarget(ctx, remoteFileId)
+	if err != nil {
+		return err
+	}
+	return t.store.storageAppendFile(ctx, t.tc, t.storeServ, t.remoteFilename, r, size)
+}
+
+// Truncate cuts the appender file remoteFileId down to truncatedFileSize
+// bytes, e.g. 0 to reset it. Truncate never grows a file: a size larger
+// than the current one fails with ErrTruncateGrows, which takes a file info
+// query before the truncate. It fails with ErrNotAppenderFile for other
+// files.
+func (this *FastDFSClient) Truncate(remoteFileId string, truncatedFileSize int64) error {
+	if truncatedFileSize < 0 {
+		return fmt.Errorf("invalid truncated file size %d", truncatedFileSize)
+	}
+	if err := this.acquireOp(context.Background()); err != nil {
+		return err
+	}
+	defer this.releaseOp()
+
+	ctx := context.Background()
+	t, err := this.appenderTarget(ctx, remoteFileId)
+	if err != nil {
+		return err
+	}
+	if truncatedFileSize > 0 {
+		info, err := t.store.storageQueryFileInfo(ctx, t.tc, t.storeServ, t.remoteFilename)
+		if err != nil {
+			return err
+		}
+		if truncatedFileSize > info.FileSize {
+			return fmt.Errorf("%w: %d > %d bytes of %s", ErrTruncateGrows, truncatedFileSize, info.FileSize, remoteFileId)
+		}
+	}
+	return t.store.storageTruncateFile(ctx, t.tc, t.storeServ, t.remoteFilename, truncatedFileSize)
+}
+
+// RegenerateAppenderFile turns the appender file remoteFileId into a normal
+// file, which can't be changed anymore, and returns its new file id. The
+// old id is gone afterwards. Needs FastDFS 6.02 or later; it fails with
+// ErrNotAppenderFile for other files.
+func (this *FastDFSClient) RegenerateAppenderFile(remoteFileId string) (*UploadFileResponse, error) {
+	if err := this.acquireOp(context.Background()); err != nil {
+		return nil, err
+	}
+	defer this.releaseOp()
+
+	ctx := context.Background()
+	t, err := this.appenderTarget(ctx, remoteFileId)
+	if err != nil {
+		return nil, err
+	}
+	return t.store.storageRegenerateAppenderFile(ctx, t.tc, t.storeServ, t.remoteFilename)
+}
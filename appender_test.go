@@ -0,0 +1,165 @@
+package fastdfs
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAppend(t *testing.T) {
+	c := newFakeCluster(t)
+	defer c.close()
+	client := c.client(t, nil)
+	id := mustUpload(t, client.UploadAppenderByBuffer, "head")
+
+	steps := []struct {
+		name    string
+		append  func() error
+		want    string
+		wantErr error
+	}{
+		{"buffer", func() error { return client.AppendByBuffer(id, []byte("-one")) }, "head-one", nil},
+		{"empty", func() error { return client.AppendByBuffer(id, nil) }, "head-one", nil},
+		{"reader", func() error { return client.AppendByReader(id, strings.NewReader("-two"), 4) }, "head-one-two", nil},
+		{"short reader", func() error { return client.AppendByReader(id, strings.NewReader("-x"), 4) }, "head-one-two", ErrShortUpload},
+		{"after short reader", func() error { return client.AppendByBuffer(id, []byte("-three")) }, "head-one-two-three", nil},
+	}
+	for _, step := range steps {
+		if err := step.append(); !errors.Is(err, step.wantErr) {
+			t.Fatalf("%s: append error = %v, want %v", step.name, err, step.wantErr)
+		}
+		if got := downloadString(t, client, id, 0, 0); got != step.want {
+			t.Fatalf("%s: downloaded %q, want %q", step.name, got, step.want)
+		}
+	}
+
+	normalId := mustUpload(t, client.UploadByBuffer, "normal")
+	if err := client.AppendByBuffer(normalId, []byte("more")); !errors.Is(err, ErrNotAppenderFile) {
+		t.Errorf("AppendByBuffer() to a normal file error = %v, want %v", err, ErrNotAppenderFile)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	c := newFakeCluster(t)
+	defer c.close()
+	client := c.client(t, nil)
+	id := mustUpload(t, client.UploadAppenderByBuffer, "0123")
+	if err := client.AppendByBuffer(id, []byte("456789")); err != nil {
+		t.Fatalf("AppendByBuffer() error = %v", err)
+	}
+
+	steps := []struct {
+		size     int64
+		wantSize int64
+		wantErr  error
+	}{
+		{11, 10, ErrTruncateGrows},
+		{10, 10, nil},
+		{4, 4, nil},
+		{5, 4, ErrTruncateGrows},
+		{0, 0, nil},
+	}
+	for _, step := range steps {
+		if err := client.Truncate(id, step.size); !errors.Is(err, step.wantErr) {
+			t.Fatalf("Truncate(%d) error = %v, want %v", step.size, err, step.wantErr)
+		}
+		info, err := client.QueryFileInfo(id)
+		if err != nil {
+			t.Fatalf("QueryFileInfo() error = %v", err)
+		}
+		if info.FileSize != step.wantSize {
+			t.Fatalf("size after Truncate(%d) = %d, want %d", step.size, info.FileSize, step.wantSize)
+		}
+	}
+	if err := client.Truncate(id, -1); err == nil {
+		t.Error("Truncate(-1) succeeded")
+	}
+
+	normalId := mustUpload(t, client.UploadByBuffer, "normal")
+	if err := client.Truncate(normalId, 0); !errors.Is(err, ErrNotAppenderFile) {
+		t.Errorf("Truncate() of a normal file error = %v, want %v", err, ErrNotAppenderFile)
+	}
+	if got := downloadString(t, client, normalId, 0, 0); got != "normal" {
+		t.Errorf("normal file after Truncate() = %q, want %q", got, "normal")
+	}
+}
+
+func TestRegenerateAppenderFile(t *testing.T) {
+	c := newFakeCluster(t)
+	defer c.close()
+	client := c.client(t, nil)
+	id := mustUpload(t, client.UploadAppenderByBuffer, "part one")
+	if err := client.AppendByBuffer(id, []byte(", part two")); err != nil {
+		t.Fatalf("AppendByBuffer() error = %v", err)
+	}
+
+	ur, err := client.RegenerateAppenderFile(id)
+	if err != nil {
+		t.Fatalf("RegenerateAppenderFile() error = %v", err)
+	}
+	newId := ur.fileId()
+	if newId == id {
+		t.Fatalf("RegenerateAppenderFile() kept the id %s", id)
+	}
+	if meta, err := DecodeFileIdMeta(newId); err != nil || meta.IsAppender {
+		t.Errorf("DecodeFileIdMeta(%s) = %+v, %v, want a normal file", newId, meta, err)
+	}
+	if got := downloadString(t, client, newId, 0, 0); got != "part one, part two" {
+		t.Errorf("download of the regenerated file = %q, want %q", got, "part one, part two")
+	}
+	if _, err := client.DownloadToBuffer(id, 0, 0); err == nil {
+		t.Error("download by the old id succeeded")
+	}
+
+	if _, err := client.RegenerateAppenderFile(newId); !errors.Is(err, ErrNotAppenderFile) {
+		t.Errorf("RegenerateAppenderFile() of a normal file error = %v, want %v", err, ErrNotAppenderFile)
+	}
+	if err := client.AppendByBuffer(newId, []byte("more")); !errors.Is(err, ErrNotAppenderFile) {
+		t.Errorf("AppendByBuffer() to the regenerated file error = %v, want %v", err, ErrNotAppenderFile)
+	}
+}
+
+func TestReplaceAppenderContent(t *testing.T) {
+	c := newFakeCluster(t)
+	defer c.close()
+	client := c.client(t, nil)
+	id := mustUpload(t, client.UploadAppenderByBuffer, "old content")
+
+	for _, content := range []string{"new", "newer content", ""} {
+		if err := client.ReplaceAppenderContent(id, []byte(content)); err != nil {
+			t.Fatalf("ReplaceAppenderContent(%q) error = %v", content, err)
+		}
+		if got := downloadString(t, client, id, 0, 0); got != content {
+			t.Errorf("after ReplaceAppenderContent(%q) downloaded %q", content, got)
+		}
+	}
+
+	normalId := mustUpload(t, client.UploadByBuffer, "normal")
+	if err := client.ReplaceAppenderContent(normalId, []byte("new")); !errors.Is(err, ErrNotAppenderFile) {
+		t.Errorf("ReplaceAppenderContent() of a normal file error = %v, want %v", err, ErrNotAppenderFile)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := client.ReplaceAppenderContentContext(ctx, id, []byte("new")); !errors.Is(err, context.Canceled) {
+		t.Errorf("ReplaceAppenderContentContext() with a cancelled context error = %v, want %v", err, context.Canceled)
+	}
+
+	// the storage never answers the truncate, ctx ends the call and its
+	// connection is dropped
+	c.storage.setFault(STORAGE_PROTO_CMD_TRUNCATE_FILE, faultHang, -1)
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := client.ReplaceAppenderContentContext(ctx, id, []byte("new")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("ReplaceAppenderContentContext() against a hanging storage error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("ReplaceAppenderContentContext() returned after %v", elapsed)
+	}
+	if stat := client.PoolStats()[c.storage.addr()]; stat.ActiveConns != 0 || stat.IdleConns != 0 {
+		t.Errorf("storage pool = %+v, want the connection discarded", stat)
+	}
+}
@@ -0,0 +1,193 @@
+package fastdfs
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// BatchError reports the failure of one file in a batch operation.
+type BatchError struct {
+	RemoteFileId string
+	Err          error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("%s: %v", e.RemoteFileId, e.Err)
+}
+
+type metadataUpdate struct {
+	remoteFileId   string
+	remoteFilename string
+	meta           map[string]string
+}
+
+// SetMetadataBatch applies metadata to many files. Files are grouped by the
+// storage that owns them and each storage's updates go over one reused
+// connection, with the storages handled in parallel. With merge set, the
+// given names are added to or replace the existing ones, otherwise they
+// overwrite all existing metadata. It keeps going when a file fails and
+// returns a *BatchError for each failed file, or nil if all succeeded.
+func (this *FastDFSClient) SetMetadataBatch(updates map[string]map[string]string, merge bool) []error {
+	if err := this.acquireOp(context.Background()); err != nil {
+		return []error{err}
+	}
+	defer this.releaseOp()
+
+	flag := byte(STORAGE_SET_METADATA_FLAG_OVERWRITE)
+	if merge {
+		flag = STORAGE_SET_METADATA_FLAG_MERGE
+	}
+
+	var (
+		errs     []error
+		errsLock sync.Mutex
+	)
+	fail := func(remoteFileId string, err error) {
+		errsLock.Lock()
+		errs = append(errs, &BatchError{remoteFileId, err})
+		errsLock.Unlock()
+	}
+
+	tc := this.trackerClient()
+	byStorage := make(map[StorageServer][]metadataUpdate)
+	for remoteFileId, meta := range updates {
+		tmp, err := this.splitRemoteFileId(remoteFileId)
+		if err != nil {
+			fail(remoteFileId, err)
+			continue
+		}
+		storeServ, err := tc.trackerQueryStorageUpdate(tmp[0], tmp[1])
+		if err != nil {
+			fail(remoteFileId, err)
+			continue
+		}
+		key := StorageServer{storeServ.ipAddr, storeServ.groupName, 0}
+		byStorage[key] = append(byStorage[key], metadataUpdate{remoteFileId, tmp[1], meta})
+	}
+
+	var wg sync.WaitGroup
+	for storeServ, batch := range byStorage {
+		wg.Add(1)
+		go func(storeServ StorageServer, batch []metadataUpdate) {
+			defer wg.Done()
+
+			storagePool, err := this.getStoragePool(storeServ.ipAddr)
+			if err != nil {
+				for _, u := range batch {
+					fail(u.remoteFileId, err)
+				}
+				return
+			}
+
+			var conn net.Conn
+			for _, u := range batch {
+				if conn == nil {
+					if conn, err = storagePool.Get(); err != nil {
+						fail(u.remoteFileId, err)
+						continue
+					}
+				}
+				err = setMetadataOnConn(conn, storeServ.groupName, u.remoteFilename, u.meta, flag)
+				if err == nil {
+					continue
+				}
+				fail(u.remoteFileId, err)
+				if _, ok := err.(Errno); !ok {
+					// the connection broke, continue on a fresh one
+					releaseConn(conn, err)
+					conn = nil
+				}
+			}
+			if conn != nil {
+				conn.Close()
+			}
+		}(storeServ, batch)
+	}
+	wg.Wait()
+
+	return errs
+}
+
+// UploadItem is one file of UploadBatch: the local file Filename if set,
+// otherwise Buffer with the extension Ext.
+type UploadItem struct {
+	Buffer   []byte
+	Ext      string
+	Filename string
+}
+
+// BatchResult is the outcome of one UploadItem. Skipped is set for items
+// never started because the batch was cancelled, Err then being the
+// context's error.
+type BatchResult struct {
+	Response *UploadFileResponse
+	Err      error
+	Skipped  bool
+}
+
+// UploadBatch uploads many files with up to concurrency uploads running at
+// the same time, sharing the client's pools. Failed files don't stop the
+// others: the results, in the order of files, tell which succeeded. Every
+// upload counts against MaxConcurrentOps on its own.
+func (this *FastDFSClient) UploadBatch(files []UploadItem, concurrency int) ([]BatchResult, error) {
+	return this.UploadBatchContext(context.Background(), files, concurrency)
+}
+
+// UploadBatchContext is UploadBatch bound to ctx. When ctx ends, uploads in
+// flight are aborted without leaving partial files, the remaining items are
+// skipped, and ctx's error is returned along with the results.
+func (this *FastDFSClient) UploadBatchContext(ctx context.Context, files []UploadItem, concurrency int) ([]BatchResult, error) {
+	if concurrency <= 0 {
+		return nil, fmt.Errorf("invalid concurrency %d", concurrency)
+	}
+
+	results := make([]BatchResult, len(files))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency && w < len(files); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				// the feeder may still hand out an item as ctx ends
+				if err := ctx.Err(); err != nil {
+					results[i] = BatchResult{Err: err, Skipped: true}
+					continue
+				}
+				results[i] = this.uploadItem(ctx, files[i])
+			}
+		}()
+	}
+
+	i := 0
+feed:
+	for ; i < len(files); i++ {
+		select {
+		case next <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(next)
+	wg.Wait()
+
+	for ; i < len(files); i++ {
+		results[i] = BatchResult{Err: ctx.Err(), Skipped: true}
+	}
+	return results, ctx.Err()
+}
+
+func (this *FastDFSClient) uploadItem(ctx context.Context, item UploadItem) BatchResult {
+	var (
+		ur  *UploadFileResponse
+		err error
+	)
+	if item.Filename != "" {
+		ur, err = this.UploadByFilenameContext(ctx, item.Filename)
+	} else {
+		ur, err = this.UploadByBufferContext(ctx, item.Buffer, item.Ext)
+	}
+	return BatchResult{Response: ur, Err: err}
+}
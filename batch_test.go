@@ -0,0 +1,116 @@
+package fastdfs
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestUploadBatch(t *testing.T) {
+	c := newFakeCluster(t)
+	defer c.close()
+	client := c.client(t, nil)
+
+	f, err := ioutil.TempFile("", "fastdfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString("from file")
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := []UploadItem{
+		{Buffer: []byte("from buffer"), Ext: "txt"},
+		{Filename: f.Name()},
+		{Filename: f.Name() + ".missing"},
+		{Buffer: []byte("after the missing file"), Ext: "txt"},
+	}
+	want := []string{"from buffer", "from file", "", "after the missing file"}
+	results, err := client.UploadBatch(files, 2)
+	if err != nil {
+		t.Fatalf("UploadBatch() error = %v", err)
+	}
+	if len(results) != len(files) {
+		t.Fatalf("UploadBatch() returned %d results for %d files", len(results), len(files))
+	}
+	for i, r := range results {
+		if want[i] == "" {
+			if r.Err == nil || r.Skipped || r.Response != nil {
+				t.Errorf("results[%d] = %+v, want its own error", i, r)
+			}
+			continue
+		}
+		if r.Err != nil {
+			t.Errorf("results[%d] error = %v", i, r.Err)
+			continue
+		}
+		if got := string(c.storage.file(r.Response.RemoteFileId)); got != want[i] {
+			t.Errorf("results[%d] uploaded %q, want %q", i, got, want[i])
+		}
+	}
+}
+
+func TestUploadBatchCancelled(t *testing.T) {
+	const bigSize = 16 << 20
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := newFakeCluster(t)
+	defer c.close()
+	client := c.client(t, func(cfg *Config) {
+		// cancel while the big item is being sent, after the first one
+		// was committed
+		cfg.Defaults.Progress = func(transferred, total int64) {
+			if total == bigSize {
+				cancel()
+			}
+		}
+	})
+
+	// sent in chunks, unlike a buffer
+	bigFile, err := ioutil.TempFile("", "fastdfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(bigFile.Name())
+	_, err = bigFile.Write(make([]byte, bigSize))
+	bigFile.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := []UploadItem{
+		{Buffer: []byte("first"), Ext: "txt"},
+		{Filename: bigFile.Name()},
+		{Buffer: []byte("third"), Ext: "txt"},
+		{Buffer: []byte("fourth"), Ext: "txt"},
+	}
+	results, err := client.UploadBatchContext(ctx, files, 1)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("UploadBatchContext() error = %v, want %v", err, context.Canceled)
+	}
+
+	if r := results[0]; r.Err != nil || r.Skipped || string(c.storage.file(r.Response.RemoteFileId)) != "first" {
+		t.Errorf("results[0] = %+v, want the first file committed", r)
+	}
+	if r := results[1]; !errors.Is(r.Err, context.Canceled) || r.Skipped || r.Response != nil {
+		t.Errorf("results[1] = %+v, want the upload in flight aborted", r)
+	}
+	for i, r := range results[2:] {
+		if !r.Skipped || !errors.Is(r.Err, context.Canceled) {
+			t.Errorf("results[%d] = %+v, want it skipped", i+2, r)
+		}
+	}
+	// the storage drops the aborted upload once its connection is gone
+	if !waitFor(func() bool { return c.storage.openConns() == 0 }) {
+		t.Fatalf("storage has %d open connections", c.storage.openConns())
+	}
+	if names := c.storage.fileNames(); len(names) != 1 {
+		t.Errorf("storage holds %v, want only the first file", names)
+	}
+}
@@ -0,0 +1,62 @@
+package fastdfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var ErrTooManyInFlightBytes = errors.New("too many bytes in flight")
+
+// byteBudget is a semaphore counting bytes instead of slots, bounding the
+// memory held by buffer downloads running at the same time.
+type byteBudget struct {
+	lock  sync.Mutex
+	limit int64
+	used  int64
+	block bool
+	// freed is closed and replaced whenever bytes are released, waking
+	// every waiter to check again
+	freed chan struct{}
+}
+
+func newByteBudget(limit int64, block bool) *byteBudget {
+	return &byteBudget{limit: limit, block: block, freed: make(chan struct{})}
+}
+
+// acquire reserves n bytes, waiting for other downloads to release theirs
+// if the budget blocks. A request larger than the whole budget can never
+// be served and fails right away.
+func (this *byteBudget) acquire(ctx context.Context, n int64) error {
+	if n > this.limit {
+		return fmt.Errorf("%w: %d bytes exceed the limit of %d", ErrTooManyInFlightBytes, n, this.limit)
+	}
+	for {
+		this.lock.Lock()
+		if this.used+n <= this.limit {
+			this.used += n
+			this.lock.Unlock()
+			return nil
+		}
+		freed := this.freed
+		this.lock.Unlock()
+
+		if !this.block {
+			return ErrTooManyInFlightBytes
+		}
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (this *byteBudget) release(n int64) {
+	this.lock.Lock()
+	this.used -= n
+	close(this.freed)
+	this.freed = make(chan struct{})
+	this.lock.Unlock()
+}
@@ -0,0 +1,142 @@
+package fastdfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestByteBudget(t *testing.T) {
+	b := newByteBudget(100, false)
+	steps := []struct {
+		name    string
+		acquire int64 // released if negative
+		wantErr bool
+	}{
+		{"first", 60, false},
+		{"over the rest", 50, true},
+		{"the rest", 40, false},
+		{"release first", -60, false},
+		{"after release", 50, false},
+		{"over the limit", 101, true},
+	}
+	for _, step := range steps {
+		if step.acquire < 0 {
+			b.release(-step.acquire)
+			continue
+		}
+		err := b.acquire(context.Background(), step.acquire)
+		if step.wantErr != errors.Is(err, ErrTooManyInFlightBytes) {
+			t.Fatalf("%s: acquire(%d) error = %v, want failure %v", step.name, step.acquire, err, step.wantErr)
+		}
+	}
+}
+
+func TestByteBudgetBlocks(t *testing.T) {
+	b := newByteBudget(100, true)
+	if err := b.acquire(context.Background(), 80); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := b.acquire(ctx, 30); err != context.DeadlineExceeded {
+		t.Fatalf("acquire() with an ended context error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	acquired := make(chan error)
+	go func() { acquired <- b.acquire(context.Background(), 30) }()
+	select {
+	case err := <-acquired:
+		t.Fatalf("acquire() returned %v before bytes were released", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	b.release(80)
+	if err := <-acquired; err != nil {
+		t.Fatalf("acquire() after release error = %v", err)
+	}
+}
+
+func TestConcurrentBufferDownloads(t *testing.T) {
+	c := newFakeCluster(t)
+	defer c.close()
+	const size = 64 << 10
+	content := bytes.Repeat([]byte("0123456789abcdef"), size/16)
+	client := c.client(t, func(cfg *Config) {
+		cfg.MaxConns = 16
+		cfg.MaxInFlightBytes = 2 * size
+		cfg.BlockOnMaxInFlightBytes = true
+	})
+	ur, err := client.UploadByBuffer(content, "bin")
+	if err != nil {
+		t.Fatalf("UploadByBuffer() error = %v", err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			dr, err := client.DownloadToBuffer(ur.fileId(), 0, 0)
+			if err == nil && !bytes.Equal(dr.Content.([]byte), content) {
+				err = errors.New("downloaded content differs")
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("DownloadToBuffer() error = %v", err)
+		}
+	}
+	if client.budget.used != 0 {
+		t.Errorf("%d bytes still held after every download ended", client.budget.used)
+	}
+
+	small := c.client(t, func(cfg *Config) { cfg.MaxInFlightBytes = size - 1 })
+	if _, err := small.DownloadToBuffer(ur.fileId(), 0, 0); !errors.Is(err, ErrTooManyInFlightBytes) {
+		t.Fatalf("DownloadToBuffer() over the limit error = %v, want %v", err, ErrTooManyInFlightBytes)
+	}
+	if _, err := small.DownloadToBuffer(ur.fileId(), 0, size-1); err != nil {
+		t.Fatalf("DownloadToBuffer() within the limit error = %v", err)
+	}
+}
+
+func TestMaxConcurrentOpsBlocksUntilContextEnds(t *testing.T) {
+	c := newFakeCluster(t)
+	defer c.close()
+	client := c.client(t, func(cfg *Config) {
+		cfg.MaxConcurrentOps = 1
+		cfg.BlockOnMaxConcurrentOps = true
+	})
+	if err := client.acquireOp(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.UploadByBufferContext(ctx, []byte("content"), "txt")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != context.DeadlineExceeded {
+			t.Errorf("UploadByBufferContext() waiting for a slot error = %v, want %v", err, context.DeadlineExceeded)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("UploadByBufferContext() kept waiting for a slot after its context ended")
+	}
+
+	client.releaseOp()
+	if _, err := client.UploadByBuffer([]byte("content"), "txt"); err != nil {
+		t.Fatalf("UploadByBuffer() after the slot was freed error = %v", err)
+	}
+}
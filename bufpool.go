@@ -0,0 +1,12 @@
+package fastdfs
+
+import "sync"
+
+// Buffers used for a single exchange with a tracker or storage are reused
+// across requests. None of them may end up in a returned response: copy
+// out what is kept before putting them back.
+var (
+	headerBufPool = sync.Pool{New: func() interface{} { b := make([]byte, 10); return &b }}
+	recvBufPool   = sync.Pool{New: func() interface{} { b := make([]byte, 256); return &b }}
+	chunkBufPool  = sync.Pool{New: func() interface{} { b := make([]byte, uploadChunkSize); return &b }}
+)
@@ -1,15 +1,31 @@
 package fastdfs
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 )
 
+var ErrTooManyRequests = errors.New("too many concurrent operations")
+
+var ErrGroupNotAllowed = errors.New("storage group not allowed")
+
+var ErrDraining = errors.New("client is draining")
+
+var ErrInsufficientSpace = errors.New("not enough free space in storage group")
+
 var (
-	logger                                          = NewLogger()
-	storagePoolChan      chan *storagePool          = make(chan *storagePool, 1)
-	storagePoolMap       map[string]*ConnectionPool = make(map[string]*ConnectionPool)
-	fetchStoragePoolChan chan interface{}           = make(chan interface{}, 1)
-	quit                 chan bool
+	ErrOffsetBeyondEOF     = errors.New("download offset is beyond the end of the file")
+	ErrRangeNotSatisfiable = errors.New("file is shorter than the requested download range")
 )
 
 type Config struct {
@@ -22,250 +38,1574 @@ type Config struct {
 	//		"10.0.1.69:22122",
 	//		"10.0.1.66:22122",
 	//	}
+	//
+	// IPv6 addresses are written in brackets, like "[2001:db8::1]:22122".
+	// Trackers report storages in a 15 byte field, so storages on IPv6
+	// need addresses of at most 14 characters, like "fd00::17"; queries
+	// answered with longer ones fail.
 	Endpoints []string
+
+	// TrackerPool lets several clients share one tracker connection pool,
+	// e.g. clients with different settings pointing at the same cluster.
+	// Endpoints, SkipTestOnBorrow and TestOnReturn then don't apply to tracker
+	// connections. The pool stays owned by the caller: clients never close
+	// it, so close it once every client using it is done.
+	TrackerPool *ConnectionPool
+
+	// MinConns and MaxConns size every pool, one per storage and one shared
+	// by the trackers: up to MaxConns connections per pool (default 150),
+	// idle and checked out ones together, of which MinConns (default 10)
+	// are opened up front where pools are warmed up.
+	// ConnectTimeout bounds dialing a new connection (default 1m).
+	MinConns       int
+	MaxConns       int
+	ConnectTimeout time.Duration
+
+	// Timeout bounds every single read or write on a tracker or storage
+	// connection (default 30s), so a hung server fails a request in
+	// bounded time instead of blocking it and its connection forever. As
+	// it applies per read or write, transfers taking longer in total are
+	// fine as long as data keeps moving. Negative disables it.
+	Timeout time.Duration
+
+	// MaxIdleTime closes pooled connections that weren't used for that
+	// long, and MaxLifetime those older than that, so connections to a
+	// storage that restarted or sits behind a NAT dropping idle flows
+	// aren't reused. Expired connections are never handed out, and a
+	// background check closes them, keeping MinConns idle ones unless they
+	// are past MaxLifetime. Zero keeps connections forever.
+	MaxIdleTime time.Duration
+	MaxLifetime time.Duration
+
+	// A pooled connection is validated with ACTIVE_TEST before it is handed
+	// out; SkipTestOnBorrow saves that round trip. TestOnReturn validates it
+	// before putting it back, so the next borrower gets a known-good
+	// connection at the cost of a little latency on return.
+	SkipTestOnBorrow bool
+	TestOnReturn     bool
+
+	// ValidateOnBorrow checks that a storage or tracker hasn't closed a
+	// pooled connection, e.g. by restarting, before handing it out, and
+	// dials a new one if it has. Unlike ACTIVE_TEST it takes no round
+	// trip, but it only catches connections the peer closed properly.
+	ValidateOnBorrow bool
+
+	// MaxConcurrentOps caps the number of operations this client runs at the
+	// same time, independent of the pool sizes. Zero means unlimited. When the
+	// limit is reached calls fail with ErrTooManyRequests, or wait for a free
+	// slot if BlockOnMaxConcurrentOps is set. Calls taking a context stop
+	// waiting when it ends and return its error.
+	MaxConcurrentOps        int
+	BlockOnMaxConcurrentOps bool
+
+	// UploadPolicy chooses the group for uploads that don't name one, based
+	// on group stats cached for GroupStatsTTL (default 30s). When nil the
+	// tracker picks the group itself.
+	UploadPolicy  UploadPolicy
+	GroupStatsTTL time.Duration
+
+	// StickyDownloads enables remembering, for up to that many file ids, the
+	// storage that served the last download, so repeated downloads within
+	// StickyTTL (default 10s) skip the tracker and reuse the node's page
+	// cache. Zero disables it.
+	StickyDownloads int
+	StickyTTL       time.Duration
+
+	// StallTimeout aborts an upload with ErrUploadStalled when writing a
+	// single chunk takes longer than this, which usually means the storage
+	// node is degraded. The upload is then started over on a freshly
+	// queried storage up to StallRetries times. A normal upload only becomes
+	// visible once complete, so starting over never leaves a partial file.
+	// Zero disables stall detection.
+	StallTimeout time.Duration
+	StallRetries int
+
+	// SlowThreshold logs a warning for every tracker or storage operation
+	// that takes longer, naming the operation, the server and the duration.
+	// Zero disables it.
+	SlowThreshold time.Duration
+
+	// PreferLowLatency makes downloads read from the storage with the lowest
+	// recently measured latency among those holding the file, instead of the
+	// one the tracker picks. Without recent measurements the tracker's
+	// choice is used.
+	PreferLowLatency bool
+
+	// ReadablePollInterval is how often WaitReadable checks the replicas at
+	// first (default 100ms). The interval doubles after every miss, up to
+	// ReadablePollMaxInterval (default 2s).
+	ReadablePollInterval    time.Duration
+	ReadablePollMaxInterval time.Duration
+
+	// DialRetries redials a tracker or storage that refused a new connection
+	// up to that many times before the operation fails, waiting
+	// DialRetryBackoff (default 50ms) before the first retry and doubling
+	// the wait after each one. This only smooths over transient dial
+	// failures of the chosen server; it never switches to another one.
+	DialRetries      int
+	DialRetryBackoff time.Duration
+
+	// MaxRetries runs an upload, download or delete that failed with a
+	// connection error or timeout up to that many more times, each time on
+	// the storage the tracker picks anew, so a storage that is down doesn't
+	// fail the call. Rejections by a server, like a file too large, are
+	// never retried. The wait before the first retry is RetryBackoff
+	// (default 100ms) and doubles after each one; Defaults.Timeout bounds
+	// all of them together. A delete whose reply was lost may be retried
+	// after it succeeded, and then fails with ENOENT. Downloads to a writer
+	// are only retried as long as nothing was written to it. Zero disables
+	// retries.
+	MaxRetries   int
+	RetryBackoff time.Duration
+
+	// CommitRetries is how often UploadCommitted starts over after a
+	// connection error (default 2), backing off like MaxRetries. Negative
+	// disables it.
+	CommitRetries int
+
+	// AllowedGroups restricts the client to these groups: file ids of other
+	// groups are rejected with ErrGroupNotAllowed before any network call,
+	// and uploads only go to allowed groups. Empty allows every group.
+	AllowedGroups []string
+
+	// OnBackgroundError is called with failures of the pools' housekeeping,
+	// e.g. a storage pool that couldn't be created or a pooled connection
+	// dropped because it failed its return test. These never reach the
+	// caller of an operation. When nil they are logged.
+	OnBackgroundError func(error)
+
+	// WarmUp opens the minimum number of connections to a storage as soon
+	// as the client first talks to it, so a burst of uploads to a new node
+	// doesn't pay for connection setup. By default storage pools start
+	// empty and grow on demand. Tracker pools are always warmed up.
+	WarmUp bool
+
+	// EnableAdmin allows operations that change the cluster itself, like
+	// DeleteStorage. They fail with ErrAdminDisabled otherwise.
+	EnableAdmin bool
+
+	// StrictDownloadRange makes downloads whose offset plus size reaches
+	// past the end of the file fail with ErrRangeNotSatisfiable. By default
+	// they return the bytes up to the end of the file, and DownloadSize of
+	// the response tells how many that were. An offset past the end always
+	// fails with ErrOffsetBeyondEOF.
+	StrictDownloadRange bool
+
+	// TrackerSelect chooses the tracker endpoint of every new tracker
+	// connection: at random (the default), in turn, or the first one in
+	// Endpoints unless it's down, see HealthCheckInterval. Pooled
+	// connections are reused in turn, so queries spread the same way.
+	// EndpointWeights takes precedence when set.
+	TrackerSelect TrackerSelect
+
+	// EndpointWeights makes the client open proportionally more tracker
+	// connections, and so send more queries, to the endpoints with higher
+	// weights, using smooth weighted round-robin. Endpoints missing here
+	// get weight 1. When empty, trackers are picked at random.
+	EndpointWeights map[string]int
+
+	// FreeSpaceCheckThreshold makes uploads of at least that many bytes
+	// first check that the target group has room for them plus
+	// FreeSpaceMargin bytes, and fail with ErrInsufficientSpace otherwise,
+	// instead of failing near the end when a disk fills up. The check uses
+	// the group stats cached for GroupStatsTTL, so it's a guard against
+	// full disks rather than an exact reservation. Zero disables it.
+	FreeSpaceCheckThreshold int64
+	FreeSpaceMargin         int64
+
+	// HealthCheckInterval starts a background check that pings every
+	// tracker endpoint at that interval. New tracker connections avoid the
+	// endpoints that didn't answer, and use them again as soon as they do.
+	// See EndpointStatus. Close stops it. Zero disables it.
+	HealthCheckInterval time.Duration
+
+	// MaxInFlightBytes caps the memory that buffer downloads running at the
+	// same time may hold, counted as the content sizes announced by the
+	// storage servers, so many concurrent DownloadToBuffer calls can't add
+	// up to more than the process can afford. When the limit is reached
+	// such downloads fail with ErrTooManyInFlightBytes, or wait for memory
+	// to be released if BlockOnMaxInFlightBytes is set. A single download
+	// larger than the limit always fails. Zero means unlimited.
+	MaxInFlightBytes        int64
+	BlockOnMaxInFlightBytes bool
+
+	// SOCKS5Proxy routes every tracker and storage connection through a
+	// SOCKS5 server, for clients in network zones without a direct route
+	// to the cluster. Storage addresses are those the tracker reports, so
+	// the proxy must be able to reach them. Nil dials directly.
+	SOCKS5Proxy *SOCKS5Proxy
+
+	// Logger receives what the client logs. Nil discards it; NewLogger
+	// returns one writing to stdout and stderr.
+	Logger Logger
+
+	// Defaults sets the timeout, retries, source preference and progress
+	// callback of every call that doesn't override them, see Defaults.
+	Defaults Defaults
 }
 
+var ErrUploadStalled = errors.New("upload stalled")
+
 type FastDFSClient struct {
-	pool    *ConnectionPool
-	timeout int
-}
+	cfg           Config
+	log           Logger
+	pool          *ConnectionPool
+	ownsPool      bool
+	poolOpts      poolOptions
+	ops           chan struct{}
+	blockOnMaxOps bool
+	uploadPolicy  UploadPolicy
+	allowedGroups map[string]bool
 
-type storagePool struct {
-	addr     string
-	minConns int
-	maxConns int
+	groupStatsLock sync.Mutex
+	groupStats     []GroupStat
+	groupStatsAt   time.Time
+	groupStatsTTL  time.Duration
+
+	capsLock sync.Mutex
+	caps     *Capabilities
+
+	sticky  *stickyCache
+	latency *latencyTracker
+	budget  *byteBudget
+
+	drainLock sync.Mutex
+	draining  bool
+	inFlight  sync.WaitGroup
+
+	// storagePools is nil once the client is closed
+	storagePoolLock sync.Mutex
+	storagePools    map[string]*ConnectionPool
+
+	healthLock    sync.Mutex
+	endpointsDown map[string]bool
+	stopHealth    chan struct{}
+	closeOnce     sync.Once
 }
 
-func init() {
-	go func() {
-		// start a loop
-		for {
-			select {
-			case spd := <-storagePoolChan:
-				ipAddr := spd.addr
-				if sp, ok := storagePoolMap[ipAddr]; ok {
-					fetchStoragePoolChan <- sp
-				} else {
-					var (
-						sp  *ConnectionPool
-						err error
-					)
-					sp, err = NewConnectionPool([]string{ipAddr}, spd.minConns, spd.maxConns)
-					if err != nil {
-						logger.Warn.Println("创建%s连接池时出错: %v", ipAddr, err)
-						fetchStoragePoolChan <- err
-					} else {
-						storagePoolMap[ipAddr] = sp
-						fetchStoragePoolChan <- sp
-					}
-				}
-			case <-quit:
-				break
-			}
+// withDefaults fills in the unset fields of cfg with the values the client
+// actually uses.
+func (cfg Config) withDefaults() Config {
+	if cfg.Logger == nil {
+		cfg.Logger = nopLogger{}
+	}
+	if cfg.MaxConns <= 0 {
+		cfg.MaxConns = 150
+	}
+	if cfg.MinConns <= 0 {
+		cfg.MinConns = 10
+	}
+	if cfg.MinConns > cfg.MaxConns {
+		cfg.MinConns = cfg.MaxConns
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 30 * time.Second
+	}
+	if cfg.ConnectTimeout <= 0 {
+		cfg.ConnectTimeout = time.Minute
+	}
+	if cfg.GroupStatsTTL <= 0 {
+		cfg.GroupStatsTTL = 30 * time.Second
+	}
+	if cfg.StickyDownloads > 0 && cfg.StickyTTL <= 0 {
+		cfg.StickyTTL = 10 * time.Second
+	}
+	if cfg.DialRetries > 0 && cfg.DialRetryBackoff <= 0 {
+		cfg.DialRetryBackoff = 50 * time.Millisecond
+	}
+	if cfg.CommitRetries == 0 {
+		cfg.CommitRetries = 2
+	}
+	if (cfg.MaxRetries > 0 || cfg.CommitRetries > 0) && cfg.RetryBackoff <= 0 {
+		cfg.RetryBackoff = 100 * time.Millisecond
+	}
+	if cfg.ReadablePollInterval <= 0 {
+		cfg.ReadablePollInterval = 100 * time.Millisecond
+	}
+	if cfg.ReadablePollMaxInterval < cfg.ReadablePollInterval {
+		cfg.ReadablePollMaxInterval = 2 * time.Second
+		if cfg.ReadablePollMaxInterval < cfg.ReadablePollInterval {
+			cfg.ReadablePollMaxInterval = cfg.ReadablePollInterval
 		}
-	}()
+	}
+	return cfg
 }
 
 func New(cfg Config) (*FastDFSClient, error) {
-	pool, err := NewConnectionPool(cfg.Endpoints, 10, 150)
-	if err != nil {
-		return nil, err
+	// keep the caller from changing the client through its slices and maps
+	cfg = cfg.clone().withDefaults()
+	opts := poolOptions{
+		minConns:     cfg.MinConns,
+		maxConns:     cfg.MaxConns,
+		warmUp:       true,
+		testOnBorrow: !cfg.SkipTestOnBorrow,
+		testOnReturn: cfg.TestOnReturn,
+
+		validateOnBorrow: cfg.ValidateOnBorrow,
+
+		dialRetries:      cfg.DialRetries,
+		dialRetryBackoff: cfg.DialRetryBackoff,
+
+		onBackgroundError: cfg.OnBackgroundError,
+		connectTimeout:    cfg.ConnectTimeout,
+		maxIdleTime:       cfg.MaxIdleTime,
+		maxLifetime:       cfg.MaxLifetime,
+		log:               cfg.Logger,
+	}
+	if cfg.Timeout > 0 {
+		opts.ioTimeout = cfg.Timeout
+	}
+	if cfg.SOCKS5Proxy != nil {
+		var err error
+		if opts.dialContext, err = cfg.SOCKS5Proxy.dialContext(cfg.ConnectTimeout); err != nil {
+			return nil, err
+		}
+	}
+	trackerOpts := opts
+	trackerOpts.weights = cfg.EndpointWeights
+	trackerOpts.trackerSelect = cfg.TrackerSelect
+	pool := cfg.TrackerPool
+	ownsPool := pool == nil
+	if ownsPool {
+		var err error
+		if pool, err = newConnectionPool(cfg.Endpoints, trackerOpts); err != nil {
+			return nil, err
+		}
+	} else if len(cfg.Endpoints) == 0 {
+		cfg.Endpoints = pool.endpoints
+	}
+
+	client := &FastDFSClient{
+		cfg:           cfg,
+		log:           cfg.Logger,
+		pool:          pool,
+		ownsPool:      ownsPool,
+		poolOpts:      opts,
+		blockOnMaxOps: cfg.BlockOnMaxConcurrentOps,
+		uploadPolicy:  cfg.UploadPolicy,
+		groupStatsTTL: cfg.GroupStatsTTL,
+		storagePools:  make(map[string]*ConnectionPool),
+	}
+	if cfg.StickyDownloads > 0 {
+		client.sticky = newStickyCache(cfg.StickyDownloads, cfg.StickyTTL)
+	}
+	if cfg.PreferLowLatency {
+		client.latency = newLatencyTracker()
+	}
+	if cfg.MaxInFlightBytes > 0 {
+		client.budget = newByteBudget(cfg.MaxInFlightBytes, cfg.BlockOnMaxInFlightBytes)
+	}
+	if cfg.MaxConcurrentOps > 0 {
+		client.ops = make(chan struct{}, cfg.MaxConcurrentOps)
+	}
+	if cfg.HealthCheckInterval > 0 {
+		client.stopHealth = make(chan struct{})
+		go client.healthLoop(cfg.HealthCheckInterval, client.stopHealth)
+	}
+	if len(cfg.AllowedGroups) > 0 {
+		client.allowedGroups = make(map[string]bool, len(cfg.AllowedGroups))
+		for _, groupName := range cfg.AllowedGroups {
+			client.allowedGroups[groupName] = true
+		}
+	}
+	return client, nil
+}
+
+// Config returns a copy of the client's effective configuration, with
+// defaults filled in for the fields that were left unset. Slices and maps
+// are copied too, so changing the copy never affects the client.
+func (this *FastDFSClient) Config() Config {
+	return this.cfg.clone()
+}
+
+// clone copies cfg along with its slices and maps.
+func (cfg Config) clone() Config {
+	cfg.Endpoints = append([]string(nil), cfg.Endpoints...)
+	if cfg.AllowedGroups != nil {
+		cfg.AllowedGroups = append([]string(nil), cfg.AllowedGroups...)
+	}
+	if cfg.EndpointWeights != nil {
+		weights := make(map[string]int, len(cfg.EndpointWeights))
+		for endpoint, weight := range cfg.EndpointWeights {
+			weights[endpoint] = weight
+		}
+		cfg.EndpointWeights = weights
+	}
+	return cfg
+}
+
+// PurgeStoragePool drops the cached connection pool of the storage at
+// ipAddr ("host:port") and closes its idle connections, so the next
+// operation dials fresh ones, e.g. after the node was replaced under the
+// same address. Operations in flight on the old pool finish normally and
+// their connections are closed when released.
+func (this *FastDFSClient) PurgeStoragePool(ipAddr string) {
+	this.storagePoolLock.Lock()
+	sp, ok := this.storagePools[ipAddr]
+	delete(this.storagePools, ipAddr)
+	this.storagePoolLock.Unlock()
+
+	if ok {
+		sp.Close()
+	}
+}
+
+// DialFailures returns the failed connection attempts per tracker and
+// storage endpoint.
+func (this *FastDFSClient) DialFailures() map[string]int64 {
+	failures := this.pool.DialFailures()
+
+	this.storagePoolLock.Lock()
+	defer this.storagePoolLock.Unlock()
+	for _, sp := range this.storagePools {
+		for addr, n := range sp.DialFailures() {
+			failures[addr] += n
+		}
 	}
+	return failures
+}
+
+// PoolStats returns the stats of the tracker pool, keyed by its endpoints
+// joined with commas, and of every storage pool, keyed by the storage's
+// address.
+func (this *FastDFSClient) PoolStats() map[string]PoolStat {
+	stats := map[string]PoolStat{strings.Join(this.pool.endpoints, ","): this.pool.Stats()}
 
-	return &FastDFSClient{pool: pool}, nil
+	this.storagePoolLock.Lock()
+	defer this.storagePoolLock.Unlock()
+	for addr, sp := range this.storagePools {
+		stats[addr] = sp.Stats()
+	}
+	return stats
 }
 
+// Close does nothing.
+//
+// Deprecated: every client owns its storage pools now, close them with
+// FastDFSClient.Close.
 func Close() {
-	quit <- true
 }
 
 func (this *FastDFSClient) UploadByFilename(filename string) (*UploadFileResponse, error) {
+	return this.UploadByFilenameContext(context.Background(), filename)
+}
+
+// UploadByFilenameContext is UploadByFilename bound to ctx. If ctx is done
+// mid-transfer the storage connection is closed instead of being pooled;
+// the storage server drops the incomplete file, so nothing is left behind.
+// Only if ctx fires after the server stored the file but before the reply
+// arrives can the file exist without its id being returned.
+func (this *FastDFSClient) UploadByFilenameContext(ctx context.Context, filename string, opts ...CallOption) (*UploadFileResponse, error) {
+	if err := this.acquireOp(ctx); err != nil {
+		return nil, err
+	}
+	defer this.releaseOp()
+
+	co := this.callOptions(opts)
+	ctx, cancel := co.context(ctx)
+	defer cancel()
+
 	if err := fdfsCheckFile(filename); err != nil {
 		return nil, errors.New(err.Error() + "(uploading)")
 	}
 
-	tc := &TrackerClient{this.pool}
-	storeServ, err := tc.trackerQueryStorageStorWithoutGroup()
-	if err != nil {
+	tc := this.trackerClientContext(ctx)
+	return this.uploadWithRetries(tc, fileSizeOf(filename), co.stallRetries, co.retries, func() (*StorageServer, error) {
+		return this.queryUploadStorage(tc)
+	}, func(store *StorageClient, storeServ *StorageServer) (*UploadFileResponse, error) {
+		store.progress = co.progress
+		return store.storageUploadByFilename(ctx, tc, storeServ, filename)
+	})
+}
+
+func (this *FastDFSClient) UploadByBuffer(filebuffer []byte, fileExtName string) (*UploadFileResponse, error) {
+	return this.UploadByBufferContext(context.Background(), filebuffer, fileExtName)
+}
+
+// UploadByBufferContext is UploadByBuffer bound to ctx.
+func (this *FastDFSClient) UploadByBufferContext(ctx context.Context, filebuffer []byte, fileExtName string, opts ...CallOption) (*UploadFileResponse, error) {
+	if err := this.acquireOp(ctx); err != nil {
 		return nil, err
 	}
+	defer this.releaseOp()
 
-	storagePool, err := this.getStoragePool(storeServ.ipAddr)
-	store := &StorageClient{storagePool}
+	co := this.callOptions(opts)
+	ctx, cancel := co.context(ctx)
+	defer cancel()
 
-	return store.storageUploadByFilename(tc, storeServ, filename)
+	tc := this.trackerClientContext(ctx)
+	return this.uploadWithRetries(tc, int64(len(filebuffer)), co.stallRetries, co.retries, func() (*StorageServer, error) {
+		return this.queryUploadStorage(tc)
+	}, func(store *StorageClient, storeServ *StorageServer) (*UploadFileResponse, error) {
+		store.progress = co.progress
+		return store.storageUploadByBuffer(ctx, tc, storeServ, filebuffer, fileExtName)
+	})
 }
 
-func (this *FastDFSClient) UploadByBuffer(filebuffer []byte, fileExtName string) (*UploadFileResponse, error) {
-	tc := &TrackerClient{this.pool}
-	storeServ, err := tc.trackerQueryStorageStorWithoutGroup()
-	if err != nil {
+// UploadByReader uploads exactly size bytes read from r, streaming them to
+// the storage in chunks instead of holding the whole file in memory. If r
+// ends early the upload is aborted with ErrShortUpload and the storage
+// discards what it got. A stalled upload is only started over elsewhere if
+// r is an io.Seeker, to rewind it.
+func (this *FastDFSClient) UploadByReader(r io.Reader, size int64, fileExtName string) (*UploadFileResponse, error) {
+	return this.UploadByReaderContext(context.Background(), r, size, fileExtName)
+}
+
+// UploadByReaderContext is UploadByReader bound to ctx.
+func (this *FastDFSClient) UploadByReaderContext(ctx context.Context, r io.Reader, size int64, fileExtName string, opts ...CallOption) (*UploadFileResponse, error) {
+	if size < 0 {
+		return nil, fmt.Errorf("invalid upload size %d", size)
+	}
+	if err := this.acquireOp(ctx); err != nil {
 		return nil, err
 	}
+	defer this.releaseOp()
 
-	storagePool, err := this.getStoragePool(storeServ.ipAddr)
+	co := this.callOptions(opts)
+	ctx, cancel := co.context(ctx)
+	defer cancel()
+
+	var (
+		seeker       io.Seeker
+		start        int64
+		stallRetries int
+		retries      int
+		started      bool
+	)
+	if s, ok := r.(io.Seeker); ok {
+		if pos, err := s.Seek(0, io.SeekCurrent); err == nil {
+			seeker, start = s, pos
+			stallRetries, retries = co.stallRetries, co.retries
+		}
+	}
+
+	tc := this.trackerClientContext(ctx)
+	return this.uploadWithRetries(tc, size, stallRetries, retries, func() (*StorageServer, error) {
+		return this.queryUploadStorage(tc)
+	}, func(store *StorageClient, storeServ *StorageServer) (*UploadFileResponse, error) {
+		if started {
+			if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+				return nil, err
+			}
+		}
+		started = true
+		store.progress = co.progress
+		return store.storageUploadByReader(ctx, tc, storeServ, r, size, fileExtName)
+	})
+}
+
+var ErrFileChanged = errors.New("file changed size during upload")
+
+// UploadFile uploads the whole of f, streaming it like UploadByReader. The
+// size comes from f.Stat and the extension from the name of f. If the file
+// grows or shrinks before it was sent completely, the upload is aborted
+// with ErrFileChanged. f is read at absolute offsets, so its own offset
+// doesn't matter and is left alone.
+func (this *FastDFSClient) UploadFile(f *os.File) (*UploadFileResponse, error) {
+	return this.UploadFileContext(context.Background(), f)
+}
+
+// UploadFileContext is UploadFile bound to ctx.
+func (this *FastDFSClient) UploadFileContext(ctx context.Context, f *os.File, opts ...CallOption) (*UploadFileResponse, error) {
+	fileInfo, err := f.Stat()
 	if err != nil {
-		logger.Error.Println("创建storage连接池时出错: %v", err)
 		return nil, err
 	}
-	store := &StorageClient{storagePool}
+	if !fileInfo.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", f.Name())
+	}
+	size := fileInfo.Size()
+	r := &fileReader{SectionReader: io.NewSectionReader(f, 0, size), f: f, size: size}
+	resp, err := this.UploadByReaderContext(ctx, r, size, getFileExt(filepath.Base(f.Name())), opts...)
+	if errors.Is(err, ErrShortUpload) {
+		return nil, fmt.Errorf("%w: %v", ErrFileChanged, err)
+	}
+	return resp, err
+}
+
+// fileReader reads a file up to the size it had when the upload started.
+// Right after handing out the last byte it checks that there is no more,
+// so a grown file fails the upload before the storage has all it expects.
+type fileReader struct {
+	*io.SectionReader
+	f    *os.File
+	size int64
+}
+
+func (this *fileReader) Read(p []byte) (int, error) {
+	n, err := this.SectionReader.Read(p)
+	if pos, _ := this.Seek(0, io.SeekCurrent); n > 0 && pos == this.size {
+		var b [1]byte
+		if m, _ := this.f.ReadAt(b[:], this.size); m > 0 {
+			return 0, ErrFileChanged
+		}
+	}
+	return n, err
+}
+
+// UploadByBufferWithStorePath uploads to the given store path ("Mxx") of the
+// storage server the tracker picks, instead of the one the tracker
+// suggests. This is the only placement control the protocol offers: the
+// two-level sub directory and the file name are always generated by the
+// storage server, so a file name hint cannot be passed along. Use
+// DecodeFileIdMeta to read the store path back from an existing file id.
+func (this *FastDFSClient) UploadByBufferWithStorePath(filebuffer []byte, fileExtName string, storePathIndex int) (*UploadFileResponse, error) {
+	return this.UploadByBufferWithStorePathContext(context.Background(), filebuffer, fileExtName, storePathIndex)
+}
+
+// UploadByBufferWithStorePathContext is UploadByBufferWithStorePath bound
+// to ctx.
+func (this *FastDFSClient) UploadByBufferWithStorePathContext(ctx context.Context, filebuffer []byte, fileExtName string, storePathIndex int, opts ...CallOption) (*UploadFileResponse, error) {
+	if storePathIndex < 0 || storePathIndex > 0xFF {
+		return nil, fmt.Errorf("invalid store path index %d", storePathIndex)
+	}
+	if err := this.acquireOp(ctx); err != nil {
+		return nil, err
+	}
+	defer this.releaseOp()
 
-	return store.storageUploadByBuffer(tc, storeServ, filebuffer, fileExtName)
+	co := this.callOptions(opts)
+	ctx, cancel := co.context(ctx)
+	defer cancel()
+
+	tc := this.trackerClientContext(ctx)
+	return this.uploadWithRetries(tc, int64(len(filebuffer)), co.stallRetries, co.retries, func() (*StorageServer, error) {
+		storeServ, err := this.queryUploadStorage(tc)
+		if err != nil {
+			return nil, err
+		}
+		pinned := *storeServ
+		pinned.storePathIndex = storePathIndex
+		return &pinned, nil
+	}, func(store *StorageClient, storeServ *StorageServer) (*UploadFileResponse, error) {
+		store.progress = co.progress
+		return store.storageUploadByBuffer(ctx, tc, storeServ, filebuffer, fileExtName)
+	})
+}
+
+var ErrNoWritableStorage = errors.New("no writable storage in group")
+
+// UploadByBufferToGroup uploads to groupName instead of the group the
+// tracker or UploadPolicy picks. If the group doesn't exist, or has no
+// active storage with room for the file, it fails with an error wrapping
+// ErrNoWritableStorage.
+func (this *FastDFSClient) UploadByBufferToGroup(groupName string, filebuffer []byte, fileExtName string) (*UploadFileResponse, error) {
+	return this.UploadByBufferToGroupContext(context.Background(), groupName, filebuffer, fileExtName)
+}
+
+// UploadByBufferToGroupContext is UploadByBufferToGroup bound to ctx.
+func (this *FastDFSClient) UploadByBufferToGroupContext(ctx context.Context, groupName string, filebuffer []byte, fileExtName string, opts ...CallOption) (*UploadFileResponse, error) {
+	if err := this.acquireOp(ctx); err != nil {
+		return nil, err
+	}
+	defer this.releaseOp()
+
+	if !this.groupAllowed(groupName) {
+		return nil, ErrGroupNotAllowed
+	}
+	co := this.callOptions(opts)
+	ctx, cancel := co.context(ctx)
+	defer cancel()
+
+	tc := this.trackerClientContext(ctx)
+	return this.uploadWithRetries(tc, int64(len(filebuffer)), co.stallRetries, co.retries, func() (*StorageServer, error) {
+		return this.queryGroupStorage(tc, groupName)
+	}, func(store *StorageClient, storeServ *StorageServer) (*UploadFileResponse, error) {
+		store.progress = co.progress
+		return store.storageUploadByBuffer(ctx, tc, storeServ, filebuffer, fileExtName)
+	})
+}
+
+// UploadByFilenameToGroup is UploadByBufferToGroup for a local file.
+func (this *FastDFSClient) UploadByFilenameToGroup(groupName string, filename string) (*UploadFileResponse, error) {
+	return this.UploadByFilenameToGroupContext(context.Background(), groupName, filename)
+}
+
+// UploadByFilenameToGroupContext is UploadByFilenameToGroup bound to ctx.
+func (this *FastDFSClient) UploadByFilenameToGroupContext(ctx context.Context, groupName string, filename string, opts ...CallOption) (*UploadFileResponse, error) {
+	if err := this.acquireOp(ctx); err != nil {
+		return nil, err
+	}
+	defer this.releaseOp()
+
+	if !this.groupAllowed(groupName) {
+		return nil, ErrGroupNotAllowed
+	}
+	if err := fdfsCheckFile(filename); err != nil {
+		return nil, errors.New(err.Error() + "(uploading)")
+	}
+	co := this.callOptions(opts)
+	ctx, cancel := co.context(ctx)
+	defer cancel()
+
+	tc := this.trackerClientContext(ctx)
+	return this.uploadWithRetries(tc, fileSizeOf(filename), co.stallRetries, co.retries, func() (*StorageServer, error) {
+		return this.queryGroupStorage(tc, groupName)
+	}, func(store *StorageClient, storeServ *StorageServer) (*UploadFileResponse, error) {
+		store.progress = co.progress
+		return store.storageUploadByFilename(ctx, tc, storeServ, filename)
+	})
+}
+
+// queryGroupStorage asks the tracker for the storage to upload to in
+// groupName, telling a missing or full group apart from other failures.
+func (this *FastDFSClient) queryGroupStorage(tc *TrackerClient, groupName string) (*StorageServer, error) {
+	storeServ, err := tc.trackerQueryStorageStorWithGroup(groupName)
+	var errno Errno
+	if errors.As(err, &errno) && (errno.status == enoent || errno.status == enospc) {
+		return nil, fmt.Errorf("%w %s: %v", ErrNoWritableStorage, groupName, err)
+	}
+	return storeServ, err
 }
 
 func (this *FastDFSClient) UploadSlaveByFilename(filename, remoteFileId, prefixName string) (*UploadFileResponse, error) {
+	return this.UploadSlaveByFilenameContext(context.Background(), filename, remoteFileId, prefixName)
+}
+
+// UploadSlaveByFilenameContext is UploadSlaveByFilename bound to ctx.
+func (this *FastDFSClient) UploadSlaveByFilenameContext(ctx context.Context, filename, remoteFileId, prefixName string, opts ...CallOption) (*UploadFileResponse, error) {
+	if err := this.acquireOp(ctx); err != nil {
+		return nil, err
+	}
+	defer this.releaseOp()
+
+	co := this.callOptions(opts)
+	ctx, cancel := co.context(ctx)
+	defer cancel()
+
 	if err := fdfsCheckFile(filename); err != nil {
 		return nil, errors.New(err.Error() + "(uploading)")
 	}
 
-	tmp, err := splitRemoteFileId(remoteFileId)
+	tmp, err := this.splitRemoteFileId(remoteFileId)
 	if err != nil || len(tmp) != 2 {
 		return nil, err
 	}
 	groupName := tmp[0]
 	remoteFilename := tmp[1]
 
-	tc := &TrackerClient{this.pool}
-	storeServ, err := tc.trackerQueryStorageStorWithGroup(groupName)
-	if err != nil {
+	tc := this.trackerClientContext(ctx)
+	return this.uploadWithRetries(tc, fileSizeOf(filename), co.stallRetries, co.retries, func() (*StorageServer, error) {
+		return tc.trackerQueryStorageStorWithGroup(groupName)
+	}, func(store *StorageClient, storeServ *StorageServer) (*UploadFileResponse, error) {
+		store.progress = co.progress
+		return store.storageUploadSlaveByFilename(ctx, tc, storeServ, filename, prefixName, remoteFilename)
+	})
+}
+
+// UploadSlaveByBuffer uploads filebuffer as the slave of remoteFileId
+// named with prefixName and fileExtName, see BuildSlaveFileId.
+func (this *FastDFSClient) UploadSlaveByBuffer(filebuffer []byte, remoteFileId, prefixName, fileExtName string) (*UploadFileResponse, error) {
+	return this.UploadSlaveByBufferContext(context.Background(), filebuffer, remoteFileId, prefixName, fileExtName)
+}
+
+// UploadSlaveByBufferContext is UploadSlaveByBuffer bound to ctx.
+func (this *FastDFSClient) UploadSlaveByBufferContext(ctx context.Context, filebuffer []byte, remoteFileId, prefixName, fileExtName string, opts ...CallOption) (*UploadFileResponse, error) {
+	if err := this.acquireOp(ctx); err != nil {
 		return nil, err
 	}
+	defer this.releaseOp()
 
-	storagePool, err := this.getStoragePool(storeServ.ipAddr)
-	store := &StorageClient{storagePool}
-
-	return store.storageUploadSlaveByFilename(tc, storeServ, filename, prefixName, remoteFilename)
-}
+	co := this.callOptions(opts)
+	ctx, cancel := co.context(ctx)
+	defer cancel()
 
-func (this *FastDFSClient) UploadSlaveByBuffer(filebuffer []byte, remoteFileId, fileExtName string) (*UploadFileResponse, error) {
-	tmp, err := splitRemoteFileId(remoteFileId)
+	tmp, err := this.splitRemoteFileId(remoteFileId)
 	if err != nil || len(tmp) != 2 {
 		return nil, err
 	}
 	groupName := tmp[0]
 	remoteFilename := tmp[1]
 
-	tc := &TrackerClient{this.pool}
-	storeServ, err := tc.trackerQueryStorageStorWithGroup(groupName)
-	if err != nil {
+	tc := this.trackerClientContext(ctx)
+	return this.uploadWithRetries(tc, int64(len(filebuffer)), co.stallRetries, co.retries, func() (*StorageServer, error) {
+		return tc.trackerQueryStorageStorWithGroup(groupName)
+	}, func(store *StorageClient, storeServ *StorageServer) (*UploadFileResponse, error) {
+		store.progress = co.progress
+		return store.storageUploadSlaveByBuffer(ctx, tc, storeServ, filebuffer, prefixName, remoteFilename, fileExtName)
+	})
+}
+
+func (this *FastDFSClient) UploadAppenderByFilename(filename string) (*UploadFileResponse, error) {
+	return this.UploadAppenderByFilenameContext(context.Background(), filename)
+}
+
+// UploadAppenderByFilenameContext is UploadAppenderByFilename bound to ctx,
+// with the same cancellation guarantees as UploadByFilenameContext: the
+// appender file is only created once the whole content has arrived.
+func (this *FastDFSClient) UploadAppenderByFilenameContext(ctx context.Context, filename string, opts ...CallOption) (*UploadFileResponse, error) {
+	if err := this.acquireOp(ctx); err != nil {
 		return nil, err
 	}
+	defer this.releaseOp()
 
-	storagePool, err := this.getStoragePool(storeServ.ipAddr)
-	store := &StorageClient{storagePool}
-
-	return store.storageUploadSlaveByBuffer(tc, storeServ, filebuffer, remoteFilename, fileExtName)
-}
+	co := this.callOptions(opts)
+	ctx, cancel := co.context(ctx)
+	defer cancel()
 
-func (this *FastDFSClient) UploadAppenderByFilename(filename string) (*UploadFileResponse, error) {
 	if err := fdfsCheckFile(filename); err != nil {
 		return nil, errors.New(err.Error() + "(uploading)")
 	}
 
-	tc := &TrackerClient{this.pool}
-	storeServ, err := tc.trackerQueryStorageStorWithoutGroup()
-	if err != nil {
+	tc := this.trackerClientContext(ctx)
+	return this.uploadWithRetries(tc, fileSizeOf(filename), co.stallRetries, co.retries, func() (*StorageServer, error) {
+		return this.queryUploadStorage(tc)
+	}, func(store *StorageClient, storeServ *StorageServer) (*UploadFileResponse, error) {
+		store.progress = co.progress
+		return store.storageUploadAppenderByFilename(ctx, tc, storeServ, filename)
+	})
+}
+
+func (this *FastDFSClient) UploadAppenderByBuffer(filebuffer []byte, fileExtName string) (*UploadFileResponse, error) {
+	return this.UploadAppenderByBufferContext(context.Background(), filebuffer, fileExtName)
+}
+
+// UploadAppenderByBufferContext is UploadAppenderByBuffer bound to ctx.
+func (this *FastDFSClient) UploadAppenderByBufferContext(ctx context.Context, filebuffer []byte, fileExtName string, opts ...CallOption) (*UploadFileResponse, error) {
+	if err := this.acquireOp(ctx); err != nil {
 		return nil, err
 	}
+	defer this.releaseOp()
 
-	storagePool, err := this.getStoragePool(storeServ.ipAddr)
-	store := &StorageClient{storagePool}
+	co := this.callOptions(opts)
+	ctx, cancel := co.context(ctx)
+	defer cancel()
 
-	return store.storageUploadAppenderByFilename(tc, storeServ, filename)
+	tc := this.trackerClientContext(ctx)
+	return this.uploadWithRetries(tc, int64(len(filebuffer)), co.stallRetries, co.retries, func() (*StorageServer, error) {
+		return this.queryUploadStorage(tc)
+	}, func(store *StorageClient, storeServ *StorageServer) (*UploadFileResponse, error) {
+		store.progress = co.progress
+		return store.storageUploadAppenderByBuffer(ctx, tc, storeServ, filebuffer, fileExtName)
+	})
 }
 
-func (this *FastDFSClient) UploadAppenderByBuffer(filebuffer []byte, fileExtName string) (*UploadFileResponse, error) {
-	tc := &TrackerClient{this.pool}
-	storeServ, err := tc.trackerQueryStorageStorWithoutGroup()
-	if err != nil {
-		return nil, err
+func (this *FastDFSClient) DeleteFile(remoteFileId string) error {
+	return this.DeleteFileContext(context.Background(), remoteFileId)
+}
+
+// DeleteFileContext is DeleteFile bound to ctx.
+func (this *FastDFSClient) DeleteFileContext(ctx context.Context, remoteFileId string, opts ...CallOption) error {
+	if err := this.acquireOp(ctx); err != nil {
+		return err
 	}
+	defer this.releaseOp()
 
-	storagePool, err := this.getStoragePool(storeServ.ipAddr)
-	store := &StorageClient{storagePool}
+	co := this.callOptions(opts)
+	ctx, cancel := co.context(ctx)
+	defer cancel()
 
-	return store.storageUploadAppenderByBuffer(tc, storeServ, filebuffer, fileExtName)
+	return this.withRetries(ctx, co.retries, nil, func() error {
+		return this.deleteFile(ctx, remoteFileId)
+	})
 }
 
-func (this *FastDFSClient) DeleteFile(remoteFileId string) error {
-	tmp, err := splitRemoteFileId(remoteFileId)
+func (this *FastDFSClient) deleteFile(ctx context.Context, remoteFileId string) error {
+	tmp, err := this.splitRemoteFileId(remoteFileId)
 	if err != nil || len(tmp) != 2 {
 		return err
 	}
 	groupName := tmp[0]
 	remoteFilename := tmp[1]
 
-	tc := &TrackerClient{this.pool}
+	tc := this.trackerClientContext(ctx)
 	storeServ, err := tc.trackerQueryStorageUpdate(groupName, remoteFilename)
 	if err != nil {
 		return err
 	}
 
 	storagePool, err := this.getStoragePool(storeServ.ipAddr)
-	store := &StorageClient{storagePool}
+	if err != nil {
+		return err
+	}
+	store := this.storageClient(storagePool)
 
-	return store.storageDeleteFile(tc, storeServ, remoteFilename)
+	return store.storageDeleteFile(ctx, tc, storeServ, remoteFilename)
 }
 
+// QueryFileInfo returns what the storage holding remoteFileId knows about
+// it: size, creation time, crc32 and the storage it was uploaded to. It
+// asks the storage the tracker routes updates to, so a file that was just
+// uploaded is found even before it is replicated. A missing file fails
+// with an error wrapping Errno ENOENT.
+func (this *FastDFSClient) QueryFileInfo(remoteFileId string) (*FileInfo, error) {
+	if err := this.acquireOp(context.Background()); err != nil {
+		return nil, err
+	}
+	defer this.releaseOp()
+
+	tmp, err := this.splitRemoteFileId(remoteFileId)
+	if err != nil {
+		return nil, err
+	}
+	groupName, remoteFilename := tmp[0], tmp[1]
+
+	tc := this.trackerClient()
+	storeServ, err := tc.trackerQueryStorageUpdate(groupName, remoteFilename)
+	if err != nil {
+		return nil, err
+	}
+	storagePool, err := this.getStoragePool(storeServ.ipAddr)
+	if err != nil {
+		return nil, err
+	}
+	return this.storageClient(storagePool).storageQueryFileInfo(context.Background(), tc, storeServ, remoteFilename)
+}
+
+// FileExists reports whether remoteFileId names a file the storage it
+// belongs to has, by querying its file info. A missing file is not an
+// error; failing to reach the tracker or storage is.
+func (this *FastDFSClient) FileExists(remoteFileId string) (bool, error) {
+	_, err := this.QueryFileInfo(remoteFileId)
+	if errors.Is(err, ErrFileNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// ReplaceAppenderContent replaces the whole content of an appender file
+// while keeping its file id, by truncating it to zero and then writing
+// newContent from offset 0. This is two separate storage commands and not
+// atomic: a concurrent reader may see an empty or partially written file,
+// and if the second step fails the file is left empty. It fails with
+// ErrNotAppenderFile for other files.
+func (this *FastDFSClient) ReplaceAppenderContent(remoteFileId string, newContent []byte) error {
+	return this.ReplaceAppenderContentContext(context.Background(), remoteFileId, newContent)
+}
+
+// ReplaceAppenderContentContext is ReplaceAppenderContent bound to ctx. If
+// ctx ends between the two steps the file is left empty.
+func (this *FastDFSClient) ReplaceAppenderContentContext(ctx context.Context, remoteFileId string, newContent []byte) error {
+	if err := this.acquireOp(ctx); err != nil {
+		return err
+	}
+	defer this.releaseOp()
+
+	t, err := this.appenderTarget(ctx, remoteFileId)
+	if err != nil {
+		return err
+	}
+	if err = t.store.storageTruncateFile(ctx, t.tc, t.storeServ, t.remoteFilename, 0); err != nil {
+		return err
+	}
+	if len(newContent) == 0 {
+		return nil
+	}
+	return t.store.storageModifyFile(ctx, t.tc, t.storeServ, t.remoteFilename, 0, bytes.NewReader(newContent), int64(len(newContent)))
+}
+
+// DownloadToFile writes downloadSize bytes of the file starting at offset
+// to localFilename. A downloadSize of 0 or -1 downloads everything from
+// offset to the end of the file, without knowing its size in advance. An
+// offset past the end fails with ErrOffsetBeyondEOF.
 func (this *FastDFSClient) DownloadToFile(localFilename string, remoteFileId string, offset int64, downloadSize int64) (*DownloadFileResponse, error) {
-	tmp, err := splitRemoteFileId(remoteFileId)
+	return this.DownloadToFileContext(context.Background(), localFilename, remoteFileId, offset, downloadSize)
+}
+
+// DownloadToFileContext is DownloadToFile bound to ctx.
+func (this *FastDFSClient) DownloadToFileContext(ctx context.Context, localFilename string, remoteFileId string, offset int64, downloadSize int64, opts ...CallOption) (*DownloadFileResponse, error) {
+	if err := this.acquireOp(ctx); err != nil {
+		return nil, err
+	}
+	defer this.releaseOp()
+
+	co := this.callOptions(opts)
+	ctx, cancel := co.context(ctx)
+	defer cancel()
+
+	tmp, err := this.splitRemoteFileId(remoteFileId)
 	if err != nil || len(tmp) != 2 {
 		return nil, err
 	}
 	groupName := tmp[0]
 	remoteFilename := tmp[1]
 
-	tc := &TrackerClient{this.pool}
-	storeServ, err := tc.trackerQueryStorageFetch(groupName, remoteFilename)
+	tc := this.trackerClientContext(ctx)
+	var dr *DownloadFileResponse
+	err = this.withRetries(ctx, co.retries, nil, func() error {
+		storeServ, err := this.queryFetchStorage(tc, remoteFileId, groupName, remoteFilename)
+		if err != nil {
+			return err
+		}
+		if co.preferSource {
+			if sourceServ, ok := sourceStorage(remoteFileId, storeServ); ok {
+				storeServ = sourceServ
+			}
+		}
+
+		dr, err = this.downloadWithSourceFallback(remoteFileId, storeServ, func(store *StorageClient, storeServ *StorageServer) (*DownloadFileResponse, error) {
+			store.progress = co.progress
+			return store.storageDownloadToFile(ctx, tc, storeServ, localFilename, offset, downloadSize, remoteFilename)
+		})
+		return err
+	})
+	return dr, err
+}
+
+// DownloadToFileWithProgress is DownloadToFile calling progress with the
+// bytes written so far and the total after every chunk, see WithProgress.
+// The total is the content length the storage announces before sending,
+// so it is known even when downloading to the end of the file. progress
+// runs on the goroutine doing the copy, which waits for it to return.
+func (this *FastDFSClient) DownloadToFileWithProgress(localFilename string, remoteFileId string, offset int64, downloadSize int64,
+	progress func(downloaded, total int64)) (*DownloadFileResponse, error) {
+	return this.DownloadToFileContext(context.Background(), localFilename, remoteFileId, offset, downloadSize, WithProgress(progress))
+}
+
+// DownloadToBuffer returns downloadSize bytes of the file starting at
+// offset in the response's Content. As for DownloadToFile, a downloadSize
+// of 0 or -1 means up to the end of the file.
+func (this *FastDFSClient) DownloadToBuffer(remoteFileId string, offset int64, downloadSize int64) (*DownloadFileResponse, error) {
+	return this.DownloadToBufferContext(context.Background(), remoteFileId, offset, downloadSize)
+}
+
+// DownloadToBufferContext is DownloadToBuffer bound to ctx.
+func (this *FastDFSClient) DownloadToBufferContext(ctx context.Context, remoteFileId string, offset int64, downloadSize int64, opts ...CallOption) (*DownloadFileResponse, error) {
+	if err := this.acquireOp(ctx); err != nil {
+		return nil, err
+	}
+	defer this.releaseOp()
+
+	co := this.callOptions(opts)
+	ctx, cancel := co.context(ctx)
+	defer cancel()
+
+	tmp, err := this.splitRemoteFileId(remoteFileId)
+	if err != nil || len(tmp) != 2 {
+		return nil, err
+	}
+	groupName := tmp[0]
+	remoteFilename := tmp[1]
+
+	tc := this.trackerClientContext(ctx)
+	var dr *DownloadFileResponse
+	err = this.withRetries(ctx, co.retries, nil, func() error {
+		storeServ, err := this.queryFetchStorage(tc, remoteFileId, groupName, remoteFilename)
+		if err != nil {
+			return err
+		}
+		if co.preferSource {
+			if sourceServ, ok := sourceStorage(remoteFileId, storeServ); ok {
+				storeServ = sourceServ
+			}
+		}
+
+		dr, err = this.downloadWithSourceFallback(remoteFileId, storeServ, func(store *StorageClient, storeServ *StorageServer) (*DownloadFileResponse, error) {
+			store.progress = co.progress
+			return store.storageDownloadToBuffer(ctx, tc, storeServ, offset, downloadSize, remoteFilename)
+		})
+		return err
+	})
+	return dr, err
+}
+
+// DownloadSlaveToBuffer is DownloadToBuffer for the slave file of
+// masterFileId with prefixName and fileExtName, e.g. a thumbnail, see
+// BuildSlaveFileId.
+func (this *FastDFSClient) DownloadSlaveToBuffer(masterFileId string, prefixName string, fileExtName string, offset int64, downloadSize int64) (*DownloadFileResponse, error) {
+	slaveFileId, err := BuildSlaveFileId(masterFileId, prefixName, fileExtName)
 	if err != nil {
 		return nil, err
 	}
+	return this.DownloadToBuffer(slaveFileId, offset, downloadSize)
+}
 
-	storagePool, err := this.getStoragePool(storeServ.ipAddr)
-	store := &StorageClient{storagePool}
+// DownloadTransform streams the file through transform into w without
+// buffering it or using temp files, e.g. to resize images on the fly.
+// A nil transform copies the content unchanged. An error on either side
+// aborts the download and its storage connection is closed.
+func (this *FastDFSClient) DownloadTransform(remoteFileId string, transform func(io.Reader) io.Reader, w io.Writer) error {
+	return this.DownloadTransformContext(context.Background(), remoteFileId, transform, w)
+}
+
+// DownloadTransformContext is DownloadTransform bound to ctx.
+func (this *FastDFSClient) DownloadTransformContext(ctx context.Context, remoteFileId string, transform func(io.Reader) io.Reader, w io.Writer, opts ...CallOption) error {
+	if err := this.acquireOp(ctx); err != nil {
+		return err
+	}
+	defer this.releaseOp()
 
-	return store.storageDownloadToFile(tc, storeServ, localFilename, offset, downloadSize, remoteFilename)
+	co := this.callOptions(opts)
+	ctx, cancel := co.context(ctx)
+	defer cancel()
+
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		_, err := this.downloadToWriter(ctx, pw, remoteFileId, 0, 0, co)
+		pw.CloseWithError(err)
+		done <- err
+	}()
+
+	var r io.Reader = pr
+	if transform != nil {
+		r = transform(pr)
+	}
+	_, err := io.Copy(w, r)
+	if err != nil {
+		pr.CloseWithError(err)
+	} else {
+		pr.Close()
+	}
+	// the consumer is done; don't let a storage read that is still blocked
+	// keep the download goroutine and its connection alive
+	cancel()
+	dlErr := <-done
+	if err != nil {
+		return err
+	}
+	return dlErr
 }
 
-func (this *FastDFSClient) DownloadToBuffer(remoteFileId string, offset int64, downloadSize int64) (*DownloadFileResponse, error) {
-	tmp, err := splitRemoteFileId(remoteFileId)
+// DownloadToMmap downloads the file into localFilename and maps it read-only
+// into memory, so huge files can be accessed randomly without copying them
+// into the Go heap. If localFilename is empty a temporary file is used and
+// removed when the returned MmapFile is closed.
+func (this *FastDFSClient) DownloadToMmap(localFilename string, remoteFileId string, offset int64, downloadSize int64) (*MmapFile, error) {
+	removeOnClose := false
+	if localFilename == "" {
+		tmp, err := ioutil.TempFile("", "fastdfs-mmap-")
+		if err != nil {
+			return nil, err
+		}
+		localFilename = tmp.Name()
+		tmp.Close()
+		removeOnClose = true
+	}
+
+	if _, err := this.DownloadToFile(localFilename, remoteFileId, offset, downloadSize); err != nil {
+		if removeOnClose {
+			os.Remove(localFilename)
+		}
+		return nil, err
+	}
+
+	mf, err := mmapFile(localFilename, removeOnClose)
+	if err != nil {
+		if removeOnClose {
+			os.Remove(localFilename)
+		}
+		return nil, err
+	}
+	return mf, nil
+}
+
+// DownloadToWriter streams the file into w as it arrives, e.g. into an
+// http.ResponseWriter, without holding it in memory. It returns the bytes
+// written to w, which are fewer than expected if w fails or the storage
+// connection closes early; the error tells which.
+func (this *FastDFSClient) DownloadToWriter(w io.Writer, remoteFileId string, offset int64, downloadSize int64) (int64, error) {
+	return this.DownloadToWriterContext(context.Background(), w, remoteFileId, offset, downloadSize)
+}
+
+// DownloadToWriterContext is DownloadToWriter bound to ctx.
+func (this *FastDFSClient) DownloadToWriterContext(ctx context.Context, w io.Writer, remoteFileId string, offset int64, downloadSize int64, opts ...CallOption) (int64, error) {
+	if err := this.acquireOp(ctx); err != nil {
+		return 0, err
+	}
+	defer this.releaseOp()
+
+	co := this.callOptions(opts)
+	ctx, cancel := co.context(ctx)
+	defer cancel()
+
+	cw := &countingWriter{w: w}
+	err := this.withRetries(ctx, co.retries, func() bool { return cw.n == 0 }, func() error {
+		_, err := this.downloadToWriter(ctx, cw, remoteFileId, offset, downloadSize, co)
+		return err
+	})
+	return cw.n, err
+}
+
+func (this *FastDFSClient) downloadToWriter(ctx context.Context, w io.Writer, remoteFileId string, offset int64, downloadSize int64, co callOptions) (*DownloadFileResponse, error) {
+	tmp, err := this.splitRemoteFileId(remoteFileId)
 	if err != nil || len(tmp) != 2 {
 		return nil, err
 	}
 	groupName := tmp[0]
 	remoteFilename := tmp[1]
 
-	tc := &TrackerClient{this.pool}
-	storeServ, err := tc.trackerQueryStorageFetch(groupName, remoteFilename)
+	tc := this.trackerClientContext(ctx)
+	storeServ, err := this.queryFetchStorage(tc, remoteFileId, groupName, remoteFilename)
 	if err != nil {
 		return nil, err
 	}
+	if co.preferSource {
+		if sourceServ, ok := sourceStorage(remoteFileId, storeServ); ok {
+			storeServ = sourceServ
+		}
+	}
 
-	storagePool, err := this.getStoragePool(storeServ.ipAddr)
-	store := &StorageClient{storagePool}
-
-	var fileBuffer []byte
-	return store.storageDownloadToBuffer(tc, storeServ, fileBuffer, offset, downloadSize, remoteFilename)
+	return this.downloadWithSourceFallback(remoteFileId, storeServ, func(store *StorageClient, storeServ *StorageServer) (*DownloadFileResponse, error) {
+		store.progress = co.progress
+		return store.storageDownloadToWriter(ctx, tc, storeServ, w, offset, downloadSize, remoteFilename)
+	})
 }
 
-func (this *FastDFSClient) getStoragePool(ipAddr string) (*ConnectionPool, error) {
-	spd := &storagePool{
-		addr:     ipAddr,
-		minConns: 10,
-		maxConns: 150,
+func (this *FastDFSClient) storageClient(storagePool *ConnectionPool) *StorageClient {
+	return &StorageClient{
+		pool:          storagePool,
+		stallTimeout:  this.cfg.StallTimeout,
+		slowThreshold: this.cfg.SlowThreshold,
+		latency:       this.latency,
+		strictRange:   this.cfg.StrictDownloadRange,
+		budget:        this.budget,
+		log:           this.log,
 	}
-	storagePoolChan <- spd
+}
+
+func (this *FastDFSClient) trackerClient() *TrackerClient {
+	return &TrackerClient{pool: this.pool, slowThreshold: this.cfg.SlowThreshold, log: this.log}
+}
+
+// trackerClientContext returns a TrackerClient whose queries give up when
+// ctx ends.
+func (this *FastDFSClient) trackerClientContext(ctx context.Context) *TrackerClient {
+	return &TrackerClient{pool: this.pool, slowThreshold: this.cfg.SlowThreshold, ctx: ctx, log: this.log}
+}
+
+// uploadWithRetries runs upload against the storage chosen by query and,
+// if the transfer stalls or the connection fails, starts over on a freshly
+// queried storage, at most stallRetries times after stalls and retries
+// times after connection errors.
+func (this *FastDFSClient) uploadWithRetries(tc *TrackerClient, size int64, stallRetries int, retries int, query func() (*StorageServer, error),
+	upload func(store *StorageClient, storeServ *StorageServer) (*UploadFileResponse, error)) (*UploadFileResponse, error) {
+	stalls, failures := 0, 0
 	for {
-		select {
-		case result := <-fetchStoragePoolChan:
-			var storagePool *ConnectionPool
-			if err, ok := result.(error); ok {
+		storeServ, err := query()
+		if retryable(err) && failures < retries {
+			if this.retryWait(tc.context(), failures) != nil {
 				return nil, err
-			} else if storagePool, ok = result.(*ConnectionPool); ok {
-				return storagePool, nil
-			} else {
-				return nil, errors.New("none")
 			}
+			failures++
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err = this.checkFreeSpace(tc, storeServ.groupName, size); err != nil {
+			return nil, err
+		}
+
+		storagePool, err := this.getStoragePool(storeServ.ipAddr)
+		if err != nil {
+			this.log.Errorf("创建storage连接池时出错: %v", err)
+			return nil, err
+		}
+
+		ur, err := upload(this.storageClient(storagePool), storeServ)
+		switch {
+		case errors.Is(err, ErrUploadStalled) && stalls < stallRetries:
+			stalls++
+			this.log.Warnf("upload to %s stalled, retrying on another storage", storeServ.ipAddr)
+		case retryable(err) && failures < retries:
+			this.log.Warnf("upload to %s failed, retrying on another storage: %v", storeServ.ipAddr, err)
+			if this.retryWait(tc.context(), failures) != nil {
+				return ur, err
+			}
+			failures++
+		default:
+			return ur, err
+		}
+	}
+}
+
+func (this *FastDFSClient) queryFetchStorage(tc *TrackerClient, remoteFileId string, groupName string, remoteFilename string) (*StorageServer, error) {
+	if this.sticky != nil {
+		if addr, ok := this.sticky.get(remoteFileId); ok {
+			return &StorageServer{addr, groupName, 0}, nil
+		}
+	}
+	var (
+		storeServ *StorageServer
+		err       error
+	)
+	if this.latency != nil {
+		storeServ, err = this.queryFastestStorage(tc, groupName, remoteFilename)
+	} else {
+		storeServ, err = tc.trackerQueryStorageFetch(groupName, remoteFilename)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if this.sticky != nil {
+		this.sticky.put(remoteFileId, storeServ.ipAddr)
+	}
+	return storeServ, nil
+}
+
+func (this *FastDFSClient) queryFastestStorage(tc *TrackerClient, groupName string, remoteFilename string) (*StorageServer, error) {
+	storeServs, err := tc.trackerQueryStorageFetchAll(groupName, remoteFilename)
+	if err != nil {
+		return nil, err
+	}
+	if storeServ, ok := this.latency.fastest(storeServs); ok {
+		return storeServ, nil
+	}
+	return storeServs[0], nil
+}
+
+// downloadWithSourceFallback runs download against storeServ. A replica
+// that hasn't caught up with replication yet answers ENOENT, in which case
+// the download is retried once on the source storage named in the file id,
+// on the same port. ENOENT comes with the response header, before any
+// content is written, so the retry never duplicates output.
+func (this *FastDFSClient) downloadWithSourceFallback(remoteFileId string, storeServ *StorageServer,
+	download func(store *StorageClient, storeServ *StorageServer) (*DownloadFileResponse, error)) (*DownloadFileResponse, error) {
+	storagePool, err := this.getStoragePool(storeServ.ipAddr)
+	if err != nil {
+		return nil, err
+	}
+	dr, err := download(this.storageClient(storagePool), storeServ)
+	this.forgetFailedStorage(remoteFileId, err)
+
+	var errno Errno
+	if !errors.As(err, &errno) || errno.status != enoent {
+		return dr, err
+	}
+	sourceServ, ok := sourceStorage(remoteFileId, storeServ)
+	if !ok {
+		return dr, err
+	}
+	this.log.Infof("%s not on %s yet, reading from source %s", remoteFileId, storeServ.ipAddr, sourceServ.ipAddr)
+	if storagePool, err = this.getStoragePool(sourceServ.ipAddr); err != nil {
+		return nil, err
+	}
+	return download(this.storageClient(storagePool), sourceServ)
+}
+
+// sourceStorage returns the storage remoteFileId was uploaded to, assuming
+// it listens on the same port as storeServ, or false if storeServ is that
+// storage already.
+func sourceStorage(remoteFileId string, storeServ *StorageServer) (*StorageServer, bool) {
+	meta, err := DecodeFileIdMeta(remoteFileId)
+	if err != nil {
+		return nil, false
+	}
+	host, port, err := net.SplitHostPort(storeServ.ipAddr)
+	if err != nil || host == meta.SourceIpAddr {
+		return nil, false
+	}
+	return &StorageServer{net.JoinHostPort(meta.SourceIpAddr, port), storeServ.groupName, storeServ.storePathIndex}, true
+}
+
+// forgetFailedStorage drops the sticky entry of a download that failed, so
+// the next attempt asks the tracker again.
+func (this *FastDFSClient) forgetFailedStorage(remoteFileId string, err error) {
+	if this.sticky != nil && err != nil {
+		this.sticky.remove(remoteFileId)
+	}
+}
+
+func (this *FastDFSClient) queryUploadStorage(tc *TrackerClient) (*StorageServer, error) {
+	policy := this.uploadPolicy
+	if policy == nil {
+		storeServ, err := tc.trackerQueryStorageStorWithoutGroup()
+		if err != nil || this.groupAllowed(storeServ.groupName) {
+			return storeServ, err
+		}
+		// the tracker picked a group this client may not use
+		policy = MostFreeSpace()
+	}
+
+	var groups []GroupStat
+	if _, ok := policy.(pinnedPolicy); !ok {
+		var err error
+		if groups, err = this.cachedGroupStats(tc); err != nil {
+			return nil, err
+		}
+		groups = this.filterAllowedGroups(groups)
+	}
+	groupName, err := policy.SelectGroup(groups)
+	if err != nil {
+		return nil, err
+	}
+	if !this.groupAllowed(groupName) {
+		return nil, ErrGroupNotAllowed
+	}
+	return tc.trackerQueryStorageStorWithGroup(groupName)
+}
+
+func (this *FastDFSClient) groupAllowed(groupName string) bool {
+	return this.allowedGroups == nil || this.allowedGroups[groupName]
+}
+
+func (this *FastDFSClient) filterAllowedGroups(groups []GroupStat) []GroupStat {
+	if this.allowedGroups == nil {
+		return groups
+	}
+	allowed := make([]GroupStat, 0, len(groups))
+	for _, g := range groups {
+		if this.allowedGroups[g.GroupName] {
+			allowed = append(allowed, g)
+		}
+	}
+	return allowed
+}
+
+// splitRemoteFileId splits remoteFileId into group and file name and
+// rejects groups outside AllowedGroups.
+func (this *FastDFSClient) splitRemoteFileId(remoteFileId string) ([]string, error) {
+	parts, err := splitRemoteFileId(remoteFileId)
+	if err != nil {
+		return nil, err
+	}
+	if !this.groupAllowed(parts[0]) {
+		return nil, ErrGroupNotAllowed
+	}
+	return parts, nil
+}
+
+// checkFreeSpace refuses uploads of at least FreeSpaceCheckThreshold bytes
+// that wouldn't leave FreeSpaceMargin free in groupName, going by the cached
+// group stats.
+func (this *FastDFSClient) checkFreeSpace(tc *TrackerClient, groupName string, size int64) error {
+	threshold := this.cfg.FreeSpaceCheckThreshold
+	if threshold <= 0 || size < threshold {
+		return nil
+	}
+	groups, err := this.cachedGroupStats(tc)
+	if err != nil {
+		return err
+	}
+	for _, g := range groups {
+		if g.GroupName != groupName {
+			continue
+		}
+		if free := g.FreeMB << 20; free < size+this.cfg.FreeSpaceMargin {
+			return fmt.Errorf("%w: group %s has %d MB free, upload needs %d bytes plus a margin of %d",
+				ErrInsufficientSpace, groupName, g.FreeMB, size, this.cfg.FreeSpaceMargin)
+		}
+		return nil
+	}
+	return nil
+}
+
+func (this *FastDFSClient) cachedGroupStats(tc *TrackerClient) ([]GroupStat, error) {
+	this.groupStatsLock.Lock()
+	defer this.groupStatsLock.Unlock()
+
+	if this.groupStats != nil && time.Since(this.groupStatsAt) < this.groupStatsTTL {
+		return this.groupStats, nil
+	}
+	groups, err := tc.trackerListGroups()
+	if err != nil {
+		return nil, err
+	}
+	this.groupStats = groups
+	this.groupStatsAt = time.Now()
+	return groups, nil
+}
+
+// acquireOp takes a slot for an operation. With BlockOnMaxConcurrentOps
+// it waits for one, giving up with ctx's error when ctx ends first.
+func (this *FastDFSClient) acquireOp(ctx context.Context) error {
+	this.drainLock.Lock()
+	if this.draining {
+		this.drainLock.Unlock()
+		return ErrDraining
+	}
+	this.inFlight.Add(1)
+	this.drainLock.Unlock()
+
+	if this.ops == nil {
+		return nil
+	}
+	if this.blockOnMaxOps {
+		select {
+		case this.ops <- struct{}{}:
+			return nil
+		case <-ctx.Done():
+			this.inFlight.Done()
+			return ctx.Err()
 		}
 	}
+	select {
+	case this.ops <- struct{}{}:
+		return nil
+	default:
+		this.inFlight.Done()
+		return ErrTooManyRequests
+	}
+}
+
+func (this *FastDFSClient) releaseOp() {
+	if this.ops != nil {
+		<-this.ops
+	}
+	this.inFlight.Done()
+}
+
+// Drain makes the client refuse new operations with ErrDraining, waits for
+// the ones in flight to finish and then closes the client like Close,
+// e.g. to shut down without failing requests during a rolling deploy. If
+// ctx ends first its error is returned and the operations still running
+// are left alone.
+func (this *FastDFSClient) Drain(ctx context.Context) error {
+	this.drainLock.Lock()
+	this.draining = true
+	this.drainLock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		this.inFlight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	this.Close()
+	return nil
+}
+
+// CloseContext is Drain, except that when ctx ends before the operations
+// in flight finish, it closes the client anyway and aborts them by closing
+// their connections, returning ctx's error. Aborted uploads leave no
+// partial files behind. Connections of a shared Config.TrackerPool are
+// left alone.
+func (this *FastDFSClient) CloseContext(ctx context.Context) error {
+	err := this.Drain(ctx)
+	if err == nil {
+		return nil
+	}
+
+	this.storagePoolLock.Lock()
+	pools := make([]*ConnectionPool, 0, len(this.storagePools)+1)
+	for _, sp := range this.storagePools {
+		pools = append(pools, sp)
+	}
+	this.storagePoolLock.Unlock()
+	if this.ownsPool {
+		pools = append(pools, this.pool)
+	}
+
+	this.Close()
+	for _, pool := range pools {
+		pool.abort()
+	}
+	return err
+}
+
+func (this *FastDFSClient) getStoragePool(ipAddr string) (*ConnectionPool, error) {
+	this.storagePoolLock.Lock()
+	defer this.storagePoolLock.Unlock()
+
+	if this.storagePools == nil {
+		return nil, ErrClosed
+	}
+	if sp, ok := this.storagePools[ipAddr]; ok {
+		return sp, nil
+	}
+	opts := this.poolOpts
+	opts.warmUp = this.cfg.WarmUp
+	sp, err := newConnectionPool([]string{ipAddr}, opts)
+	if err != nil {
+		opts.reportBackgroundError(fmt.Errorf("创建%s连接池时出错: %w", ipAddr, err))
+		return nil, err
+	}
+	this.storagePools[ipAddr] = sp
+	return sp, nil
 }
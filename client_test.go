@@ -0,0 +1,665 @@
+package fastdfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mustUpload uploads content through upload and returns its file id.
+func mustUpload(t *testing.T, upload func([]byte, string) (*UploadFileResponse, error), content string) string {
+	t.Helper()
+	ur, err := upload([]byte(content), "txt")
+	if err != nil {
+		t.Fatalf("upload error = %v", err)
+	}
+	return ur.fileId()
+}
+
+// downloadString downloads size bytes of remoteFileId from offset.
+func downloadString(t *testing.T, client *FastDFSClient, remoteFileId string, offset int64, size int64) string {
+	t.Helper()
+	dr, err := client.DownloadToBuffer(remoteFileId, offset, size)
+	if err != nil {
+		t.Fatalf("DownloadToBuffer(%d, %d) error = %v", offset, size, err)
+	}
+	return string(dr.Content.([]byte))
+}
+
+func TestDownloadAppenderFile(t *testing.T) {
+	c := newFakeCluster(t)
+	defer c.close()
+	client := c.client(t, nil)
+
+	normalId := mustUpload(t, client.UploadByBuffer, "hello")
+	appenderId := mustUpload(t, client.UploadAppenderByBuffer, "hello")
+	for _, id := range []string{normalId, appenderId} {
+		if got := downloadString(t, client, id, 0, 0); got != "hello" {
+			t.Errorf("DownloadToBuffer(%s) = %q, want %q", id, got, "hello")
+		}
+	}
+
+	if err := client.AppendByBuffer(appenderId, []byte(" world")); err != nil {
+		t.Fatalf("AppendByBuffer() error = %v", err)
+	}
+	tests := []struct {
+		offset, size int64
+		want         string
+	}{
+		{0, 0, "hello world"},
+		{6, 0, "world"},
+		{0, 5, "hello"},
+		{4, 3, "o w"},
+	}
+	for _, tt := range tests {
+		if got := downloadString(t, client, appenderId, tt.offset, tt.size); got != tt.want {
+			t.Errorf("DownloadToBuffer(%d, %d) = %q, want %q", tt.offset, tt.size, got, tt.want)
+		}
+	}
+
+	var w bytes.Buffer
+	if _, err := client.DownloadToWriter(&w, appenderId, 0, 0); err != nil {
+		t.Fatalf("DownloadToWriter() error = %v", err)
+	}
+	if w.String() != "hello world" {
+		t.Errorf("DownloadToWriter() wrote %q, want %q", w.String(), "hello world")
+	}
+}
+
+func TestDownloadRangePastEOF(t *testing.T) {
+	c := newFakeCluster(t)
+	defer c.close()
+	client := c.client(t, nil)
+	strict := c.client(t, func(cfg *Config) { cfg.StrictDownloadRange = true })
+	id := mustUpload(t, client.UploadByBuffer, "0123456789")
+
+	tests := []struct {
+		name         string
+		client       *FastDFSClient
+		offset, size int64
+		want         string
+		wantErr      error
+	}{
+		{"size past EOF clamps", client, 5, 100, "56789", nil},
+		{"size to EOF", client, 5, 5, "56789", nil},
+		{"offset past EOF", client, 11, 1, "", ErrOffsetBeyondEOF},
+		{"strict size past EOF", strict, 5, 100, "", ErrRangeNotSatisfiable},
+		{"strict size to EOF", strict, 5, 5, "56789", nil},
+		{"strict offset past EOF", strict, 11, 0, "", ErrOffsetBeyondEOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dr, err := tt.client.DownloadToBuffer(id, tt.offset, tt.size)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("DownloadToBuffer() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("DownloadToBuffer() error = %v", err)
+			}
+			if got := string(dr.Content.([]byte)); got != tt.want || dr.DownloadSize != int64(len(tt.want)) {
+				t.Errorf("DownloadToBuffer() = %q of size %d, want %q", got, dr.DownloadSize, tt.want)
+			}
+		})
+	}
+}
+
+func TestCloseLeavesNoGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	c := newFakeCluster(t)
+	client := c.client(t, func(cfg *Config) {
+		// start the background loops too
+		cfg.HealthCheckInterval = time.Millisecond
+		cfg.MaxIdleTime = time.Minute
+	})
+	if _, err := client.UploadByBuffer([]byte("content"), "txt"); err != nil {
+		t.Fatalf("UploadByBuffer() error = %v", err)
+	}
+	client.Close()
+	client.Close()
+	Close()
+	c.close()
+
+	// goroutines of closed connections may take a moment to end
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		buf := make([]byte, 1<<16)
+		t.Fatalf("%d goroutines after Close, %d before:\n%s", n, before, buf[:runtime.Stack(buf, true)])
+	}
+}
+
+var errConsumerGone = errors.New("consumer gone")
+
+// failingWriter fails once more than n bytes were written to it, like a
+// response to a client that went away.
+type failingWriter struct {
+	n int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		written := w.n
+		w.n = 0
+		return written, errConsumerGone
+	}
+	w.n -= len(p)
+	return len(p), nil
+}
+
+func TestDownloadConsumerDisconnects(t *testing.T) {
+	c := newFakeCluster(t)
+	defer c.close()
+	client := c.client(t, nil)
+	id := mustUpload(t, client.UploadByBuffer, strings.Repeat("x", 1<<20))
+
+	downloads := []struct {
+		name     string
+		download func(w io.Writer) error
+	}{
+		{"DownloadToWriter", func(w io.Writer) error {
+			_, err := client.DownloadToWriter(w, id, 0, 0)
+			return err
+		}},
+		{"DownloadTransform", func(w io.Writer) error {
+			return client.DownloadTransform(id, nil, w)
+		}},
+	}
+	for _, d := range downloads {
+		// pool a connection for the download to take
+		downloadString(t, client, id, 0, 1)
+		before := runtime.NumGoroutine()
+
+		if err := d.download(&failingWriter{n: 1000}); !errors.Is(err, errConsumerGone) {
+			t.Errorf("%s: error = %v, want %v", d.name, err, errConsumerGone)
+		}
+		// the connection still had content coming and is closed
+		if stat := client.PoolStats()[c.storage.addr()]; stat.ActiveConns != 0 || stat.IdleConns != 0 {
+			t.Errorf("%s: storage pool = %+v, want no connections", d.name, stat)
+		}
+		if !waitFor(func() bool { return runtime.NumGoroutine() <= before }) {
+			t.Errorf("%s: %d goroutines after the download, %d before", d.name, runtime.NumGoroutine(), before)
+		}
+	}
+}
+
+func TestDownloadTransformContext(t *testing.T) {
+	c := newFakeCluster(t)
+	defer c.close()
+	client := c.client(t, nil)
+	id := mustUpload(t, client.UploadByBuffer, "content")
+
+	upper := func(r io.Reader) io.Reader { return upperReader{r} }
+	var buf bytes.Buffer
+	if err := client.DownloadTransformContext(context.Background(), id, upper, &buf); err != nil {
+		t.Fatalf("DownloadTransformContext() error = %v", err)
+	}
+	if buf.String() != "CONTENT" {
+		t.Errorf("DownloadTransformContext() wrote %q, want %q", buf.String(), "CONTENT")
+	}
+
+	// the storage never answers, the call option's timeout ends it
+	c.storage.setFault(STORAGE_PROTO_CMD_DOWNLOAD_FILE, faultHang, -1)
+	start := time.Now()
+	err := client.DownloadTransformContext(context.Background(), id, nil, ioutil.Discard, WithTimeout(100*time.Millisecond))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("DownloadTransformContext() from a hanging storage error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("DownloadTransformContext() returned after %v", elapsed)
+	}
+}
+
+// upperReader upper-cases ASCII letters read from r.
+type upperReader struct {
+	r io.Reader
+}
+
+func (u upperReader) Read(p []byte) (int, error) {
+	n, err := u.r.Read(p)
+	copy(p, bytes.ToUpper(p[:n]))
+	return n, err
+}
+
+func TestUploadCancelledMidStream(t *testing.T) {
+	c := newFakeCluster(t)
+	defer c.close()
+	client := c.client(t, nil)
+
+	f, err := ioutil.TempFile("", "fastdfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	// far more than the socket buffers take, so the upload is still
+	// sending when cancelled
+	_, err = f.Write(make([]byte, 16<<20))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, err = client.UploadByFilenameContext(ctx, f.Name(), WithProgress(func(transferred, total int64) { cancel() }))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("UploadByFilenameContext() error = %v, want %v", err, context.Canceled)
+	}
+	if stat := client.PoolStats()[c.storage.addr()]; stat.ActiveConns != 0 || stat.IdleConns != 0 {
+		t.Errorf("storage pool = %+v, want the connection discarded", stat)
+	}
+	// the storage drops the incomplete file once the connection is gone
+	if !waitFor(func() bool { return c.storage.openConns() == 0 }) {
+		t.Fatalf("storage has %d open connections", c.storage.openConns())
+	}
+	if names := c.storage.fileNames(); len(names) != 0 {
+		t.Errorf("storage holds %v, want no files", names)
+	}
+}
+
+func TestUploadToGroupContext(t *testing.T) {
+	c := newFakeCluster(t)
+	defer c.close()
+	client := c.client(t, func(cfg *Config) { cfg.RetryBackoff = time.Millisecond })
+
+	f, err := ioutil.TempFile("", "fastdfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString("content")
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uploads := []struct {
+		name   string
+		upload func(ctx context.Context, groupName string, opts ...CallOption) (*UploadFileResponse, error)
+	}{
+		{"buffer", func(ctx context.Context, groupName string, opts ...CallOption) (*UploadFileResponse, error) {
+			return client.UploadByBufferToGroupContext(ctx, groupName, []byte("content"), "txt", opts...)
+		}},
+		{"filename", func(ctx context.Context, groupName string, opts ...CallOption) (*UploadFileResponse, error) {
+			return client.UploadByFilenameToGroupContext(ctx, groupName, f.Name(), opts...)
+		}},
+	}
+	for _, u := range uploads {
+		// a connection error is retried as the call options say
+		c.storage.setFault(STORAGE_PROTO_CMD_UPLOAD_FILE, faultClose, 1)
+		var progressed int64
+		ur, err := u.upload(context.Background(), "group1", WithRetries(1), WithProgress(func(transferred, total int64) {
+			progressed = transferred
+		}))
+		if err != nil {
+			t.Fatalf("%s: upload error = %v", u.name, err)
+		}
+		if got := string(c.storage.file(ur.RemoteFileId)); got != "content" {
+			t.Errorf("%s: uploaded %q", u.name, got)
+		}
+		if progressed != int64(len("content")) {
+			t.Errorf("%s: progress reported %d bytes", u.name, progressed)
+		}
+
+		if _, err := u.upload(context.Background(), "group2"); !errors.Is(err, ErrNoWritableStorage) {
+			t.Errorf("%s: upload to a missing group error = %v, want %v", u.name, err, ErrNoWritableStorage)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := u.upload(ctx, "group1"); !errors.Is(err, context.Canceled) {
+			t.Errorf("%s: upload with a cancelled context error = %v, want %v", u.name, err, context.Canceled)
+		}
+	}
+}
+
+func TestUploadWithStorePathContext(t *testing.T) {
+	c := newFakeCluster(t)
+	defer c.close()
+	client := c.client(t, func(cfg *Config) { cfg.RetryBackoff = time.Millisecond })
+
+	// a connection error is retried as the call options say, still on the
+	// given store path
+	c.storage.setFault(STORAGE_PROTO_CMD_UPLOAD_FILE, faultClose, 1)
+	ur, err := client.UploadByBufferWithStorePathContext(context.Background(), []byte("content"), "txt", 3, WithRetries(1))
+	if err != nil {
+		t.Fatalf("UploadByBufferWithStorePathContext() error = %v", err)
+	}
+	if !strings.HasPrefix(ur.fileId(), "group1/M03/") || string(c.storage.file(ur.RemoteFileId)) != "content" {
+		t.Errorf("UploadByBufferWithStorePathContext() uploaded %s holding %q", ur.fileId(), c.storage.file(ur.RemoteFileId))
+	}
+
+	if _, err := client.UploadByBufferWithStorePathContext(context.Background(), []byte("content"), "txt", 256); err == nil {
+		t.Error("UploadByBufferWithStorePathContext() to store path 256 succeeded")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := client.UploadByBufferWithStorePathContext(ctx, []byte("content"), "txt", 3); !errors.Is(err, context.Canceled) {
+		t.Errorf("UploadByBufferWithStorePathContext() with a cancelled context error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestDownloadToBuffer(t *testing.T) {
+	c := newFakeCluster(t)
+	defer c.close()
+	client := c.client(t, nil)
+
+	for _, size := range []int{0, 1, 10, 4096, 100000} {
+		content := make([]byte, size)
+		for i := range content {
+			content[i] = byte(i * 7)
+		}
+		ur, err := client.UploadByBuffer(content, "bin")
+		if err != nil {
+			t.Fatalf("UploadByBuffer() of %d bytes error = %v", size, err)
+		}
+		dr, err := client.DownloadToBuffer(ur.fileId(), 0, 0)
+		if err != nil {
+			t.Fatalf("DownloadToBuffer() of %d bytes error = %v", size, err)
+		}
+		if got := dr.Content.([]byte); !bytes.Equal(got, content) || dr.DownloadSize != int64(size) {
+			t.Errorf("DownloadToBuffer() of %d bytes got %d bytes, DownloadSize %d, content equal %v",
+				size, len(got), dr.DownloadSize, bytes.Equal(got, content))
+		}
+	}
+}
+
+func TestDownloadToEnd(t *testing.T) {
+	c := newFakeCluster(t)
+	defer c.close()
+	client := c.client(t, nil)
+	id := mustUpload(t, client.UploadByBuffer, "0123456789")
+
+	dir, err := ioutil.TempDir("", "fastdfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	localFilename := filepath.Join(dir, "download")
+
+	tests := []struct {
+		offset, size int64
+		want         string
+		wantErr      error
+	}{
+		{0, 0, "0123456789", nil},
+		{0, -1, "0123456789", nil},
+		{3, 0, "3456789", nil},
+		{3, -1, "3456789", nil},
+		{10, -1, "", nil},
+		{11, 0, "", ErrOffsetBeyondEOF},
+		{100, -1, "", ErrOffsetBeyondEOF},
+	}
+	for _, tt := range tests {
+		dr, err := client.DownloadToBuffer(id, tt.offset, tt.size)
+		if !errors.Is(err, tt.wantErr) || err == nil && string(dr.Content.([]byte)) != tt.want {
+			t.Errorf("DownloadToBuffer(%d, %d) = %v, %v, want %q, %v", tt.offset, tt.size, dr, err, tt.want, tt.wantErr)
+		}
+
+		_, err = client.DownloadToFile(localFilename, id, tt.offset, tt.size)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("DownloadToFile(%d, %d) error = %v, want %v", tt.offset, tt.size, err, tt.wantErr)
+			continue
+		}
+		if err == nil {
+			if got, _ := ioutil.ReadFile(localFilename); string(got) != tt.want {
+				t.Errorf("DownloadToFile(%d, %d) wrote %q, want %q", tt.offset, tt.size, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestDownloadFallsBackToSource(t *testing.T) {
+	c := newFakeCluster(t)
+	defer c.close()
+	// the replica listens on another address with the storage's port, as
+	// sourceStorage expects
+	_, port, _ := net.SplitHostPort(c.storage.addr())
+	ln, err := net.Listen("tcp", net.JoinHostPort("127.0.0.2", port))
+	if err != nil {
+		t.Skipf("127.0.0.2 not available: %v", err)
+	}
+	ln.Close()
+	replica := newFakeStorage(t, net.JoinHostPort("127.0.0.2", port), "group1")
+	defer replica.close()
+
+	client := c.client(t, nil)
+	id := mustUpload(t, client.UploadByBuffer, "content")
+	// the tracker sends downloads to the replica, which hasn't got the
+	// file yet
+	c.tracker.setFetchStorage(t, replica.addr())
+
+	if got := downloadString(t, client, id, 0, 0); got != "content" {
+		t.Errorf("downloaded %q, want %q", got, "content")
+	}
+	if got := replica.Requests(STORAGE_PROTO_CMD_DOWNLOAD_FILE); got != 1 {
+		t.Errorf("replica got %d downloads, want 1", got)
+	}
+	if got := c.storage.Requests(STORAGE_PROTO_CMD_DOWNLOAD_FILE); got != 1 {
+		t.Errorf("source got %d downloads, want 1", got)
+	}
+
+	// a file missing on the source too is looked for there only once
+	if err := client.DeleteFile(id); err != nil {
+		t.Fatalf("DeleteFile() error = %v", err)
+	}
+	var errno Errno
+	if _, err := client.DownloadToBuffer(id, 0, 0); !errors.As(err, &errno) || errno.status != fakeEnoent {
+		t.Fatalf("DownloadToBuffer() of a deleted file error = %v, want ENOENT", err)
+	}
+	if got := replica.Requests(STORAGE_PROTO_CMD_DOWNLOAD_FILE); got != 2 {
+		t.Errorf("replica got %d downloads, want 2", got)
+	}
+	if got := c.storage.Requests(STORAGE_PROTO_CMD_DOWNLOAD_FILE); got != 2 {
+		t.Errorf("source got %d downloads, want 2", got)
+	}
+}
+
+func TestImportKeepsGOMAXPROCS(t *testing.T) {
+	if want := os.Getenv("FASTDFS_TEST_GOMAXPROCS"); want != "" {
+		// the runtime took GOMAXPROCS from the environment before the
+		// package was initialized
+		if n := runtime.GOMAXPROCS(0); strconv.Itoa(n) != want {
+			t.Fatalf("GOMAXPROCS = %d after initializing the package, want %s", n, want)
+		}
+		return
+	}
+
+	// one more than the CPUs, so setting it to their number shows
+	want := strconv.Itoa(runtime.NumCPU() + 1)
+	cmd := exec.Command(os.Args[0], "-test.run=^TestImportKeepsGOMAXPROCS$")
+	cmd.Env = append(os.Environ(), "FASTDFS_TEST_GOMAXPROCS="+want, "GOMAXPROCS="+want)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("test binary with GOMAXPROCS=%s: %v\n%s", want, err, out)
+	}
+}
+
+func TestUnreachableStorage(t *testing.T) {
+	c := newFakeCluster(t)
+	defer c.close()
+	// a port nobody listens on
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.tracker.setStorage(t, ln.Addr().String())
+	ln.Close()
+
+	dir, err := ioutil.TempDir("", "fastdfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	localFilename := filepath.Join(dir, "file.txt")
+	if err := ioutil.WriteFile(localFilename, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, warmUp := range []bool{false, true} {
+		// with WarmUp creating the storage pool already fails
+		client := c.client(t, func(cfg *Config) { cfg.WarmUp = warmUp })
+		ops := []struct {
+			name string
+			op   func() error
+		}{
+			{"UploadByBuffer", func() error {
+				_, err := client.UploadByBuffer([]byte("content"), "txt")
+				return err
+			}},
+			{"UploadByFilename", func() error {
+				_, err := client.UploadByFilename(localFilename)
+				return err
+			}},
+			{"UploadAppenderByBuffer", func() error {
+				_, err := client.UploadAppenderByBuffer([]byte("content"), "txt")
+				return err
+			}},
+			{"UploadSlaveByBuffer", func() error {
+				_, err := client.UploadSlaveByBuffer([]byte("content"), testMasterFileId, "_small", "jpg")
+				return err
+			}},
+			{"DownloadToBuffer", func() error {
+				_, err := client.DownloadToBuffer(testMasterFileId, 0, 0)
+				return err
+			}},
+			{"DownloadToFile", func() error {
+				_, err := client.DownloadToFile(filepath.Join(dir, "download"), testMasterFileId, 0, 0)
+				return err
+			}},
+			{"DeleteFile", func() error { return client.DeleteFile(testMasterFileId) }},
+			{"QueryFileInfo", func() error {
+				_, err := client.QueryFileInfo(testMasterFileId)
+				return err
+			}},
+			{"GetMetadata", func() error {
+				_, err := client.GetMetadata(testMasterFileId)
+				return err
+			}},
+		}
+		for _, op := range ops {
+			err := op.op()
+			var opErr *net.OpError
+			if !errors.As(err, &opErr) || opErr.Op != "dial" {
+				t.Errorf("%s with WarmUp %v error = %v, want a dial error", op.name, warmUp, err)
+			}
+		}
+	}
+}
+
+func TestFileExists(t *testing.T) {
+	c := newFakeCluster(t)
+	defer c.close()
+	client := c.client(t, nil)
+
+	ur, err := client.UploadByBuffer([]byte("content"), "txt")
+	if err != nil {
+		t.Fatalf("UploadByBuffer() error = %v", err)
+	}
+	deleted, err := client.UploadByBuffer([]byte("deleted"), "txt")
+	if err != nil {
+		t.Fatalf("UploadByBuffer() error = %v", err)
+	}
+	if err := client.DeleteFile(deleted.fileId()); err != nil {
+		t.Fatalf("DeleteFile() error = %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		fileId   string
+		fault    bool
+		want     bool
+		wantFail bool
+	}{
+		{"exists", ur.fileId(), false, true, false},
+		{"deleted", deleted.fileId(), false, false, false},
+		{"never uploaded", testMasterFileId, false, false, false},
+		{"connection closed", ur.fileId(), true, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.fault {
+				c.storage.setFault(STORAGE_PROTO_CMD_QUERY_FILE_INFO, faultClose, -1)
+				defer c.storage.setFault(STORAGE_PROTO_CMD_QUERY_FILE_INFO, 0, 0)
+			}
+			got, err := client.FileExists(tt.fileId)
+			if (err != nil) != tt.wantFail {
+				t.Fatalf("FileExists() error = %v, want failure %v", err, tt.wantFail)
+			}
+			if got != tt.want {
+				t.Errorf("FileExists() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIPv6RoundTrip(t *testing.T) {
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback not available: %v", err)
+	}
+	ln.Close()
+	c := newFakeClusterOn(t, "[::1]:0")
+	defer c.close()
+	// the tracker reports the storage as ::1, which has to be bracketed
+	// before dialing
+	if c.tracker.storageIp != "::1" {
+		t.Fatalf("tracker reports storage ip %q, want ::1", c.tracker.storageIp)
+	}
+	client := c.client(t, nil)
+
+	id := mustUpload(t, client.UploadByBuffer, "over ipv6")
+	if got := downloadString(t, client, id, 0, 0); got != "over ipv6" {
+		t.Errorf("DownloadToBuffer() = %q, want %q", got, "over ipv6")
+	}
+	if err := client.DeleteFile(id); err != nil {
+		t.Errorf("DeleteFile() error = %v", err)
+	}
+	if _, ok := client.PoolStats()[c.storage.addr()]; !ok {
+		t.Errorf("PoolStats() has no pool for %s", c.storage.addr())
+	}
+}
+
+func TestConfigIsCopied(t *testing.T) {
+	c := newFakeCluster(t)
+	defer c.close()
+	groups := []string{"group1"}
+	weights := map[string]int{c.tracker.addr(): 1}
+	client := c.client(t, func(cfg *Config) {
+		cfg.AllowedGroups = groups
+		cfg.EndpointWeights = weights
+	})
+
+	// neither the caller's values nor a returned copy reach the client
+	groups[0] = "group2"
+	weights[c.tracker.addr()] = 2
+	cfg := client.Config()
+	cfg.AllowedGroups[0] = "group3"
+	cfg.EndpointWeights[c.tracker.addr()] = 3
+
+	got := client.Config()
+	if len(got.AllowedGroups) != 1 || got.AllowedGroups[0] != "group1" {
+		t.Errorf("AllowedGroups = %q, want [group1]", got.AllowedGroups)
+	}
+	if w := got.EndpointWeights[c.tracker.addr()]; w != 1 {
+		t.Errorf("EndpointWeights[%s] = %d, want 1", c.tracker.addr(), w)
+	}
+	if !client.groupAllowed("group1") || client.groupAllowed("group2") {
+		t.Error("the client no longer allows only group1")
+	}
+}
@@ -0,0 +1,58 @@
+package fastdfs
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+var ErrUnknownCluster = errors.New("unknown cluster")
+
+// Clusters holds one client per named FastDFS cluster, e.g. one per region
+// for routing uploads to the nearest one. Every client has its own tracker
+// and storage pools, so storages of different clusters that share an
+// address never share connections.
+type Clusters struct {
+	clients map[string]*FastDFSClient
+}
+
+// NewClusters creates a client for every named config. If any of them
+// fails, the ones already created are closed again.
+func NewClusters(cfgs map[string]Config) (*Clusters, error) {
+	clusters := &Clusters{clients: make(map[string]*FastDFSClient, len(cfgs))}
+	for name, cfg := range cfgs {
+		client, err := New(cfg)
+		if err != nil {
+			clusters.Close()
+			return nil, fmt.Errorf("cluster %s: %w", name, err)
+		}
+		clusters.clients[name] = client
+	}
+	return clusters, nil
+}
+
+// Client returns the client of the named cluster.
+func (this *Clusters) Client(name string) (*FastDFSClient, error) {
+	client, ok := this.clients[name]
+	if !ok {
+		return nil, fmt.Errorf("%w %s", ErrUnknownCluster, name)
+	}
+	return client, nil
+}
+
+// Names returns the names of the clusters, sorted.
+func (this *Clusters) Names() []string {
+	names := make([]string, 0, len(this.clients))
+	for name := range this.clients {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Close closes the clients of all clusters.
+func (this *Clusters) Close() {
+	for _, client := range this.clients {
+		client.Close()
+	}
+}
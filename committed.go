@@ -0,0 +1,70 @@
+package fastdfs
+
+import (
+	"context"
+	"fmt"
+)
+
+// UploadCommitted uploads filebuffer so that its file id either becomes
+// visible complete or not at all, even when retried over a flaky network.
+// It uploads an appender file first, checks its size on the storage and
+// then regenerates it into a normal file, which is the commit. If any
+// step fails with a connection error the temporary file is deleted and
+// the upload starts over, up to Config.CommitRetries times; errors reported
+// by the storage are returned right away. This costs two more round trips
+// than UploadByBuffer and needs FastDFS 6.02 or later. Only if the reply
+// to the commit itself is lost can the committed file be left behind.
+func (this *FastDFSClient) UploadCommitted(filebuffer []byte, fileExtName string) (string, error) {
+	retries := this.cfg.CommitRetries
+	for attempt := 0; ; attempt++ {
+		remoteFileId, err := this.uploadCommittedOnce(filebuffer, fileExtName)
+		if !retryable(err) || attempt >= retries {
+			return remoteFileId, err
+		}
+		this.log.Warnf("committed upload failed, starting over: %v", err)
+		this.retryWait(context.Background(), attempt)
+	}
+}
+
+func (this *FastDFSClient) uploadCommittedOnce(filebuffer []byte, fileExtName string) (string, error) {
+	ur, err := this.UploadAppenderByBuffer(filebuffer, fileExtName)
+	if err != nil {
+		return "", err
+	}
+	tempFileId := ur.fileId()
+
+	remoteFileId, err := this.commitAppenderFile(context.Background(), tempFileId, int64(len(filebuffer)))
+	if err != nil {
+		if delErr := this.DeleteFile(tempFileId); delErr != nil {
+			this.log.Warnf("deleting temporary file %s error :%s", tempFileId, delErr.Error())
+		}
+		return "", err
+	}
+	return remoteFileId, nil
+}
+
+// commitAppenderFile checks that the appender file holds size bytes and
+// regenerates it into a normal file.
+func (this *FastDFSClient) commitAppenderFile(ctx context.Context, remoteFileId string, size int64) (string, error) {
+	if err := this.acquireOp(ctx); err != nil {
+		return "", err
+	}
+	defer this.releaseOp()
+
+	t, err := this.appenderTarget(ctx, remoteFileId)
+	if err != nil {
+		return "", err
+	}
+	info, err := t.store.storageQueryFileInfo(ctx, t.tc, t.storeServ, t.remoteFilename)
+	if err != nil {
+		return "", err
+	}
+	if info.FileSize != size {
+		return "", fmt.Errorf("temporary file %s has %d bytes instead of %d", remoteFileId, info.FileSize, size)
+	}
+	ur, err := t.store.storageRegenerateAppenderFile(ctx, t.tc, t.storeServ, t.remoteFilename)
+	if err != nil {
+		return "", err
+	}
+	return ur.fileId(), nil
+}
@@ -0,0 +1,49 @@
+package fastdfs
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUploadCommittedRetries(t *testing.T) {
+	tests := []struct {
+		name          string
+		commitRetries int
+		wantErr       bool
+	}{
+		{"retried", 0, false},
+		{"no retries", -1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newFakeCluster(t)
+			defer c.close()
+			client := c.client(t, func(cfg *Config) {
+				cfg.CommitRetries = tt.commitRetries
+				cfg.RetryBackoff = time.Millisecond
+			})
+
+			// the storage goes away while committing the first attempt
+			c.storage.setFault(STORAGE_PROTO_CMD_REGENERATE_APPENDER_FILENAME, faultClose, 1)
+			id, err := client.UploadCommitted([]byte("content"), "txt")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("UploadCommitted() error = %v, want failure %v", err, tt.wantErr)
+			}
+			if err != nil && !retryable(err) {
+				t.Errorf("UploadCommitted() error = %v, want a connection error", err)
+			}
+
+			// the first attempt's temporary appender file was deleted
+			names := c.storage.fileNames()
+			switch {
+			case err != nil && len(names) != 0:
+				t.Errorf("storage holds %v after a failed upload, want no files", names)
+			case err == nil && (len(names) != 1 || "group1/"+names[0] != id):
+				t.Errorf("storage holds %v, want only %s", names, id)
+			case err == nil && string(c.storage.file(strings.TrimPrefix(id, "group1/"))) != "content":
+				t.Errorf("committed file holds %q", c.storage.file(strings.TrimPrefix(id, "group1/")))
+			}
+		})
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd
+
+package fastdfs
+
+import "net"
+
+func peekAlive(conn net.Conn) (alive bool, ok bool) {
+	return false, false
+}
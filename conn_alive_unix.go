@@ -0,0 +1,35 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+// +build linux darwin freebsd netbsd openbsd
+
+package fastdfs
+
+import (
+	"net"
+	"syscall"
+)
+
+// peekAlive peeks at the socket of conn without consuming or waiting for
+// anything. ok is false if conn has no socket to peek at, e.g. when it
+// goes through a proxy.
+func peekAlive(conn net.Conn) (alive bool, ok bool) {
+	sc, isSocket := conn.(syscall.Conn)
+	if !isSocket {
+		return false, false
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return false, false
+	}
+	var peekErr error
+	err = raw.Read(func(fd uintptr) bool {
+		var b [1]byte
+		_, _, peekErr = syscall.Recvfrom(int(fd), b[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+		// done either way, never wait for the socket to become readable
+		return true
+	})
+	if err != nil {
+		return false, true
+	}
+	// anything but "nothing to read" is EOF, data or an error
+	return peekErr == syscall.EAGAIN || peekErr == syscall.EWOULDBLOCK, true
+}
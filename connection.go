@@ -1,12 +1,15 @@
 package fastdfs
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"math/rand"
 	"net"
 	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,42 +17,257 @@ var ErrClosed = errors.New("pool is closed")
 
 type pConn struct {
 	net.Conn
-	pool *ConnectionPool
+	pool     *ConnectionPool
+	unusable bool
+
+	// timeout bounds every single read and write, zero if unbounded
+	timeout time.Duration
+	// deadlineLock orders refreshing the timeout against deadlines set by
+	// the user of the connection, which win when they are earlier, so a
+	// deadline set to abort pending I/O is never pushed back
+	deadlineLock  sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func (c *pConn) Read(p []byte) (int, error) {
+	if c.timeout > 0 {
+		c.deadlineLock.Lock()
+		c.Conn.SetReadDeadline(earliest(time.Now().Add(c.timeout), c.readDeadline))
+		c.deadlineLock.Unlock()
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *pConn) Write(p []byte) (int, error) {
+	if c.timeout > 0 {
+		c.deadlineLock.Lock()
+		c.Conn.SetWriteDeadline(earliest(time.Now().Add(c.timeout), c.writeDeadline))
+		c.deadlineLock.Unlock()
+	}
+	return c.Conn.Write(p)
+}
+
+func (c *pConn) SetDeadline(t time.Time) error {
+	c.deadlineLock.Lock()
+	defer c.deadlineLock.Unlock()
+	c.readDeadline, c.writeDeadline = t, t
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *pConn) SetReadDeadline(t time.Time) error {
+	c.deadlineLock.Lock()
+	defer c.deadlineLock.Unlock()
+	c.readDeadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *pConn) SetWriteDeadline(t time.Time) error {
+	c.deadlineLock.Lock()
+	defer c.deadlineLock.Unlock()
+	c.writeDeadline = t
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// earliest returns the earlier of t and deadline, where a zero deadline
+// means none.
+func earliest(t time.Time, deadline time.Time) time.Time {
+	if !deadline.IsZero() && deadline.Before(t) {
+		return deadline
+	}
+	return t
 }
 
-func (c pConn) Close() error {
+func (c *pConn) Close() error {
+	atomic.AddInt64(&c.pool.active, -1)
+	c.pool.statsLock.Lock()
+	delete(c.pool.checkedOut, c)
+	c.pool.statsLock.Unlock()
+	if c.unusable {
+		return c.Conn.Close()
+	}
 	return c.pool.put(c.Conn)
 }
 
+// MarkUnusable makes the next Close discard the connection instead of
+// returning it to the pool.
+func (c *pConn) MarkUnusable() {
+	c.unusable = true
+}
+
+// timedConn is a connection as the pool keeps it, with the times needed to
+// expire it.
+type timedConn struct {
+	net.Conn
+	created   time.Time
+	idleSince time.Time
+}
+
+// releaseConn gives conn back to its pool. If err shows that the connection
+// itself failed (anything but a status reported by the server) the connection
+// is closed instead, so a broken connection never gets reused.
+func releaseConn(conn net.Conn, err error) {
+	if err != nil {
+		if _, ok := err.(Errno); !ok {
+			if pc, ok := conn.(*pConn); ok {
+				pc.MarkUnusable()
+			}
+		}
+	}
+	conn.Close()
+}
+
 type ConnectionPool struct {
-	endpoints []string
-	minConns  int
-	maxConns  int
-	conns     chan net.Conn
+	// active, waited and refused are only accessed atomically, see Stats
+	active  int64
+	waited  int64
+	refused int64
+	// next is the round-robin position, only accessed atomically
+	next uint32
+
+	endpoints    []string
+	minConns     int
+	maxConns     int
+	testOnBorrow bool
+	testOnReturn bool
+	opts         poolOptions
+	conns        chan net.Conn
+	lock         sync.RWMutex
+	selector     *weightedSelector
+
+	// stopReaper is closed by Close, nil without a reaper
+	stopReaper chan struct{}
+
+	statsLock    sync.Mutex
+	checkedOut   map[*pConn]struct{}
+	dialFailures map[string]int64
+	// down is never modified in place, only replaced
+	down map[string]bool
+}
+
+type poolOptions struct {
+	minConns int
+	maxConns int
+	// warmUp dials minConns connections when the pool is created, otherwise
+	// the pool starts empty and grows on demand
+	warmUp bool
+	// testOnBorrow sends ACTIVE_TEST before handing out a pooled connection
+	testOnBorrow bool
+	// testOnReturn sends ACTIVE_TEST before putting a connection back
+	testOnReturn bool
+	// validateOnBorrow checks that the peer hasn't closed a pooled
+	// connection before handing it out, without a round trip
+	validateOnBorrow bool
+	// dialRetries redials the same endpoint that many times after a failed
+	// dial, waiting dialRetryBackoff before the first retry and doubling
+	// the wait after each one
+	dialRetries      int
+	dialRetryBackoff time.Duration
+	// onBackgroundError receives housekeeping failures nobody waits for
+	onBackgroundError func(error)
+	// weights switches endpoint selection from random to smooth weighted
+	// round-robin; endpoints without a positive weight count as 1
+	weights map[string]int
+	// ioTimeout bounds every read and write on a pooled connection
+	ioTimeout time.Duration
+	// connectTimeout bounds a direct dial, one minute if zero
+	connectTimeout time.Duration
+	// dialContext replaces direct TCP dialing, e.g. to go through a proxy
+	dialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+	// maxIdleTime closes connections idle for longer, maxLifetime those
+	// older than that; zero keeps them
+	maxIdleTime time.Duration
+	maxLifetime time.Duration
+	// trackerSelect picks the endpoint of new connections without weights
+	trackerSelect TrackerSelect
+	// log receives background errors without onBackgroundError, nil
+	// drops them
+	log Logger
+}
+
+// TrackerSelect is how a pool picks the tracker for a new connection
+// among the endpoints that are up.
+type TrackerSelect int
+
+const (
+	// TrackerRandom picks a random endpoint.
+	TrackerRandom TrackerSelect = iota
+	// TrackerRoundRobin picks the endpoints in turn.
+	TrackerRoundRobin
+	// TrackerFirstAvailable picks the first endpoint in the list, falling
+	// back to the next ones only while it is down.
+	TrackerFirstAvailable
+)
+
+// reportBackgroundError hands err to onBackgroundError, or logs it.
+func (this poolOptions) reportBackgroundError(err error) {
+	if this.onBackgroundError != nil {
+		this.onBackgroundError(err)
+		return
+	}
+	if this.log != nil {
+		this.log.Warnf("%v", err)
+	}
 }
 
 func NewConnectionPool(endpoints []string, minConns int, maxConns int) (*ConnectionPool, error) {
+	return newConnectionPool(endpoints, poolOptions{
+		minConns:     minConns,
+		maxConns:     maxConns,
+		warmUp:       true,
+		testOnBorrow: true,
+	})
+}
+
+func newConnectionPool(endpoints []string, opts poolOptions) (*ConnectionPool, error) {
+	minConns, maxConns := opts.minConns, opts.maxConns
 	if minConns < 0 || maxConns <= 0 || minConns > maxConns {
 		return nil, errors.New("invalid conns settings")
 	}
+	for _, endpoint := range endpoints {
+		if _, _, err := net.SplitHostPort(endpoint); err != nil {
+			return nil, fmt.Errorf("invalid endpoint %q: %w", endpoint, err)
+		}
+	}
 	cp := &ConnectionPool{
-		endpoints: endpoints,
-		minConns:  minConns,
-		maxConns:  maxConns,
-		conns:     make(chan net.Conn, maxConns),
+		endpoints:    endpoints,
+		minConns:     minConns,
+		maxConns:     maxConns,
+		testOnBorrow: opts.testOnBorrow,
+		testOnReturn: opts.testOnReturn,
+		opts:         opts,
+		conns:        make(chan net.Conn, maxConns),
+		checkedOut:   make(map[*pConn]struct{}),
+		dialFailures: make(map[string]int64),
+	}
+	if len(opts.weights) > 0 {
+		cp.selector = newWeightedSelector(endpoints, opts.weights)
 	}
-	for i := 0; i < minConns; i++ {
-		conn, err := cp.makeConn()
+	for i := 0; opts.warmUp && i < minConns; i++ {
+		conn, err := cp.makeConn(context.Background())
 		if err != nil {
 			cp.Close()
 			return nil, err
 		}
 		cp.conns <- conn
 	}
+	if interval := cp.reapInterval(); interval > 0 {
+		cp.stopReaper = make(chan struct{})
+		go cp.reapLoop(interval, cp.stopReaper)
+	}
 	return cp, nil
 }
 
 func (this *ConnectionPool) Get() (net.Conn, error) {
+	return this.GetContext(context.Background())
+}
+
+// GetContext is Get, but gives up dialing a new connection when ctx ends,
+// returning ctx's error.
+func (this *ConnectionPool) GetContext(ctx context.Context) (net.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	conns := this.getConns()
 	if conns == nil {
 		return nil, ErrClosed
@@ -57,45 +275,81 @@ func (this *ConnectionPool) Get() (net.Conn, error) {
 
 	for {
 		select {
-		case conn := <-conns:
-			if conn == nil {
+		case conn, ok := <-conns:
+			if !ok {
+				return nil, ErrClosed
+			}
+			if this.expired(conn, time.Now()) {
+				conn.Close()
 				break
-				//return nil, ErrClosed
 			}
-			if err := this.activeConn(conn); err != nil {
+			if this.opts.validateOnBorrow && !connAlive(conn) {
+				conn.Close()
 				break
 			}
+			if this.testOnBorrow {
+				if err := this.activeConn(conn); err != nil {
+					conn.Close()
+					break
+				}
+			}
+			atomic.AddInt64(&this.active, 1)
 			return this.wrapConn(conn), nil
 		default:
-			if this.Len() >= this.maxConns {
-				errmsg := fmt.Sprintf("Too many connctions %d", this.Len())
+			atomic.AddInt64(&this.waited, 1)
+			if total, ok := this.reserve(); !ok {
+				atomic.AddInt64(&this.refused, 1)
+				errmsg := fmt.Sprintf("Too many connctions %d", total)
 				return nil, errors.New(errmsg)
 			}
-			conn, err := this.makeConn()
+			conn, err := this.makeConn(ctx)
 			if err != nil {
+				atomic.AddInt64(&this.active, -1)
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
 				return nil, err
 			}
-
-			this.conns <- conn
-			//put connection to pool and go next `for` loop
-			//return this.wrapConn(conn), nil
+			// a freshly dialed connection needs no validation
+			return this.wrapConn(conn), nil
 		}
 	}
 
 }
 
+// Close closes the idle connections. Connections that are checked out stay
+// usable and are closed instead of pooled when they are returned.
 func (this *ConnectionPool) Close() {
+	this.lock.Lock()
 	conns := this.conns
 	this.conns = nil
+	if conns != nil {
+		close(conns)
+		if this.stopReaper != nil {
+			close(this.stopReaper)
+		}
+	}
+	this.lock.Unlock()
 
 	if conns == nil {
 		return
 	}
 
-	close(conns)
-
 	for conn := range conns {
-		conn.Close()
+		if err := conn.Close(); err != nil {
+			this.opts.reportBackgroundError(fmt.Errorf("closing pooled connection to %s: %w", conn.RemoteAddr(), err))
+		}
+	}
+}
+
+// abort closes the connections checked out of the pool, failing the I/O
+// in progress on them. Their users still return them, which then closes
+// them again if the pool is closed.
+func (this *ConnectionPool) abort() {
+	this.statsLock.Lock()
+	defer this.statsLock.Unlock()
+	for c := range this.checkedOut {
+		c.Conn.Close()
 	}
 }
 
@@ -103,13 +357,132 @@ func (this *ConnectionPool) Len() int {
 	return len(this.getConns())
 }
 
-func (this *ConnectionPool) makeConn() (net.Conn, error) {
-	addr := this.endpoints[rand.Intn(len(this.endpoints))]
-	return net.DialTimeout("tcp", addr, time.Minute)
+// pickEndpoint chooses the endpoint for a new connection, skipping those
+// marked down unless all of them are.
+func (this *ConnectionPool) pickEndpoint() string {
+	this.statsLock.Lock()
+	down := this.down
+	this.statsLock.Unlock()
+
+	if this.selector != nil {
+		for range this.endpoints {
+			if addr := this.selector.next(); !down[addr] {
+				return addr
+			}
+		}
+		return this.selector.next()
+	}
+	up := this.endpoints
+	if len(down) > 0 {
+		up = make([]string, 0, len(this.endpoints))
+		for _, addr := range this.endpoints {
+			if !down[addr] {
+				up = append(up, addr)
+			}
+		}
+		if len(up) == 0 {
+			up = this.endpoints
+		}
+	}
+	switch this.opts.trackerSelect {
+	case TrackerRoundRobin:
+		n := atomic.AddUint32(&this.next, 1) - 1
+		return up[int(n%uint32(len(up)))]
+	case TrackerFirstAvailable:
+		return up[0]
+	}
+	return up[rand.Intn(len(up))]
+}
+
+// setDown replaces the set of endpoints new connections avoid.
+func (this *ConnectionPool) setDown(down map[string]bool) {
+	this.statsLock.Lock()
+	this.down = down
+	this.statsLock.Unlock()
+}
+
+func (this *ConnectionPool) makeConn(ctx context.Context) (net.Conn, error) {
+	addr := this.pickEndpoint()
+	backoff := this.opts.dialRetryBackoff
+	connectTimeout := this.opts.connectTimeout
+	if connectTimeout <= 0 {
+		connectTimeout = time.Minute
+	}
+	dial := (&net.Dialer{Timeout: connectTimeout}).DialContext
+	if this.opts.dialContext != nil {
+		dial = this.opts.dialContext
+	}
+	for retry := 0; ; retry++ {
+		conn, err := dial(ctx, "tcp", addr)
+		if err == nil {
+			now := time.Now()
+			return &timedConn{Conn: conn, created: now, idleSince: now}, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		this.statsLock.Lock()
+		this.dialFailures[addr]++
+		this.statsLock.Unlock()
+		if retry >= this.opts.dialRetries {
+			return nil, err
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
+
+// DialFailures returns the number of failed connection attempts per
+// endpoint since the pool was created. A growing count warns of a node
+// refusing connections before requests start failing.
+func (this *ConnectionPool) DialFailures() map[string]int64 {
+	this.statsLock.Lock()
+	defer this.statsLock.Unlock()
+
+	failures := make(map[string]int64, len(this.dialFailures))
+	for addr, n := range this.dialFailures {
+		failures[addr] = n
+	}
+	return failures
+}
+
+// PoolStat is a snapshot of a pool. TotalConns is IdleConns plus
+// ActiveConns, the connections checked out. Waited counts the Gets since
+// the pool was created that found no idle connection and had to dial one,
+// Refused those of them that failed because the pool was at its maximum.
+// Both growing fast means the pool is too small.
+type PoolStat struct {
+	TotalConns  int
+	IdleConns   int
+	ActiveConns int
+	Waited      int64
+	Refused     int64
+}
+
+// Stats returns the current state of the pool. It may be called
+// concurrently with any other use of the pool.
+func (this *ConnectionPool) Stats() PoolStat {
+	idle := this.Len()
+	active := int(atomic.LoadInt64(&this.active))
+	return PoolStat{
+		TotalConns:  idle + active,
+		IdleConns:   idle,
+		ActiveConns: active,
+		Waited:      atomic.LoadInt64(&this.waited),
+		Refused:     atomic.LoadInt64(&this.refused),
+	}
 }
 
 func (this *ConnectionPool) getConns() chan net.Conn {
+	this.lock.RLock()
 	conns := this.conns
+	this.lock.RUnlock()
 	return conns
 }
 
@@ -117,10 +490,27 @@ func (this *ConnectionPool) put(conn net.Conn) error {
 	if conn == nil {
 		return errors.New("connection is nil")
 	}
-	if this.conns == nil {
+	if this.getConns() == nil {
 		return conn.Close()
 	}
+	if this.testOnReturn {
+		if err := this.activeConn(conn); err != nil {
+			this.opts.reportBackgroundError(fmt.Errorf("discarding connection to %s failing ACTIVE_TEST on return: %w",
+				conn.RemoteAddr(), err))
+			return conn.Close()
+		}
+	}
+
+	if tc, ok := conn.(*timedConn); ok {
+		tc.idleSince = time.Now()
+	}
 
+	// hold the read lock so Close can't close the channel under us
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	if this.conns == nil {
+		return conn.Close()
+	}
 	select {
 	case this.conns <- conn:
 		return nil
@@ -129,23 +519,101 @@ func (this *ConnectionPool) put(conn net.Conn) error {
 	}
 }
 
+// reserve counts a connection about to be dialed as active, unless the
+// pool already holds maxConns connections, idle and checked out ones
+// together. It returns that total.
+func (this *ConnectionPool) reserve() (int, bool) {
+	for {
+		active := atomic.LoadInt64(&this.active)
+		total := this.Len() + int(active)
+		if total >= this.maxConns {
+			return total, false
+		}
+		if atomic.CompareAndSwapInt64(&this.active, active, active+1) {
+			return total + 1, true
+		}
+	}
+}
+
+// wrapConn hands out conn, which the caller already counted as active.
 func (this *ConnectionPool) wrapConn(conn net.Conn) net.Conn {
-	c := pConn{pool: this}
+	c := &pConn{pool: this, timeout: this.opts.ioTimeout}
 	c.Conn = conn
+	this.statsLock.Lock()
+	this.checkedOut[c] = struct{}{}
+	this.statsLock.Unlock()
 	return c
 }
 
 func (this *ConnectionPool) activeConn(conn net.Conn) error {
+	if this.opts.ioTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(this.opts.ioTimeout))
+		defer conn.SetDeadline(time.Time{})
+	}
 	th := &trackerHeader{}
 	th.cmd = FDFS_PROTO_CMD_ACTIVE_TEST
-	th.sendHeader(conn)
-	th.recvHeader(conn)
+	if err := th.sendHeader(conn); err != nil {
+		return err
+	}
+	if err := th.recvHeader(conn); err != nil {
+		return err
+	}
 	if th.cmd == 100 && th.status == 0 {
 		return nil
 	}
 	return errors.New("Conn unaliviable")
 }
 
+var aLongTimeAgo = time.Unix(1, 0)
+
+// connAlive checks an idle connection for a closed peer without blocking:
+// a closed one reports EOF or a reset. Idle connections have nothing to
+// read, so any data means the connection is out of step and is no good
+// either. Where the socket can't be peeked at, a read waiting a millisecond
+// stands in.
+func connAlive(conn net.Conn) bool {
+	if tc, ok := conn.(*timedConn); ok {
+		conn = tc.Conn
+	}
+	if alive, ok := peekAlive(conn); ok {
+		return alive
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(time.Millisecond)); err != nil {
+		return false
+	}
+	var b [1]byte
+	n, err := conn.Read(b[:])
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return false
+	}
+	ne, ok := err.(net.Error)
+	return n == 0 && ok && ne.Timeout()
+}
+
+// watchConn aborts any pending I/O on conn once ctx is done. The returned
+// stop function ends the watch and reports whether ctx fired, in which case
+// conn has a deadline in the past and must not be reused.
+func watchConn(ctx context.Context, conn net.Conn) func() bool {
+	if ctx.Done() == nil {
+		return func() bool { return false }
+	}
+	stopc := make(chan struct{})
+	firedc := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(aLongTimeAgo)
+			firedc <- true
+		case <-stopc:
+			firedc <- false
+		}
+	}()
+	return func() bool {
+		close(stopc)
+		return <-firedc
+	}
+}
+
 func TcpSendData(conn net.Conn, bytesStream []byte) error {
 	if _, err := conn.Write(bytesStream); err != nil {
 		return err
@@ -154,35 +622,79 @@ func TcpSendData(conn net.Conn, bytesStream []byte) error {
 }
 
 func TcpSendFile(conn net.Conn, filename string) error {
-	file, err := os.Open(filename)
-	defer file.Close()
+	fileInfo, err := os.Stat(filename)
 	if err != nil {
 		return err
 	}
 
-	var fileSize int64 = 0
-	if fileInfo, err := file.Stat(); err == nil {
-		fileSize = fileInfo.Size()
-	}
-
+	fileSize := fileInfo.Size()
 	if fileSize == 0 {
 		errmsg := fmt.Sprintf("file size is zeor [%s]", filename)
 		return errors.New(errmsg)
 	}
 
-	fileBuffer := make([]byte, fileSize)
+	return sendFile(conn, filename, fileSize)
+}
 
-	_, err = file.Read(fileBuffer)
+// sendFile streams exactly fileSize bytes of filename to w without loading
+// the file into memory.
+func sendFile(w io.Writer, filename string, fileSize int64) error {
+	file, err := os.Open(filename)
 	if err != nil {
 		return err
 	}
+	defer file.Close()
+
+	n, err := io.CopyN(w, file, fileSize)
+	if err == io.EOF {
+		return fmt.Errorf("file %s shrank while uploading: sent %d of %d bytes", filename, n, fileSize)
+	}
+	return err
+}
+
+const stallChunkSize = 256 * 1024
 
-	return TcpSendData(conn, fileBuffer)
+// stallWriter writes to conn in chunks, each bounded by timeout, and
+// reports ErrUploadStalled when a chunk doesn't get through in time.
+type stallWriter struct {
+	ctx     context.Context
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (this *stallWriter) Write(p []byte) (int, error) {
+	defer this.conn.SetWriteDeadline(time.Time{})
+
+	written := 0
+	for written < len(p) {
+		if err := this.ctx.Err(); err != nil {
+			return written, err
+		}
+		chunk := p[written:]
+		if len(chunk) > stallChunkSize {
+			chunk = chunk[:stallChunkSize]
+		}
+		this.conn.SetWriteDeadline(time.Now().Add(this.timeout))
+		n, err := this.conn.Write(chunk)
+		written += n
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && this.ctx.Err() == nil {
+				return written, ErrUploadStalled
+			}
+			return written, err
+		}
+	}
+	return written, nil
 }
 
 func TcpRecvResponse(conn net.Conn, bufferSize int64) ([]byte, int64, error) {
+	if bufferSize <= 0 {
+		return nil, 0, nil
+	}
 	recvBuff := make([]byte, 0, bufferSize)
-	tmp := make([]byte, 256)
+	tp := recvBufPool.Get().(*[]byte)
+	defer recvBufPool.Put(tp)
+	tmp := *tp
 	var total int64
 	for {
 		n, err := conn.Read(tmp)
@@ -192,6 +704,9 @@ func TcpRecvResponse(conn net.Conn, bufferSize int64) ([]byte, int64, error) {
 			if err != io.EOF {
 				return nil, 0, err
 			}
+			if total < bufferSize {
+				return nil, 0, io.ErrUnexpectedEOF
+			}
 			break
 		}
 		if total == bufferSize {
@@ -203,14 +718,136 @@ func TcpRecvResponse(conn net.Conn, bufferSize int64) ([]byte, int64, error) {
 
 func TcpRecvFile(conn net.Conn, localFilename string, bufferSize int64) (int64, error) {
 	file, err := os.Create(localFilename)
-	defer file.Close()
 	if err != nil {
 		return 0, err
 	}
+	defer file.Close()
 
-	recvBuff, total, err := TcpRecvResponse(conn, bufferSize)
-	if _, err := file.Write(recvBuff); err != nil {
-		return 0, err
+	// stream straight to disk instead of buffering the whole file in memory
+	total, err := io.CopyN(file, conn, bufferSize)
+	if err != nil && err != io.EOF {
+		return total, err
 	}
 	return total, nil
 }
+
+// weightedSelector is nginx's smooth weighted round-robin: it spreads the
+// picks of each endpoint evenly instead of in bursts.
+type weightedSelector struct {
+	lock      sync.Mutex
+	endpoints []string
+	weights   []int
+	current   []int
+	total     int
+}
+
+func newWeightedSelector(endpoints []string, weights map[string]int) *weightedSelector {
+	s := &weightedSelector{
+		endpoints: endpoints,
+		weights:   make([]int, len(endpoints)),
+		current:   make([]int, len(endpoints)),
+	}
+	for i, endpoint := range endpoints {
+		s.weights[i] = 1
+		if w := weights[endpoint]; w > 0 {
+			s.weights[i] = w
+		}
+		s.total += s.weights[i]
+	}
+	return s
+}
+
+func (this *weightedSelector) next() string {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	best := 0
+	for i := range this.endpoints {
+		this.current[i] += this.weights[i]
+		if this.current[i] > this.current[best] {
+			best = i
+		}
+	}
+	this.current[best] -= this.total
+	return this.endpoints[best]
+}
+
+// expired reports whether conn has been idle or open for too long to be
+// handed out again.
+func (this *ConnectionPool) expired(conn net.Conn, now time.Time) bool {
+	return this.pastLifetime(conn, now) || this.idleTooLong(conn, now)
+}
+
+func (this *ConnectionPool) pastLifetime(conn net.Conn, now time.Time) bool {
+	tc, ok := conn.(*timedConn)
+	return ok && this.opts.maxLifetime > 0 && now.Sub(tc.created) > this.opts.maxLifetime
+}
+
+func (this *ConnectionPool) idleTooLong(conn net.Conn, now time.Time) bool {
+	tc, ok := conn.(*timedConn)
+	return ok && this.opts.maxIdleTime > 0 && now.Sub(tc.idleSince) > this.opts.maxIdleTime
+}
+
+// reapInterval is how often idle connections are checked, half the
+// shorter of the idle time and the lifetime, zero if neither is limited.
+func (this *ConnectionPool) reapInterval() time.Duration {
+	interval := this.opts.maxIdleTime
+	if this.opts.maxLifetime > 0 && (interval <= 0 || this.opts.maxLifetime < interval) {
+		interval = this.opts.maxLifetime
+	}
+	return interval / 2
+}
+
+func (this *ConnectionPool) reapLoop(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		this.reap()
+	}
+}
+
+// reap closes the idle connections past their lifetime, and those idle for
+// too long as long as more than minConns are idle.
+func (this *ConnectionPool) reap() {
+	var stale []net.Conn
+	now := time.Now()
+
+	// hold the read lock so Close can't close the channel under us
+	this.lock.RLock()
+	if this.conns != nil {
+		idle := len(this.conns)
+		// cycle through the idle connections once, oldest first
+	sweep:
+		for i := idle; i > 0; i-- {
+			var conn net.Conn
+			select {
+			case conn = <-this.conns:
+			default:
+				// taken by Get meanwhile
+				break sweep
+			}
+			if this.pastLifetime(conn, now) || idle > this.minConns && this.idleTooLong(conn, now) {
+				stale = append(stale, conn)
+				idle--
+				continue
+			}
+			select {
+			case this.conns <- conn:
+			default:
+				stale = append(stale, conn)
+			}
+		}
+	}
+	this.lock.RUnlock()
+
+	for _, conn := range stale {
+		if err := conn.Close(); err != nil {
+			this.opts.reportBackgroundError(fmt.Errorf("closing expired connection to %s: %w", conn.RemoteAddr(), err))
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package fastdfs
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBrokenStorageConnNotPooled(t *testing.T) {
+	c := newFakeCluster(t)
+	defer c.close()
+	// without the borrow test a pooled broken connection would fail the
+	// next upload
+	client := c.client(t, func(cfg *Config) { cfg.SkipTestOnBorrow = true })
+
+	if _, err := client.UploadByBuffer([]byte("first"), "txt"); err != nil {
+		t.Fatalf("UploadByBuffer() error = %v", err)
+	}
+	if idle := client.PoolStats()[c.storage.addr()].IdleConns; idle != 1 {
+		t.Fatalf("idle storage connections = %d, want 1", idle)
+	}
+	accepted := c.storage.Accepted()
+
+	c.storage.setFault(STORAGE_PROTO_CMD_UPLOAD_FILE, faultClose, 1)
+	if _, err := client.UploadByBuffer([]byte("second"), "txt"); err == nil {
+		t.Fatal("UploadByBuffer() on a closed connection succeeded")
+	}
+	if stat := client.PoolStats()[c.storage.addr()]; stat.TotalConns != 0 {
+		t.Fatalf("storage pool after a broken connection = %+v, want it empty", stat)
+	}
+
+	if _, err := client.UploadByBuffer([]byte("third"), "txt"); err != nil {
+		t.Fatalf("UploadByBuffer() after a broken connection error = %v", err)
+	}
+	if got := c.storage.Accepted(); got != accepted+1 {
+		t.Errorf("storage accepted %d connections, want %d", got, accepted+1)
+	}
+}
+
+func TestRejectedRequestKeepsConn(t *testing.T) {
+	c := newFakeCluster(t)
+	defer c.close()
+	client := c.client(t, nil)
+
+	ur, err := client.UploadByBuffer([]byte("content"), "txt")
+	if err != nil {
+		t.Fatalf("UploadByBuffer() error = %v", err)
+	}
+	if err := client.DeleteFile(ur.fileId()); err != nil {
+		t.Fatalf("DeleteFile() error = %v", err)
+	}
+	idle, accepted := c.storagePool(client).Len(), c.storage.Accepted()
+
+	var errno Errno
+	if err := client.DeleteFile(ur.fileId()); !errors.As(err, &errno) || errno.status != fakeEnoent {
+		t.Fatalf("DeleteFile() of a deleted file error = %v, want ENOENT", err)
+	}
+	if got := c.storagePool(client).Len(); got != idle {
+		t.Errorf("idle storage connections after ENOENT = %d, want %d", got, idle)
+	}
+	if got := c.storage.Accepted(); got != accepted {
+		t.Errorf("storage accepted %d connections, want %d", got, accepted)
+	}
+}
+
+func TestDeadTrackerConnFailsQuery(t *testing.T) {
+	c := newFakeCluster(t)
+	defer c.close()
+	client := c.client(t, func(cfg *Config) { cfg.SkipTestOnBorrow = true })
+
+	// the pooled tracker connection dies, as when the tracker restarts
+	c.tracker.dropConns()
+	_, err := client.UploadByBuffer([]byte("content"), "txt")
+	if err == nil {
+		t.Fatal("UploadByBuffer() over a dead tracker connection succeeded")
+	}
+	if !retryable(err) {
+		t.Errorf("UploadByBuffer() error = %v, want a retryable connection error", err)
+	}
+	if idle := client.PoolStats()[c.tracker.addr()].IdleConns; idle != 0 {
+		t.Errorf("idle tracker connections = %d, want 0", idle)
+	}
+
+	if _, err := client.UploadByBuffer([]byte("content"), "txt"); err != nil {
+		t.Fatalf("UploadByBuffer() after redialing the tracker error = %v", err)
+	}
+}
+
+func TestPoolStats(t *testing.T) {
+	st := newFakeStorage(t, "127.0.0.1:0", "group1")
+	defer st.close()
+	pool, err := NewConnectionPool([]string{st.addr()}, 0, 2)
+	if err != nil {
+		t.Fatalf("NewConnectionPool() error = %v", err)
+	}
+	defer pool.Close()
+
+	var conns []net.Conn
+	get := func() error {
+		conn, err := pool.Get()
+		if err == nil {
+			conns = append(conns, conn)
+		}
+		return err
+	}
+	put := func() error {
+		conn := conns[len(conns)-1]
+		conns = conns[:len(conns)-1]
+		return conn.Close()
+	}
+
+	steps := []struct {
+		name     string
+		op       func() error
+		wantFail bool
+		want     PoolStat
+	}{
+		{"dial", get, false, PoolStat{TotalConns: 1, ActiveConns: 1, Waited: 1}},
+		{"dial second", get, false, PoolStat{TotalConns: 2, ActiveConns: 2, Waited: 2}},
+		{"refuse third", get, true, PoolStat{TotalConns: 2, ActiveConns: 2, Waited: 3, Refused: 1}},
+		{"return", put, false, PoolStat{TotalConns: 2, IdleConns: 1, ActiveConns: 1, Waited: 3, Refused: 1}},
+		{"reuse idle", get, false, PoolStat{TotalConns: 2, ActiveConns: 2, Waited: 3, Refused: 1}},
+		{"return both", func() error {
+			put()
+			return put()
+		}, false, PoolStat{TotalConns: 2, IdleConns: 2, Waited: 3, Refused: 1}},
+	}
+	for _, step := range steps {
+		err := step.op()
+		if (err != nil) != step.wantFail {
+			t.Fatalf("%s: error = %v, want failure %v", step.name, err, step.wantFail)
+		}
+		if got := pool.Stats(); got != step.want {
+			t.Fatalf("%s: Stats() = %+v, want %+v", step.name, got, step.want)
+		}
+	}
+}
+
+// waitFor polls cond for up to a second.
+func waitFor(cond func() bool) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if cond() {
+			return true
+		}
+	}
+	return cond()
+}
+
+func TestPoolExpiresConns(t *testing.T) {
+	tests := []struct {
+		name        string
+		minConns    int
+		maxIdleTime time.Duration
+		maxLifetime time.Duration
+		// wantRedial is whether the connection pooled before the pause is
+		// closed and a new one dialed for the next Get
+		wantRedial bool
+	}{
+		{"fresh", 1, time.Minute, 0, false},
+		{"idle past MaxIdleTime", 1, 30 * time.Millisecond, 0, true},
+		{"idle past MaxIdleTime, reaped", 0, 30 * time.Millisecond, 0, true},
+		{"past MaxLifetime", 1, 0, 30 * time.Millisecond, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := newFakeStorage(t, "127.0.0.1:0", "group1")
+			defer st.close()
+			pool, err := newConnectionPool([]string{st.addr()}, poolOptions{
+				minConns:    tt.minConns,
+				maxConns:    2,
+				maxIdleTime: tt.maxIdleTime,
+				maxLifetime: tt.maxLifetime,
+			})
+			if err != nil {
+				t.Fatalf("newConnectionPool() error = %v", err)
+			}
+			defer pool.Close()
+
+			conn, err := pool.Get()
+			if err != nil {
+				t.Fatalf("Get() error = %v", err)
+			}
+			conn.Close()
+			time.Sleep(80 * time.Millisecond)
+
+			if tt.wantRedial && tt.minConns == 0 {
+				if !waitFor(func() bool { return pool.Len() == 0 && st.openConns() == 0 }) {
+					t.Fatalf("idle connection not reaped: %d pooled, %d open", pool.Len(), st.openConns())
+				}
+			}
+			if conn, err = pool.Get(); err != nil {
+				t.Fatalf("Get() after the pause error = %v", err)
+			}
+			defer conn.Close()
+
+			wantAccepted := int64(1)
+			if tt.wantRedial {
+				wantAccepted = 2
+			}
+			// the server may not have accepted a new connection yet
+			if !waitFor(func() bool { return st.Accepted() == wantAccepted }) {
+				t.Errorf("server accepted %d connections, want %d", st.Accepted(), wantAccepted)
+			}
+			if !waitFor(func() bool { return st.openConns() == 1 }) {
+				t.Errorf("server has %d open connections, want the expired one closed", st.openConns())
+			}
+		})
+	}
+}
+
+func TestPoolEndpoints(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		wantFail bool
+	}{
+		{"10.0.1.70:22122", false},
+		{"[::1]:22122", false},
+		{"[2001:db8::1]:22122", false},
+		{"tracker.example.com:22122", false},
+		{"10.0.1.70", true},
+		{"::1:22122", true},
+		{"2001:db8::1", true},
+		{"[::1]22122", true},
+	}
+	for _, tt := range tests {
+		// no warm-up, nothing is dialed
+		pool, err := NewConnectionPool([]string{tt.endpoint}, 0, 1)
+		if (err != nil) != tt.wantFail {
+			t.Errorf("NewConnectionPool(%q) error = %v, want failure %v", tt.endpoint, err, tt.wantFail)
+		}
+		if pool != nil {
+			pool.Close()
+		}
+	}
+}
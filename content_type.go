@@ -0,0 +1,52 @@
+package fastdfs
+
+import (
+	"mime"
+	"path"
+	"strings"
+)
+
+const defaultContentType = "application/octet-stream"
+
+// fallbackContentTypes covers common extensions missing from the system
+// MIME tables on minimal hosts and containers.
+var fallbackContentTypes = map[string]string{
+	".apk":  "application/vnd.android.package-archive",
+	".bmp":  "image/bmp",
+	".css":  "text/css; charset=utf-8",
+	".flv":  "video/x-flv",
+	".gif":  "image/gif",
+	".htm":  "text/html; charset=utf-8",
+	".html": "text/html; charset=utf-8",
+	".ico":  "image/x-icon",
+	".jpeg": "image/jpeg",
+	".jpg":  "image/jpeg",
+	".js":   "application/javascript",
+	".json": "application/json",
+	".mp3":  "audio/mpeg",
+	".mp4":  "video/mp4",
+	".pdf":  "application/pdf",
+	".png":  "image/png",
+	".svg":  "image/svg+xml",
+	".txt":  "text/plain; charset=utf-8",
+	".webp": "image/webp",
+	".xml":  "text/xml; charset=utf-8",
+	".zip":  "application/zip",
+}
+
+// ContentTypeForFileId returns the MIME type matching the extension in
+// remoteFileId, or application/octet-stream if it has none or it is
+// unknown. No network call is made.
+func ContentTypeForFileId(remoteFileId string) string {
+	ext := strings.ToLower(path.Ext(path.Base(remoteFileId)))
+	if ext == "" || ext == "." {
+		return defaultContentType
+	}
+	if contentType := mime.TypeByExtension(ext); contentType != "" {
+		return contentType
+	}
+	if contentType, ok := fallbackContentTypes[ext]; ok {
+		return contentType
+	}
+	return defaultContentType
+}
@@ -0,0 +1,41 @@
+package fastdfs
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+var ErrCrcMismatch = errors.New("crc32 mismatch")
+
+// DownloadToBufferVerified downloads the whole file like DownloadToBuffer
+// and checks the crc32 of its content against the one the storage reports,
+// failing with an error wrapping ErrCrcMismatch if they differ, to catch
+// content corrupted on a storage or on the way. It costs a file info query
+// and a pass over the content. Appender and slave files can't be verified:
+// storages only know the crc32 encoded in a file's name, which for them is
+// that of the content at creation or of the master file.
+func (this *FastDFSClient) DownloadToBufferVerified(remoteFileId string) (*DownloadFileResponse, error) {
+	meta, err := DecodeFileIdMeta(remoteFileId)
+	if err != nil {
+		return nil, err
+	}
+	if meta.IsAppender || meta.IsSlave {
+		return nil, fmt.Errorf("%s: crc32 of appender and slave files is unknown", remoteFileId)
+	}
+
+	info, err := this.QueryFileInfo(remoteFileId)
+	if err != nil {
+		return nil, err
+	}
+	dr, err := this.DownloadToBuffer(remoteFileId, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	content, _ := dr.Content.([]byte)
+	// storages may send the crc32 sign extended
+	if sum := crc32.ChecksumIEEE(content); sum != uint32(info.Crc32) {
+		return nil, fmt.Errorf("%w: %s has %08x, storage reports %08x", ErrCrcMismatch, remoteFileId, sum, uint32(info.Crc32))
+	}
+	return dr, nil
+}
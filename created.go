@@ -0,0 +1,54 @@
+package fastdfs
+
+import (
+	"fmt"
+	"time"
+)
+
+// CreatedAtMetaName is the metadata name UploadByBufferWithTime stores the
+// original creation time under, in RFC 3339 format.
+const CreatedAtMetaName = "created_at"
+
+// UploadByBufferWithTime uploads filebuffer like UploadByBuffer and records
+// createdAt in the file's metadata, e.g. to keep the original timestamps of
+// files imported from another system. The protocol has no way to set the
+// creation time itself, so the time embedded in the file id and reported by
+// the storage is still the upload time; read createdAt back with CreatedAt.
+// If the metadata can't be set the file is deleted again.
+func (this *FastDFSClient) UploadByBufferWithTime(filebuffer []byte, fileExtName string, createdAt time.Time) (*UploadFileResponse, error) {
+	ur, err := this.UploadByBuffer(filebuffer, fileExtName)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := map[string]string{CreatedAtMetaName: createdAt.Format(time.RFC3339Nano)}
+	if err = this.SetMetadata(ur.fileId(), meta, STORAGE_SET_METADATA_FLAG_MERGE); err != nil {
+		if delErr := this.DeleteFile(ur.fileId()); delErr != nil {
+			this.log.Warnf("deleting %s after failing to set its creation time: %v", ur.fileId(), delErr)
+		}
+		return nil, err
+	}
+	return ur, nil
+}
+
+// CreatedAt returns the creation time recorded by UploadByBufferWithTime,
+// or the upload time embedded in the file id for files uploaded otherwise.
+func (this *FastDFSClient) CreatedAt(remoteFileId string) (time.Time, error) {
+	meta, err := this.GetMetadata(remoteFileId)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if value, ok := meta[CreatedAtMetaName]; ok {
+		createdAt, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid %s metadata of %s: %w", CreatedAtMetaName, remoteFileId, err)
+		}
+		return createdAt, nil
+	}
+
+	idMeta, err := DecodeFileIdMeta(remoteFileId)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(idMeta.CreateTimestamp, 0), nil
+}
@@ -0,0 +1,122 @@
+package fastdfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// DiagnosticStage is the outcome of one step of Diagnose.
+type DiagnosticStage struct {
+	Name     string
+	Duration time.Duration
+	Err      error
+}
+
+type DiagnosticsReport struct {
+	Stages []DiagnosticStage
+	// FailedStage names the first stage that failed, empty if all passed.
+	FailedStage string
+}
+
+func (this *DiagnosticsReport) OK() bool {
+	return this.FailedStage == ""
+}
+
+func (this *DiagnosticsReport) run(ctx context.Context, name string, stage func() error) error {
+	start := time.Now()
+	err := ctx.Err()
+	if err == nil {
+		err = stage()
+	}
+	this.Stages = append(this.Stages, DiagnosticStage{name, time.Since(start), err})
+	if err != nil && this.FailedStage == "" {
+		this.FailedStage = name
+	}
+	return err
+}
+
+// Diagnose runs a full round trip against the cluster: it pings every
+// tracker, queries a storage for upload, uploads a tiny file, downloads and
+// verifies it and deletes it again, timing each stage. The test file is
+// deleted even if a later stage fails. The returned error is that of the
+// first failed stage, which the report names.
+func (this *FastDFSClient) Diagnose(ctx context.Context) (*DiagnosticsReport, error) {
+	report := &DiagnosticsReport{}
+	content := []byte(fmt.Sprintf("fastdfs diagnose %d", time.Now().UnixNano()))
+
+	err := report.run(ctx, "ping trackers", func() error {
+		for _, endpoint := range this.pool.endpoints {
+			if err := this.pingEndpoint(ctx, endpoint); err != nil {
+				return fmt.Errorf("tracker %s: %v", endpoint, err)
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		err = report.run(ctx, "query storage", func() error {
+			_, err := this.queryUploadStorage(this.trackerClient())
+			return err
+		})
+	}
+
+	var remoteFileId string
+	if err == nil {
+		err = report.run(ctx, "upload", func() error {
+			ur, err := this.UploadByBuffer(content, "txt")
+			if err != nil {
+				return err
+			}
+			remoteFileId = ur.fileId()
+			return nil
+		})
+	}
+	if err == nil {
+		err = report.run(ctx, "download", func() error {
+			dr, err := this.DownloadToBuffer(remoteFileId, 0, 0)
+			if err != nil {
+				return err
+			}
+			if downloaded, _ := dr.Content.([]byte); !bytes.Equal(downloaded, content) {
+				return errors.New("downloaded content does not match the upload")
+			}
+			return nil
+		})
+	}
+	if remoteFileId != "" {
+		// clean up regardless of how the download went, even if ctx is done
+		delErr := report.run(context.Background(), "delete", func() error {
+			return this.DeleteFile(remoteFileId)
+		})
+		if err == nil {
+			err = delErr
+		}
+	}
+
+	if err != nil {
+		return report, fmt.Errorf("diagnose %s: %v", report.FailedStage, err)
+	}
+	return report, nil
+}
+
+// pingEndpoint sends ACTIVE_TEST over a fresh connection, so the result
+// reflects the endpoint itself rather than a pooled connection.
+func (this *FastDFSClient) pingEndpoint(ctx context.Context, endpoint string) error {
+	dial := (&net.Dialer{Timeout: 10 * time.Second}).DialContext
+	if this.poolOpts.dialContext != nil {
+		dial = this.poolOpts.dialContext
+	}
+	conn, err := dial(ctx, "tcp", endpoint)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	return this.pool.activeConn(conn)
+}
@@ -0,0 +1,659 @@
+package fastdfs
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// This file runs a tracker and a storage in process, on loopback
+// listeners, speaking enough of the protocol for the client's operations.
+
+// fakeFault is what a fakeServer does with a request instead of answering.
+type fakeFault int
+
+const (
+	// faultClose closes the connection after reading the request
+	faultClose fakeFault = iota + 1
+	// faultHang reads the request and never answers
+	faultHang
+)
+
+// fakeServer reads requests from every connection and answers each with
+// handle, unless a fault is set for its command.
+type fakeServer struct {
+	ln     net.Listener
+	handle func(cmd int8, body []byte) (status int8, resp []byte)
+
+	accepted int64 // only accessed atomically
+
+	lock   sync.Mutex
+	conns  map[net.Conn]struct{}
+	faults map[int8]fakeFault
+	// faultsLeft counts down the requests a fault applies to, a fault
+	// without an entry applies until cleared
+	faultsLeft map[int8]int
+	requests   map[int8]int
+	wg         sync.WaitGroup
+}
+
+func newFakeServer(t testing.TB, addr string, handle func(cmd int8, body []byte) (int8, []byte)) *fakeServer {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("listen on %s: %v", addr, err)
+	}
+	s := &fakeServer{
+		ln:         ln,
+		handle:     handle,
+		conns:      make(map[net.Conn]struct{}),
+		faults:     make(map[int8]fakeFault),
+		faultsLeft: make(map[int8]int),
+		requests:   make(map[int8]int),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s
+}
+
+func (s *fakeServer) addr() string {
+	return s.ln.Addr().String()
+}
+
+// Accepted is the number of connections accepted so far.
+func (s *fakeServer) Accepted() int64 {
+	return atomic.LoadInt64(&s.accepted)
+}
+
+// openConns is the number of connections the server hasn't seen closed.
+func (s *fakeServer) openConns() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.conns)
+}
+
+// setFault makes the next n requests with cmd fail with fault, every one
+// if n is negative. A zero fault clears it.
+func (s *fakeServer) setFault(cmd int8, fault fakeFault, n int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.faultsLeft, cmd)
+	if fault == 0 {
+		delete(s.faults, cmd)
+		return
+	}
+	s.faults[cmd] = fault
+	if n >= 0 {
+		s.faultsLeft[cmd] = n
+	}
+}
+
+// Requests returns how many requests with cmd were read.
+func (s *fakeServer) Requests(cmd int8) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.requests[cmd]
+}
+
+// fault counts a request with cmd and returns the fault to apply to it.
+func (s *fakeServer) fault(cmd int8) fakeFault {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.requests[cmd]++
+	fault := s.faults[cmd]
+	if n, ok := s.faultsLeft[cmd]; ok {
+		if n <= 1 {
+			delete(s.faults, cmd)
+			delete(s.faultsLeft, cmd)
+		} else {
+			s.faultsLeft[cmd] = n - 1
+		}
+	}
+	return fault
+}
+
+// dropConns closes every open connection, as a restarting server would.
+func (s *fakeServer) dropConns() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+func (s *fakeServer) close() {
+	s.ln.Close()
+	s.dropConns()
+	s.wg.Wait()
+}
+
+func (s *fakeServer) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		atomic.AddInt64(&s.accepted, 1)
+		s.lock.Lock()
+		s.conns[conn] = struct{}{}
+		s.lock.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.serveConn(conn)
+			s.lock.Lock()
+			delete(s.conns, conn)
+			s.lock.Unlock()
+			conn.Close()
+		}()
+	}
+}
+
+func (s *fakeServer) serveConn(conn net.Conn) {
+	header := make([]byte, 10)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		pkgLen := int64(binary.BigEndian.Uint64(header))
+		cmd := int8(header[8])
+		body := make([]byte, pkgLen)
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return
+		}
+
+		switch s.fault(cmd) {
+		case faultClose:
+			return
+		case faultHang:
+			io.Copy(ioutil.Discard, conn)
+			return
+		}
+
+		status, resp := s.handle(cmd, body)
+		binary.BigEndian.PutUint64(header, uint64(len(resp)))
+		header[8] = TRACKER_PROTO_CMD_RESP
+		header[9] = byte(status)
+		if _, err := conn.Write(append(header, resp...)); err != nil {
+			return
+		}
+	}
+}
+
+const (
+	fakeEnoent = 2
+	fakeEexist = 17
+	fakeEinval = 22
+)
+
+type fakeFile struct {
+	content  []byte
+	appender bool
+	created  int64
+	meta     []byte
+}
+
+// fakeStorage keeps the files of one group in memory.
+type fakeStorage struct {
+	*fakeServer
+	group string
+
+	filesLock sync.Mutex
+	files     map[string]*fakeFile
+	seq       uint32
+	// discard answers uploads without keeping the files
+	discard bool
+}
+
+func newFakeStorage(t testing.TB, addr string, group string) *fakeStorage {
+	st := &fakeStorage{group: group, files: make(map[string]*fakeFile)}
+	st.fakeServer = newFakeServer(t, addr, st.handle)
+	return st
+}
+
+// discardFiles makes the storage answer uploads without keeping them.
+func (st *fakeStorage) discardFiles() {
+	st.filesLock.Lock()
+	st.discard = true
+	st.filesLock.Unlock()
+}
+
+// file returns the content of remoteFilename, nil if there is no such file.
+func (st *fakeStorage) file(remoteFilename string) []byte {
+	st.filesLock.Lock()
+	defer st.filesLock.Unlock()
+	if f := st.files[remoteFilename]; f != nil {
+		return append([]byte(nil), f.content...)
+	}
+	return nil
+}
+
+// fileNames returns the names of all files kept.
+func (st *fakeStorage) fileNames() []string {
+	st.filesLock.Lock()
+	defer st.filesLock.Unlock()
+	var names []string
+	for name := range st.files {
+		names = append(names, name)
+	}
+	return names
+}
+
+// newName generates a file name the way a storage does, encoding its
+// source ip, a timestamp, the size and the crc32 of content. Timestamps
+// count up, so names are unique.
+func (st *fakeStorage) newName(storePathIndex byte, content []byte, appender bool, ext string) (string, int64) {
+	st.seq++
+	created := int64(1600000000 + st.seq)
+	size := int64(len(content))
+	if appender {
+		size |= fakeAppenderFileSize
+	}
+	buff := make([]byte, 20)
+	copy(buff[0:4], net.IPv4(127, 0, 0, 1).To4())
+	binary.BigEndian.PutUint32(buff[4:8], uint32(created))
+	binary.BigEndian.PutUint64(buff[8:16], uint64(size))
+	binary.BigEndian.PutUint32(buff[16:20], crc32.ChecksumIEEE(content))
+	name := fmt.Sprintf("M%02X/00/00/", storePathIndex) + base64.RawURLEncoding.EncodeToString(buff)
+	if ext != "" {
+		name += "." + ext
+	}
+	return name, created
+}
+
+// fakeAppenderFileSize marks the size encoded in appender file names.
+const fakeAppenderFileSize = int64(1) << 58
+
+// fileResp is the group and file name answering an upload.
+func (st *fakeStorage) fileResp(name string) []byte {
+	return append(padded(st.group, FDFS_GROUP_NAME_MAX_LEN), name...)
+}
+
+func (st *fakeStorage) handle(cmd int8, body []byte) (int8, []byte) {
+	st.filesLock.Lock()
+	defer st.filesLock.Unlock()
+
+	be := binary.BigEndian
+	switch cmd {
+	case FDFS_PROTO_CMD_ACTIVE_TEST:
+		return 0, nil
+
+	case STORAGE_PROTO_CMD_UPLOAD_FILE, STORAGE_PROTO_CMD_UPLOAD_APPENDER_FILE:
+		// |-store_path_index(1)-file_size(8)-ext(6)-content-|
+		if len(body) < 15 || int64(be.Uint64(body[1:9])) != int64(len(body)-15) {
+			return fakeEinval, nil
+		}
+		content := body[15:]
+		appender := cmd == STORAGE_PROTO_CMD_UPLOAD_APPENDER_FILE
+		name, created := st.newName(body[0], content, appender, cstr(body[9:15]))
+		if !st.discard {
+			st.files[name] = &fakeFile{content: content, appender: appender, created: created}
+		}
+		return 0, st.fileResp(name)
+
+	case STORAGE_PROTO_CMD_UPLOAD_SLAVE_FILE:
+		// |-master_len(8)-file_size(8)-prefix(16)-ext(6)-master-content-|
+		if len(body) < 38 {
+			return fakeEinval, nil
+		}
+		masterLen := int(be.Uint64(body[0:8]))
+		if len(body) < 38+masterLen || int64(be.Uint64(body[8:16])) != int64(len(body)-38-masterLen) {
+			return fakeEinval, nil
+		}
+		master := string(body[38 : 38+masterLen])
+		if st.files[master] == nil {
+			return fakeEnoent, nil
+		}
+		// like the storage: the master name without its extension, the
+		// prefix and the given extension, if any
+		name := master
+		if i := strings.LastIndexByte(name, '.'); i > strings.LastIndexByte(name, '/') {
+			name = name[:i]
+		}
+		name += cstr(body[16:32])
+		if ext := strings.TrimPrefix(cstr(body[32:38]), "."); ext != "" {
+			name += "." + ext
+		}
+		if st.files[name] != nil {
+			return fakeEexist, nil
+		}
+		st.files[name] = &fakeFile{content: append([]byte(nil), body[38+masterLen:]...), created: st.files[master].created}
+		return 0, st.fileResp(name)
+
+	case STORAGE_PROTO_CMD_DELETE_FILE:
+		name := string(body[FDFS_GROUP_NAME_MAX_LEN:])
+		if st.files[name] == nil {
+			return fakeEnoent, nil
+		}
+		delete(st.files, name)
+		return 0, nil
+
+	case STORAGE_PROTO_CMD_DOWNLOAD_FILE:
+		// |-offset(8)-download_bytes(8)-group(16)-filename-|
+		offset, size := int64(be.Uint64(body[0:8])), int64(be.Uint64(body[8:16]))
+		f := st.files[string(body[32:])]
+		if f == nil {
+			return fakeEnoent, nil
+		}
+		// like the storage: an offset past the end is invalid, a size
+		// past it is cut to the end
+		remaining := int64(len(f.content)) - offset
+		if offset < 0 || remaining < 0 {
+			return fakeEinval, nil
+		}
+		if size == 0 || size > remaining {
+			size = remaining
+		}
+		return 0, f.content[offset : offset+size]
+
+	case STORAGE_PROTO_CMD_SET_METADATA:
+		// |-filename_len(8)-meta_size(8)-flag(1)-group(16)-filename-meta-|
+		nameLen := int(be.Uint64(body[0:8]))
+		f := st.files[string(body[33:33+nameLen])]
+		if f == nil {
+			return fakeEnoent, nil
+		}
+		meta := body[33+nameLen:]
+		if body[16] == STORAGE_SET_METADATA_FLAG_MERGE {
+			merged := unmarshalMetadata(f.meta)
+			for name, value := range unmarshalMetadata(meta) {
+				merged[name] = value
+			}
+			meta = marshalMetadata(merged)
+		}
+		f.meta = append([]byte(nil), meta...)
+		return 0, nil
+
+	case STORAGE_PROTO_CMD_GET_METADATA:
+		f := st.files[string(body[FDFS_GROUP_NAME_MAX_LEN:])]
+		if f == nil {
+			return fakeEnoent, nil
+		}
+		return 0, f.meta
+
+	case STORAGE_PROTO_CMD_QUERY_FILE_INFO:
+		name := string(body[FDFS_GROUP_NAME_MAX_LEN:])
+		f := st.files[name]
+		if f == nil {
+			return fakeEnoent, nil
+		}
+		size, crc := int64(len(f.content)), int64(crc32.ChecksumIEEE(f.content))
+		// like the storage: normal files are answered from their name,
+		// only appender files are looked at
+		if meta, err := DecodeFileIdMeta(st.group + "/" + name); err == nil && !f.appender {
+			size, crc = meta.FileSize, meta.Crc32
+		}
+		resp := make([]byte, 3*FDFS_PROTO_PKG_LEN_SIZE+IP_ADDRESS_SIZE)
+		be.PutUint64(resp[0:8], uint64(size))
+		be.PutUint64(resp[8:16], uint64(f.created))
+		be.PutUint64(resp[16:24], uint64(crc))
+		copy(resp[24:], "127.0.0.1")
+		return 0, resp
+
+	case STORAGE_PROTO_CMD_APPEND_FILE:
+		// |-filename_len(8)-file_size(8)-filename-content-|
+		nameLen := int(be.Uint64(body[0:8]))
+		f := st.files[string(body[16:16+nameLen])]
+		if f == nil {
+			return fakeEnoent, nil
+		}
+		if !f.appender {
+			return fakeEinval, nil
+		}
+		f.content = append(f.content, body[16+nameLen:]...)
+		return 0, nil
+
+	case STORAGE_PROTO_CMD_MODIFY_FILE:
+		// |-filename_len(8)-file_offset(8)-file_size(8)-filename-content-|
+		nameLen := int(be.Uint64(body[0:8]))
+		offset := int(be.Uint64(body[8:16]))
+		f := st.files[string(body[24:24+nameLen])]
+		if f == nil {
+			return fakeEnoent, nil
+		}
+		if !f.appender || offset > len(f.content) {
+			return fakeEinval, nil
+		}
+		content := body[24+nameLen:]
+		if end := offset + len(content); end > len(f.content) {
+			f.content = append(f.content, make([]byte, end-len(f.content))...)
+		}
+		copy(f.content[offset:], content)
+		return 0, nil
+
+	case STORAGE_PROTO_CMD_TRUNCATE_FILE:
+		// |-filename_len(8)-truncated_size(8)-filename-|
+		nameLen := int(be.Uint64(body[0:8]))
+		size := int(be.Uint64(body[8:16]))
+		f := st.files[string(body[16:16+nameLen])]
+		if f == nil {
+			return fakeEnoent, nil
+		}
+		if !f.appender || size > len(f.content) {
+			return fakeEinval, nil
+		}
+		f.content = f.content[:size]
+		return 0, nil
+
+	case STORAGE_PROTO_CMD_REGENERATE_APPENDER_FILENAME:
+		old := string(body)
+		f := st.files[old]
+		if f == nil {
+			return fakeEnoent, nil
+		}
+		if !f.appender {
+			return fakeEinval, nil
+		}
+		ext := ""
+		if i := strings.LastIndexByte(old, '.'); i > strings.LastIndexByte(old, '/') {
+			ext = old[i+1:]
+		}
+		name, _ := st.newName(0, f.content, false, ext)
+		delete(st.files, old)
+		f.appender = false
+		st.files[name] = f
+		return 0, st.fileResp(name)
+	}
+	return fakeEinval, nil
+}
+
+// fakeTracker sends every query to one storage.
+type fakeTracker struct {
+	*fakeServer
+
+	lock        sync.Mutex
+	group       string
+	storageIp   string
+	storagePort int64
+	// fetchIp and fetchPort, if set, answer fetch queries instead
+	fetchIp   string
+	fetchPort int64
+	// storages answers LIST_STORAGE, records of TRACKER_STORAGE_STAT_LEN
+	storages []byte
+}
+
+func newFakeTracker(t testing.TB, addr string, group string, storageAddr string) *fakeTracker {
+	tr := &fakeTracker{group: group}
+	tr.setStorage(t, storageAddr)
+	tr.fakeServer = newFakeServer(t, addr, tr.handle)
+	return tr
+}
+
+// setStorage makes the tracker send queries to storageAddr.
+func (tr *fakeTracker) setStorage(t testing.TB, storageAddr string) {
+	host, port := splitAddr(t, storageAddr)
+	tr.lock.Lock()
+	tr.storageIp, tr.storagePort = host, port
+	tr.lock.Unlock()
+}
+
+// setFetchStorage makes the tracker send downloads to storageAddr, like
+// to a replica.
+func (tr *fakeTracker) setFetchStorage(t testing.TB, storageAddr string) {
+	host, port := splitAddr(t, storageAddr)
+	tr.lock.Lock()
+	tr.fetchIp, tr.fetchPort = host, port
+	tr.lock.Unlock()
+}
+
+func splitAddr(t testing.TB, addr string) (string, int64) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := strconv.ParseInt(port, 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return host, n
+}
+
+// setStorages sets the records LIST_STORAGE answers with.
+func (tr *fakeTracker) setStorages(records ...[]byte) {
+	tr.lock.Lock()
+	tr.storages = bytes.Join(records, nil)
+	tr.lock.Unlock()
+}
+
+func (tr *fakeTracker) handle(cmd int8, body []byte) (int8, []byte) {
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+
+	switch cmd {
+	case FDFS_PROTO_CMD_ACTIVE_TEST:
+		return 0, nil
+	case TRACKER_PROTO_CMD_SERVICE_QUERY_STORE_WITH_GROUP_ONE:
+		if cstr(body) != tr.group {
+			return fakeEnoent, nil
+		}
+		return 0, storeBody(tr.group, tr.storageIp, tr.storagePort, 0)
+	case TRACKER_PROTO_CMD_SERVICE_QUERY_STORE_WITHOUT_GROUP_ONE:
+		return 0, storeBody(tr.group, tr.storageIp, tr.storagePort, 0)
+	case TRACKER_PROTO_CMD_SERVICE_QUERY_FETCH_ONE:
+		if tr.fetchIp != "" {
+			return 0, storeBody(tr.group, tr.fetchIp, tr.fetchPort, -1)
+		}
+		return 0, storeBody(tr.group, tr.storageIp, tr.storagePort, -1)
+	case TRACKER_PROTO_CMD_SERVICE_QUERY_UPDATE:
+		return 0, storeBody(tr.group, tr.storageIp, tr.storagePort, -1)
+	case TRACKER_PROTO_CMD_SERVER_LIST_ALL_GROUPS:
+		resp := padded(tr.group, FDFS_GROUP_NAME_MAX_LEN+1)
+		for _, v := range []int64{1 << 20, 1 << 19, 0, 1, tr.storagePort, 8080, 1, 0, 1, 256, 0} {
+			resp = appendInt64(resp, v)
+		}
+		return 0, resp
+	case TRACKER_PROTO_CMD_SERVER_LIST_STORAGE:
+		// |-group_name(16)-storage_id(up to 15, optional)-|
+		if len(body) < FDFS_GROUP_NAME_MAX_LEN || len(body) >= FDFS_GROUP_NAME_MAX_LEN+FDFS_STORAGE_ID_MAX_SIZE {
+			return fakeEinval, nil
+		}
+		if cstr(body[:FDFS_GROUP_NAME_MAX_LEN]) != tr.group {
+			return fakeEnoent, nil
+		}
+		id := string(body[FDFS_GROUP_NAME_MAX_LEN:])
+		if id == "" {
+			return 0, tr.storages
+		}
+		// |-status(1)-id(16)-ip_addr(16)-...-|
+		for i := 0; i < len(tr.storages); i += TRACKER_STORAGE_STAT_LEN {
+			record := tr.storages[i : i+TRACKER_STORAGE_STAT_LEN]
+			if cstr(record[1:17]) == id || cstr(record[17:33]) == id {
+				return 0, record
+			}
+		}
+		return fakeEnoent, nil
+	}
+	return fakeEinval, nil
+}
+
+func appendInt64(b []byte, v int64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(v))
+	return append(b, buf[:]...)
+}
+
+// fakeCluster is a tracker in front of one storage, both on 127.0.0.1.
+type fakeCluster struct {
+	tracker *fakeTracker
+	storage *fakeStorage
+	clients []*FastDFSClient
+}
+
+func newFakeCluster(t testing.TB) *fakeCluster {
+	return newFakeClusterOn(t, "127.0.0.1:0")
+}
+
+func newFakeClusterOn(t testing.TB, addr string) *fakeCluster {
+	storage := newFakeStorage(t, addr, "group1")
+	return &fakeCluster{
+		tracker: newFakeTracker(t, addr, "group1", storage.addr()),
+		storage: storage,
+	}
+}
+
+// client returns a client of the cluster, after letting configure change
+// its config. close closes it.
+func (c *fakeCluster) client(t testing.TB, configure func(cfg *Config)) *FastDFSClient {
+	cfg := Config{
+		Endpoints: []string{c.tracker.addr()},
+		MinConns:  1,
+		MaxConns:  4,
+		Timeout:   5 * time.Second,
+	}
+	if configure != nil {
+		configure(&cfg)
+	}
+	client, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	c.clients = append(c.clients, client)
+	return client
+}
+
+func (c *fakeCluster) close() {
+	for _, client := range c.clients {
+		client.Close()
+	}
+	c.tracker.close()
+	c.storage.close()
+}
+
+// storagePool returns the pool of client's connections to the cluster's
+// storage.
+func (c *fakeCluster) storagePool(client *FastDFSClient) *ConnectionPool {
+	client.storagePoolLock.Lock()
+	defer client.storagePoolLock.Unlock()
+	return client.storagePools[c.storage.addr()]
+}
+
+// storeBody builds a tracker's answer to a store, fetch or update query.
+func storeBody(groupName string, ipAddr string, port int64, storePathIndex int) []byte {
+	buff := new(bytes.Buffer)
+	buff.Write(padded(groupName, FDFS_GROUP_NAME_MAX_LEN))
+	buff.Write(padded(ipAddr, IP_ADDRESS_SIZE-1))
+	binary.Write(buff, binary.BigEndian, port)
+	if storePathIndex >= 0 {
+		buff.WriteByte(byte(storePathIndex))
+	}
+	return buff.Bytes()
+}
+
+// padded is s cut or zero padded to n bytes, like fixed size protocol fields.
+func padded(s string, n int) []byte {
+	b := make([]byte, n)
+	copy(b, s)
+	return b
+}
@@ -4,8 +4,12 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"net"
+	"sort"
+	"strconv"
+	"time"
 )
 
 const (
@@ -82,6 +86,8 @@ const (
 	STORAGE_PROTO_CMD_TRUNCATE_FILE      = 36 //since V3.08
 	STORAGE_PROTO_CMD_SYNC_TRUNCATE_FILE = 37 //since V3.08
 
+	STORAGE_PROTO_CMD_REGENERATE_APPENDER_FILENAME = 38 //since V6.02
+
 	//for overwrite all old metadata
 	STORAGE_SET_METADATA_FLAG_OVERWRITE     = 'O'
 	STORAGE_SET_METADATA_FLAG_OVERWRITE_STR = "O"
@@ -118,8 +124,10 @@ const (
 	FDFS_UPLOAD_BY_BUFFER   = 1
 	FDFS_UPLOAD_BY_FILENAME = 2
 	FDFS_UPLOAD_BY_FILE     = 3
+	FDFS_UPLOAD_BY_READER   = 4
 	FDFS_DOWNLOAD_TO_BUFFER = 1
 	FDFS_DOWNLOAD_TO_FILE   = 2
+	FDFS_DOWNLOAD_TO_WRITER = 3
 
 	FDFS_NORMAL_LOGIC_FILENAME_LENGTH = (FDFS_LOGIC_FILE_PATH_LEN + FDFS_FILENAME_BASE64_LENGTH + FDFS_FILE_EXT_NAME_MAX_LEN + 1)
 
@@ -188,22 +196,27 @@ func (this *trackerHeader) unmarshal(data []byte) error {
 	return nil
 }
 
-func (this *trackerHeader) sendHeader(conn net.Conn) {
-	buf, _ := this.marshal()
-	conn.Write(buf)
+func (this *trackerHeader) sendHeader(conn net.Conn) error {
+	bp := headerBufPool.Get().(*[]byte)
+	defer headerBufPool.Put(bp)
+	buf := *bp
+	binary.BigEndian.PutUint64(buf, uint64(this.pkgLen))
+	buf[8] = byte(this.cmd)
+	buf[9] = byte(this.status)
+	_, err := conn.Write(buf)
+	return err
 }
 
-func (this *trackerHeader) recvHeader(conn net.Conn) {
-	buf := make([]byte, 10)
+func (this *trackerHeader) recvHeader(conn net.Conn) error {
+	bp := headerBufPool.Get().(*[]byte)
+	defer headerBufPool.Put(bp)
+	buf := *bp
 	_, err := io.ReadFull(conn, buf)
 	if err != nil {
-		return
+		return err
 	}
 
-	err = this.unmarshal(buf)
-	if err != nil {
-		return
-	}
+	return this.unmarshal(buf)
 }
 
 type uploadFileRequest struct {
@@ -218,7 +231,7 @@ func (this *uploadFileRequest) marshal() ([]byte, error) {
 	binary.Write(buffer, binary.BigEndian, this.fileSize)
 
 	// 6 bit fileExtName
-	fileExtNameBytes := bytes.NewBufferString(this.fileExtName).Bytes()
+	fileExtNameBytes := bytes.NewBufferString(truncateUtf8(this.fileExtName, FDFS_FILE_EXT_NAME_MAX_LEN)).Bytes()
 	for i := 0; i < 6; i++ {
 		if i >= len(fileExtNameBytes) {
 			buffer.WriteByte(byte(0))
@@ -245,7 +258,7 @@ func (this *uploadSlaveFileRequest) marshal() ([]byte, error) {
 	binary.Write(buffer, binary.BigEndian, this.fileSize)
 
 	// 16 bit prefixName
-	prefixNameBytes := bytes.NewBufferString(this.prefixName).Bytes()
+	prefixNameBytes := bytes.NewBufferString(truncateUtf8(this.prefixName, FDFS_FILE_PREFIX_MAX_LEN)).Bytes()
 	for i := 0; i < 16; i++ {
 		if i >= len(prefixNameBytes) {
 			buffer.WriteByte(byte(0))
@@ -255,7 +268,7 @@ func (this *uploadSlaveFileRequest) marshal() ([]byte, error) {
 	}
 
 	// 6 bit fileExtName
-	fileExtNameBytes := bytes.NewBufferString(this.fileExtName).Bytes()
+	fileExtNameBytes := bytes.NewBufferString(truncateUtf8(this.fileExtName, FDFS_FILE_EXT_NAME_MAX_LEN)).Bytes()
 	for i := 0; i < 6; i++ {
 		if i >= len(fileExtNameBytes) {
 			buffer.WriteByte(byte(0))
@@ -272,9 +285,20 @@ func (this *uploadSlaveFileRequest) marshal() ([]byte, error) {
 	return buffer.Bytes(), nil
 }
 
+// UploadSize and Duration describe the transfer itself, from sending the
+// request to receiving the file id, without the time spent querying the
+// tracker or waiting for a connection.
 type UploadFileResponse struct {
 	GroupName    string
 	RemoteFileId string
+	UploadSize   int64
+	Duration     time.Duration
+}
+
+// ThroughputBytesPerSec is UploadSize over Duration. Small uploads are
+// dominated by round trips, so only sizable ones give meaningful values.
+func (this *UploadFileResponse) ThroughputBytesPerSec() float64 {
+	return throughput(this.UploadSize, this.Duration)
 }
 
 // recv_fmt: |-group_name(16)-remote_file_name(recv_size - 16)-|
@@ -289,6 +313,12 @@ func (this *UploadFileResponse) unmarshal(data []byte) error {
 	return nil
 }
 
+// fileId returns the id of the uploaded file, group included, as the other
+// methods take it.
+func (this *UploadFileResponse) fileId() string {
+	return this.GroupName + "/" + this.RemoteFileId
+}
+
 type deleteFileRequest struct {
 	groupName      string
 	remoteFilename string
@@ -364,8 +394,331 @@ func (this *downloadFileRequest) marshal() ([]byte, error) {
 	return buffer.Bytes(), nil
 }
 
+// Duration covers the transfer from sending the request to receiving the
+// last byte, like UploadFileResponse's.
 type DownloadFileResponse struct {
 	RemoteFileId string
 	Content      interface{}
 	DownloadSize int64
+	Duration     time.Duration
+}
+
+// ThroughputBytesPerSec is DownloadSize over Duration. Small downloads are
+// dominated by round trips, so only sizable ones give meaningful values.
+func (this *DownloadFileResponse) ThroughputBytesPerSec() float64 {
+	return throughput(this.DownloadSize, this.Duration)
+}
+
+func throughput(size int64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(size) / d.Seconds()
+}
+
+// #group_stat_fmt |-group_name(16+1)-total_mb(8)-free_mb(8)-trunk_free_mb(8)
+// #               -count(8)-storage_port(8)-storage_http_port(8)-active_count(8)
+// #               -current_write_server(8)-store_path_count(8)
+// #               -subdir_count_per_path(8)-current_trunk_file_id(8)-|
+const TRACKER_GROUP_STAT_LEN = FDFS_GROUP_NAME_MAX_LEN + 1 + 11*FDFS_PROTO_PKG_LEN_SIZE
+
+type GroupStat struct {
+	GroupName          string
+	TotalMB            int64
+	FreeMB             int64
+	TrunkFreeMB        int64
+	StorageCount       int64
+	StoragePort        int64
+	StorageHttpPort    int64
+	ActiveCount        int64
+	CurrentWriteServer int64
+	StorePathCount     int64
+	SubdirCountPerPath int64
+	CurrentTrunkFileId int64
+}
+
+func (this *GroupStat) unmarshal(data []byte) error {
+	if len(data) != TRACKER_GROUP_STAT_LEN {
+		return errors.New("group stat length is not match")
+	}
+	buff := bytes.NewBuffer(data)
+	var err error
+	this.GroupName, err = readCstr(buff, FDFS_GROUP_NAME_MAX_LEN+1)
+	if err != nil {
+		return err
+	}
+	for _, v := range []*int64{&this.TotalMB, &this.FreeMB, &this.TrunkFreeMB,
+		&this.StorageCount, &this.StoragePort, &this.StorageHttpPort, &this.ActiveCount,
+		&this.CurrentWriteServer, &this.StorePathCount, &this.SubdirCountPerPath,
+		&this.CurrentTrunkFileId} {
+		if err = binary.Read(buff, binary.BigEndian, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FileInfo is what a storage server reports about one of its files.
+// FileSize is the logical size of the content. For files in trunk storage
+// Trunk tells where they are packed and how much space they take on disk;
+// the storage doesn't report that, it's read from the file name.
+type FileInfo struct {
+	FileSize        int64
+	CreateTimestamp int64
+	Crc32           int64
+	SourceIpAddr    string
+	Trunk           *TrunkInfo
+}
+
+// #query_file_info_resp: |-file_size(8)-create_timestamp(8)-crc32(8)-source_ip_addr(16)-|
+func (this *FileInfo) unmarshal(data []byte) error {
+	if len(data) != 3*FDFS_PROTO_PKG_LEN_SIZE+IP_ADDRESS_SIZE {
+		return fmt.Errorf("query file info response length %d is invalid", len(data))
+	}
+	buff := bytes.NewBuffer(data)
+	binary.Read(buff, binary.BigEndian, &this.FileSize)
+	binary.Read(buff, binary.BigEndian, &this.CreateTimestamp)
+	binary.Read(buff, binary.BigEndian, &this.Crc32)
+	this.SourceIpAddr, _ = readCstr(buff, IP_ADDRESS_SIZE)
+	return nil
+}
+
+// #storage_stat_fmt |-status(1)-id(16)-ip_addr(16)-domain_name(128)-src_id(16)
+// #                 -version(6)-join_time(8)-up_time(8)-total_mb(8)-free_mb(8)
+// #                 -upload_priority(8)-store_path_count(8)-subdir_count_per_path(8)
+// #                 -current_write_path(8)-storage_port(8)-storage_http_port(8)
+// #                 -stat_counters(42*8)-if_trunk_server(1)-|
+// This is the layout of the 4.x and 5.x trackers.
+const TRACKER_STORAGE_STAT_LEN = 1 + 3*FDFS_STORAGE_ID_MAX_SIZE + FDFS_DOMAIN_NAME_MAX_LEN +
+	FDFS_VERSION_SIZE + 10*FDFS_PROTO_PKG_LEN_SIZE + 42*FDFS_PROTO_PKG_LEN_SIZE + 1
+
+const FDFS_STORAGE_ID_MAX_SIZE = 16
+
+// StorageStat is a tracker's view of one storage server. Timestamps are unix
+// seconds as reported by the storage, zero when the event never happened.
+type StorageStat struct {
+	Status             int
+	Id                 string
+	IpAddr             string
+	DomainName         string
+	SrcId              string
+	Version            string
+	JoinTime           int64
+	UpTime             int64
+	TotalMB            int64
+	FreeMB             int64
+	UploadPriority     int64
+	StorePathCount     int64
+	SubdirCountPerPath int64
+	CurrentWritePath   int64
+	StoragePort        int64
+	StorageHttpPort    int64
+
+	SuccessUploadCount   int64
+	SuccessDownloadCount int64
+	SuccessDeleteCount   int64
+
+	// LastSourceUpdate is when a client last uploaded to or changed a file
+	// on this storage, LastSyncUpdate when it last received a file from
+	// another storage, and LastSyncedTimestamp the source timestamp up to
+	// which it holds the files of every other storage in its group.
+	LastSourceUpdate    int64
+	LastSyncUpdate      int64
+	LastSyncedTimestamp int64
+	LastHeartBeatTime   int64
+	IsTrunkServer       bool
+}
+
+// HttpAddr is the host:port the storage's HTTP server listens on, for
+// building download URLs. Nodes of a group may use different ports.
+func (this *StorageStat) HttpAddr() string {
+	return net.JoinHostPort(this.IpAddr, strconv.FormatInt(this.StorageHttpPort, 10))
+}
+
+var storageStatusNames = map[int]string{
+	FDFS_STORAGE_STATUS_INIT:       "INIT",
+	FDFS_STORAGE_STATUS_WAIT_SYNC:  "WAIT_SYNC",
+	FDFS_STORAGE_STATUS_SYNCING:    "SYNCING",
+	FDFS_STORAGE_STATUS_IP_CHANGED: "IP_CHANGED",
+	FDFS_STORAGE_STATUS_DELETED:    "DELETED",
+	FDFS_STORAGE_STATUS_OFFLINE:    "OFFLINE",
+	FDFS_STORAGE_STATUS_ONLINE:     "ONLINE",
+	FDFS_STORAGE_STATUS_ACTIVE:     "ACTIVE",
+	FDFS_STORAGE_STATUS_RECOVERY:   "RECOVERY",
+	FDFS_STORAGE_STATUS_NONE:       "NONE",
+}
+
+// StatusName is Status as the name of its FDFS_STORAGE_STATUS_ constant,
+// like "ACTIVE" or "OFFLINE", as fdfs_monitor prints it.
+func (this *StorageStat) StatusName() string {
+	if name, ok := storageStatusNames[this.Status]; ok {
+		return name
+	}
+	return "UNKNOWN(" + strconv.Itoa(this.Status) + ")"
+}
+
+// indexes into the stat counters that StorageStat keeps
+const (
+	storageStatSuccessUpload       = 1
+	storageStatSuccessDelete       = 11
+	storageStatSuccessDownload     = 13
+	storageStatLastSourceUpdate    = 38
+	storageStatLastSyncUpdate      = 39
+	storageStatLastSyncedTimestamp = 40
+	storageStatLastHeartBeatTime   = 41
+)
+
+func (this *StorageStat) unmarshal(data []byte) error {
+	if len(data) != TRACKER_STORAGE_STAT_LEN {
+		return errors.New("storage stat length is not match")
+	}
+	buff := bytes.NewBuffer(data)
+	status, _ := buff.ReadByte()
+	this.Status = int(status)
+	for _, v := range []struct {
+		s *string
+		n int
+	}{{&this.Id, FDFS_STORAGE_ID_MAX_SIZE}, {&this.IpAddr, IP_ADDRESS_SIZE},
+		{&this.DomainName, FDFS_DOMAIN_NAME_MAX_LEN}, {&this.SrcId, FDFS_STORAGE_ID_MAX_SIZE},
+		{&this.Version, FDFS_VERSION_SIZE}} {
+		var err error
+		if *v.s, err = readCstr(buff, v.n); err != nil {
+			return err
+		}
+	}
+
+	for _, v := range []*int64{&this.JoinTime, &this.UpTime, &this.TotalMB, &this.FreeMB,
+		&this.UploadPriority, &this.StorePathCount, &this.SubdirCountPerPath,
+		&this.CurrentWritePath, &this.StoragePort, &this.StorageHttpPort} {
+		if err := binary.Read(buff, binary.BigEndian, v); err != nil {
+			return err
+		}
+	}
+
+	var counters [42]int64
+	if err := binary.Read(buff, binary.BigEndian, &counters); err != nil {
+		return err
+	}
+	this.SuccessUploadCount = counters[storageStatSuccessUpload]
+	this.SuccessDeleteCount = counters[storageStatSuccessDelete]
+	this.SuccessDownloadCount = counters[storageStatSuccessDownload]
+	this.LastSourceUpdate = counters[storageStatLastSourceUpdate]
+	this.LastSyncUpdate = counters[storageStatLastSyncUpdate]
+	this.LastSyncedTimestamp = counters[storageStatLastSyncedTimestamp]
+	this.LastHeartBeatTime = counters[storageStatLastHeartBeatTime]
+
+	trunk, _ := buff.ReadByte()
+	this.IsTrunkServer = trunk != 0
+	return nil
+}
+
+type truncateFileRequest struct {
+	appenderFilename  string
+	truncatedFileSize int64
+}
+
+// #truncate_fmt: |-appender_filename_len(8)-truncated_file_size(8)-appender_filename(len)-|
+func (this *truncateFileRequest) marshal() ([]byte, error) {
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.BigEndian, int64(len(this.appenderFilename)))
+	binary.Write(buffer, binary.BigEndian, this.truncatedFileSize)
+	buffer.WriteString(this.appenderFilename)
+	return buffer.Bytes(), nil
+}
+
+type appendFileRequest struct {
+	appenderFilename string
+	fileSize         int64
+}
+
+// #append_fmt: |-appender_filename_len(8)-file_size(8)-appender_filename(len)-|
+// followed by file_size bytes of content
+func (this *appendFileRequest) marshal() ([]byte, error) {
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.BigEndian, int64(len(this.appenderFilename)))
+	binary.Write(buffer, binary.BigEndian, this.fileSize)
+	buffer.WriteString(this.appenderFilename)
+	return buffer.Bytes(), nil
+}
+
+type modifyFileRequest struct {
+	appenderFilename string
+	fileOffset       int64
+	fileSize         int64
+}
+
+// #modify_fmt: |-appender_filename_len(8)-file_offset(8)-modify_size(8)-appender_filename(len)-|
+// followed by modify_size bytes of content
+func (this *modifyFileRequest) marshal() ([]byte, error) {
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.BigEndian, int64(len(this.appenderFilename)))
+	binary.Write(buffer, binary.BigEndian, this.fileOffset)
+	binary.Write(buffer, binary.BigEndian, this.fileSize)
+	buffer.WriteString(this.appenderFilename)
+	return buffer.Bytes(), nil
+}
+
+// marshalMetadata encodes meta as name\x02value records separated by \x01,
+// with names and values cut to the lengths the server accepts.
+func marshalMetadata(meta map[string]string) []byte {
+	names := make([]string, 0, len(meta))
+	for name := range meta {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buffer := new(bytes.Buffer)
+	for i, name := range names {
+		if i > 0 {
+			buffer.WriteByte(FDFS_RECORD_SEPERATOR)
+		}
+		buffer.WriteString(truncateUtf8(name, FDFS_MAX_META_NAME_LEN))
+		buffer.WriteByte(FDFS_FIELD_SEPERATOR)
+		buffer.WriteString(truncateUtf8(meta[name], FDFS_MAX_META_VALUE_LEN))
+	}
+	return buffer.Bytes()
+}
+
+func unmarshalMetadata(data []byte) map[string]string {
+	meta := make(map[string]string)
+	if len(data) == 0 {
+		return meta
+	}
+	for _, record := range bytes.Split(data, []byte{FDFS_RECORD_SEPERATOR}) {
+		fields := bytes.SplitN(record, []byte{FDFS_FIELD_SEPERATOR}, 2)
+		if len(fields) == 2 {
+			meta[string(fields[0])] = string(fields[1])
+		}
+	}
+	return meta
+}
+
+type setMetadataRequest struct {
+	groupName      string
+	remoteFilename string
+	meta           []byte
+	flag           byte
+}
+
+// #set_meta_fmt: |-filename_len(8)-meta_size(8)-op_flag(1)-group_name(16)
+// #               -filename(filename_len)-meta(meta_size)-|
+func (this *setMetadataRequest) marshal() ([]byte, error) {
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.BigEndian, int64(len(this.remoteFilename)))
+	binary.Write(buffer, binary.BigEndian, int64(len(this.meta)))
+	buffer.WriteByte(this.flag)
+
+	// 16 bit groupName
+	groupNameBytes := bytes.NewBufferString(this.groupName).Bytes()
+	for i := 0; i < 16; i++ {
+		if i >= len(groupNameBytes) {
+			buffer.WriteByte(byte(0))
+		} else {
+			buffer.WriteByte(groupNameBytes[i])
+		}
+	}
+
+	buffer.WriteString(this.remoteFilename)
+	buffer.Write(this.meta)
+	return buffer.Bytes(), nil
 }
@@ -0,0 +1,59 @@
+package fastdfs
+
+import (
+	"bytes"
+	"testing"
+	"unicode/utf8"
+)
+
+// cstr is the string in a zero padded protocol field.
+func cstr(field []byte) string {
+	if i := bytes.IndexByte(field, 0); i >= 0 {
+		field = field[:i]
+	}
+	return string(field)
+}
+
+func TestUploadRequestMultibyteFields(t *testing.T) {
+	req := &uploadFileRequest{fileSize: 1, fileExtName: "a图片"}
+	buff, _ := req.marshal()
+	if ext := cstr(buff[9:15]); ext != "a图" {
+		t.Errorf("upload ext field = %q, want %q", ext, "a图")
+	}
+
+	slave := &uploadSlaveFileRequest{prefixName: "缩略图_小尺寸_", fileExtName: "图片", masterFilename: "M00"}
+	slave.masterFilenameLen = int64(len(slave.masterFilename))
+	buff, _ = slave.marshal()
+	for _, field := range []string{cstr(buff[16:32]), cstr(buff[32:38])} {
+		if !utf8.ValidString(field) {
+			t.Errorf("slave request field %q is not valid UTF-8", field)
+		}
+	}
+	if prefix := cstr(buff[16:32]); prefix != "缩略图_小尺" {
+		t.Errorf("slave prefix field = %q, want %q", prefix, "缩略图_小尺")
+	}
+}
+
+func TestMultibyteMetadataRoundTrip(t *testing.T) {
+	c := newFakeCluster(t)
+	defer c.close()
+	client := c.client(t, nil)
+
+	ur, err := client.UploadByBuffer([]byte("content"), "txt")
+	if err != nil {
+		t.Fatalf("UploadByBuffer() error = %v", err)
+	}
+	meta := map[string]string{"filename": "年度报告 2020.pdf", "作者": "张三"}
+	if err := client.SetMetadata(ur.fileId(), meta, STORAGE_SET_METADATA_FLAG_OVERWRITE); err != nil {
+		t.Fatalf("SetMetadata() error = %v", err)
+	}
+	got, err := client.GetMetadata(ur.fileId())
+	if err != nil {
+		t.Fatalf("GetMetadata() error = %v", err)
+	}
+	for name, value := range meta {
+		if got[name] != value {
+			t.Errorf("GetMetadata()[%q] = %q, want %q", name, got[name], value)
+		}
+	}
+}
@@ -0,0 +1,320 @@
+package fastdfs
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidFileId = errors.New("invalid file id")
+
+const (
+	FDFS_APPENDER_FILE_SIZE   = int64(1) << 58 // INFINITE_FILE_SIZE
+	FDFS_TRUNK_FILE_MARK_SIZE = int64(1) << 59
+)
+
+// fdfsBase64 is the alphabet FastDFS uses to encode file names.
+var fdfsBase64 = base64.RawURLEncoding
+
+// FileIdMeta holds the fields FastDFS encodes into every generated file name.
+// StorePathIndex is the "Mxx" store path the file was written to.
+// FileSize is -1 for appender files, whose size changes after creation.
+// For slave files the fields are those of the master file, whose name the
+// slave's name is derived from.
+type FileIdMeta struct {
+	GroupName       string
+	StorePathIndex  int
+	SourceIpAddr    string
+	CreateTimestamp int64
+	FileSize        int64
+	Crc32           int64
+	IsAppender      bool
+	IsTrunk         bool
+	IsSlave         bool
+	// Trunk is set for files stored in a trunk file
+	Trunk *TrunkInfo
+}
+
+// TrunkInfo locates a small file that trunk storage packed into a larger
+// trunk file, as encoded in its file name. AllocSize is the size of the
+// slot reserved for it, which includes a slot header and rounding, so it
+// is what the file takes on disk, while FileSize elsewhere is the logical
+// size of the content.
+type TrunkInfo struct {
+	TrunkId   int64
+	Offset    int64
+	AllocSize int64
+}
+
+// decodeTrunkInfo parses the |-trunk_id(4)-offset(4)-alloc_size(4)-| the
+// storage appends, base64 encoded, to the name of a trunk stored file.
+func decodeTrunkInfo(remoteFilename string) (*TrunkInfo, bool) {
+	start := FDFS_LOGIC_FILE_PATH_LEN + FDFS_FILENAME_BASE64_LENGTH
+	if len(remoteFilename) < start+FDFS_TRUNK_FILE_INFO_LEN {
+		return nil, false
+	}
+	buff, err := fdfsBase64.DecodeString(remoteFilename[start : start+FDFS_TRUNK_FILE_INFO_LEN])
+	if err != nil || len(buff) < 12 {
+		return nil, false
+	}
+	return &TrunkInfo{
+		TrunkId:   int64(binary.BigEndian.Uint32(buff[0:4])),
+		Offset:    int64(binary.BigEndian.Uint32(buff[4:8])),
+		AllocSize: int64(binary.BigEndian.Uint32(buff[8:12])),
+	}, true
+}
+
+// DecodeFileIdMeta parses the metadata embedded in remoteFileId without any
+// network round trip.
+func DecodeFileIdMeta(remoteFileId string) (FileIdMeta, error) {
+	var meta FileIdMeta
+
+	groupName, remoteFilename, err := ParseFileId(remoteFileId)
+	if err != nil {
+		return meta, err
+	}
+
+	encoded := remoteFilename[FDFS_LOGIC_FILE_PATH_LEN : FDFS_LOGIC_FILE_PATH_LEN+FDFS_FILENAME_BASE64_LENGTH]
+	buff, err := fdfsBase64.DecodeString(encoded)
+	if err != nil || len(buff) < 20 {
+		return meta, ErrInvalidFileId
+	}
+
+	// |-ip(4)-create_timestamp(4)-file_size(8)-crc32(4)-|
+	fileSize := int64(binary.BigEndian.Uint64(buff[8:16]))
+	storePathIndex, _ := strconv.ParseUint(remoteFilename[1:3], 16, 8)
+	meta.GroupName = groupName
+	meta.StorePathIndex = int(storePathIndex)
+	meta.SourceIpAddr = net.IP(buff[0:4]).String()
+	meta.CreateTimestamp = int64(binary.BigEndian.Uint32(buff[4:8]))
+	meta.Crc32 = int64(binary.BigEndian.Uint32(buff[16:20]))
+	meta.IsAppender = fileSize&FDFS_APPENDER_FILE_SIZE != 0
+	meta.IsTrunk = fileSize&FDFS_TRUNK_FILE_MARK_SIZE != 0
+	if meta.IsTrunk {
+		meta.Trunk, _ = decodeTrunkInfo(remoteFilename)
+	}
+
+	filenameLen := len(remoteFilename)
+	meta.IsSlave = filenameLen > FDFS_TRUNK_LOGIC_FILENAME_LENGTH ||
+		(filenameLen > FDFS_NORMAL_LOGIC_FILENAME_LENGTH && !meta.IsTrunk)
+
+	switch {
+	case meta.IsAppender:
+		meta.FileSize = -1
+	case uint64(fileSize)>>63 != 0:
+		// low 32 bits are the size, the high ones are random
+		meta.FileSize = fileSize & 0xFFFFFFFF
+	case meta.IsTrunk:
+		meta.FileSize = fileSize & 0xFFFFFFFF
+	default:
+		meta.FileSize = fileSize
+	}
+	return meta, nil
+}
+
+// FileIdError reports a malformed file id. It matches ErrInvalidFileId
+// with errors.Is.
+type FileIdError struct {
+	RemoteFileId string
+	Reason       string
+}
+
+func (e *FileIdError) Error() string {
+	return fmt.Sprintf("invalid file id %q: %s", e.RemoteFileId, e.Reason)
+}
+
+func (e *FileIdError) Unwrap() error {
+	return ErrInvalidFileId
+}
+
+// ParseFileId splits remoteFileId into its group name and the file name
+// within the group, like "group1" and "M00/00/00/wKgAAV...jpg", checking
+// that both are well-formed: a group name of letters, digits, '_', '-' or
+// '.', up to FDFS_GROUP_NAME_MAX_LEN long, and a file name starting with
+// the "Mxx/xx/xx/" store path and the encoded name storages generate.
+// Otherwise it fails with a *FileIdError.
+func ParseFileId(remoteFileId string) (groupName string, remoteFilename string, err error) {
+	parts := strings.SplitN(remoteFileId, "/", 2)
+	if len(parts) < 2 {
+		return "", "", &FileIdError{remoteFileId, "no group name"}
+	}
+	groupName, remoteFilename = parts[0], parts[1]
+	if !isGroupName(groupName) {
+		return "", "", &FileIdError{remoteFileId, "malformed group name"}
+	}
+	if !isLogicFilename(remoteFilename) {
+		return "", "", &FileIdError{remoteFileId, "malformed file name"}
+	}
+	return groupName, remoteFilename, nil
+}
+
+func isGroupName(groupName string) bool {
+	if groupName == "" || len(groupName) > FDFS_GROUP_NAME_MAX_LEN {
+		return false
+	}
+	for _, c := range groupName {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("_-.", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// isLogicFilename checks for the "Mxx/xx/xx/" store path prefix followed by
+// the base64 encoded file name.
+func isLogicFilename(remoteFilename string) bool {
+	if len(remoteFilename) < FDFS_LOGIC_FILE_PATH_LEN+FDFS_FILENAME_BASE64_LENGTH {
+		return false
+	}
+	if remoteFilename[0] != 'M' {
+		return false
+	}
+	for i, c := range remoteFilename[1:FDFS_LOGIC_FILE_PATH_LEN] {
+		if i%3 == 2 {
+			if c != '/' {
+				return false
+			}
+		} else if !strings.ContainsRune("0123456789ABCDEFabcdef", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// FileIdMismatchError reports a file id whose embedded size or crc32
+// disagrees with the content the storage serves for it.
+type FileIdMismatchError struct {
+	RemoteFileId string
+	Field        string
+	InId         interface{}
+	OnStorage    interface{}
+}
+
+func (e *FileIdMismatchError) Error() string {
+	return fmt.Sprintf("file id %s: %s is %v in the id but %v on the storage",
+		e.RemoteFileId, e.Field, e.InId, e.OnStorage)
+}
+
+// VerifyFileId checks that remoteFileId names a file that exists and whose
+// content has the size and crc32 encoded in the id, to reject fabricated
+// or tampered ids before serving them. Storages answer file info queries
+// from the id itself, so the content is downloaded and checked, streaming
+// it without holding it in memory. Appender files change after creation
+// and slave ids carry their master's size and crc32, so for them only the
+// existence of the file is checked.
+func (this *FastDFSClient) VerifyFileId(remoteFileId string) error {
+	meta, err := DecodeFileIdMeta(remoteFileId)
+	if err != nil {
+		return err
+	}
+	if meta.IsAppender || meta.IsSlave {
+		_, err = this.QueryFileInfo(remoteFileId)
+		return err
+	}
+
+	sum := crc32.NewIEEE()
+	n, err := this.DownloadToWriter(sum, remoteFileId, 0, 0)
+	if err != nil {
+		return err
+	}
+	if n != meta.FileSize {
+		return &FileIdMismatchError{remoteFileId, "size", meta.FileSize, n}
+	}
+	if crc := sum.Sum32(); crc != uint32(meta.Crc32) {
+		return &FileIdMismatchError{remoteFileId, "crc32", uint32(meta.Crc32), crc}
+	}
+	return nil
+}
+
+var ErrNotSlaveFile = errors.New("not a slave file id")
+
+// MasterOf returns the id of the master file slaveRemoteFileId was uploaded
+// for. Storages don't record that relationship, so it's derived from the
+// naming convention: a slave's name is its master's without the extension,
+// followed by the slave's prefix and extension. The master's own extension
+// is lost that way, so MasterOf tries the slave's extension first, the
+// usual case for thumbnails, then no extension, and returns the first that
+// exists on the storage, or ENOENT.
+func (this *FastDFSClient) MasterOf(slaveRemoteFileId string) (string, error) {
+	if err := this.acquireOp(context.Background()); err != nil {
+		return "", err
+	}
+	defer this.releaseOp()
+
+	tmp, err := this.splitRemoteFileId(slaveRemoteFileId)
+	if err != nil {
+		return "", err
+	}
+	meta, err := DecodeFileIdMeta(slaveRemoteFileId)
+	if err != nil {
+		return "", err
+	}
+	if !meta.IsSlave {
+		return "", ErrNotSlaveFile
+	}
+
+	groupName, slaveFilename := tmp[0], tmp[1]
+	baseLen := FDFS_LOGIC_FILE_PATH_LEN + FDFS_FILENAME_BASE64_LENGTH
+	if meta.IsTrunk {
+		baseLen += FDFS_TRUNK_FILE_INFO_LEN
+	}
+	base := slaveFilename[:baseLen]
+	candidates := []string{base}
+	if ext := path.Ext(slaveFilename[baseLen:]); ext != "" {
+		candidates = []string{base + ext, base}
+	}
+
+	tc := this.trackerClient()
+	for _, masterFilename := range candidates {
+		storeServ, err := tc.trackerQueryStorageUpdate(groupName, masterFilename)
+		if err != nil {
+			return "", err
+		}
+		storagePool, err := this.getStoragePool(storeServ.ipAddr)
+		if err != nil {
+			return "", err
+		}
+		_, err = this.storageClient(storagePool).storageQueryFileInfo(context.Background(), tc, storeServ, masterFilename)
+		if err == nil {
+			return groupName + "/" + masterFilename, nil
+		}
+		var errno Errno
+		if !errors.As(err, &errno) || errno.status != enoent {
+			return "", err
+		}
+	}
+	return "", Errno{enoent}
+}
+
+// BuildSlaveFileId returns the id the storage gives the slave file
+// uploaded for masterFileId with prefixName and fileExtName, like
+// fdfs_gen_slave_filename: the master's name without its extension,
+// followed by the prefix and the extension. As on the storage, an empty
+// fileExtName means the slave file has no extension.
+func BuildSlaveFileId(masterFileId string, prefixName string, fileExtName string) (string, error) {
+	groupName, masterFilename, err := ParseFileId(masterFileId)
+	if err != nil {
+		return "", err
+	}
+	if prefixName == "" || len(prefixName) > FDFS_FILE_PREFIX_MAX_LEN {
+		return "", fmt.Errorf("invalid slave prefix name %q", prefixName)
+	}
+
+	base := masterFilename
+	baseLen := FDFS_LOGIC_FILE_PATH_LEN + FDFS_FILENAME_BASE64_LENGTH
+	if dot := strings.IndexByte(masterFilename[baseLen:], '.'); dot >= 0 {
+		base = masterFilename[:baseLen+dot]
+	}
+	ext := ""
+	if fileExtName != "" {
+		ext = "." + strings.TrimPrefix(fileExtName, ".")
+	}
+	return groupName + "/" + base + prefixName + ext, nil
+}
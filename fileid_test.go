@@ -0,0 +1,104 @@
+package fastdfs
+
+import (
+	"errors"
+	"testing"
+)
+
+const testMasterFileId = "group1/M00/00/00/wKgAAV7gKXuAQrDTAAAAB1Z4YlU123.jpg"
+
+func TestSlaveFileRoundTrip(t *testing.T) {
+	c := newFakeCluster(t)
+	defer c.close()
+	client := c.client(t, nil)
+	masterId := mustUpload(t, client.UploadByBuffer, "master")
+
+	for _, ext := range []string{"png", ""} {
+		ur, err := client.UploadSlaveByBuffer([]byte("slave "+ext), masterId, "_150x150", ext)
+		if err != nil {
+			t.Fatalf("UploadSlaveByBuffer(%q) error = %v", ext, err)
+		}
+		slaveId, err := BuildSlaveFileId(masterId, "_150x150", ext)
+		if err != nil || slaveId != ur.fileId() {
+			t.Errorf("BuildSlaveFileId(%q) = %q, %v, want the uploaded %q", ext, slaveId, err, ur.fileId())
+		}
+		dr, err := client.DownloadSlaveToBuffer(masterId, "_150x150", ext, 0, 0)
+		if err != nil {
+			t.Fatalf("DownloadSlaveToBuffer(%q) error = %v", ext, err)
+		}
+		if got := string(dr.Content.([]byte)); got != "slave "+ext {
+			t.Errorf("DownloadSlaveToBuffer(%q) = %q, want %q", ext, got, "slave "+ext)
+		}
+	}
+}
+
+func TestBuildSlaveFileId(t *testing.T) {
+	tests := []struct {
+		name        string
+		masterId    string
+		prefix      string
+		ext         string
+		want        string
+		wantInvalid bool
+	}{
+		{"ext", testMasterFileId, "_150x150", "jpg", "group1/M00/00/00/wKgAAV7gKXuAQrDTAAAAB1Z4YlU123_150x150.jpg", false},
+		{"dotted ext", testMasterFileId, "_150x150", ".png", "group1/M00/00/00/wKgAAV7gKXuAQrDTAAAAB1Z4YlU123_150x150.png", false},
+		{"empty ext", testMasterFileId, "_150x150", "", "group1/M00/00/00/wKgAAV7gKXuAQrDTAAAAB1Z4YlU123_150x150", false},
+		{"master without ext", "group1/M00/00/00/wKgAAV7gKXuAQrDTAAAAB1Z4YlU123", "-s", "jpg", "group1/M00/00/00/wKgAAV7gKXuAQrDTAAAAB1Z4YlU123-s.jpg", false},
+		{"empty prefix", testMasterFileId, "", "jpg", "", false},
+		{"long prefix", testMasterFileId, "_12345678901234567", "jpg", "", false},
+		{"bad master", "M00/00/00/wKgAAV7gKXuAQrDTAAAAB1Z4YlU123.jpg", "_s", "jpg", "", true},
+	}
+	for _, tt := range tests {
+		got, err := BuildSlaveFileId(tt.masterId, tt.prefix, tt.ext)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%s: BuildSlaveFileId = %q, want an error", tt.name, got)
+			} else if errors.Is(err, ErrInvalidFileId) != tt.wantInvalid {
+				t.Errorf("%s: error %v, ErrInvalidFileId expected %v", tt.name, err, tt.wantInvalid)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: BuildSlaveFileId = %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestVerifyFileId(t *testing.T) {
+	c := newFakeCluster(t)
+	defer c.close()
+	client := c.client(t, nil)
+
+	ur, err := client.UploadByBuffer([]byte("content"), "txt")
+	if err != nil {
+		t.Fatalf("UploadByBuffer() error = %v", err)
+	}
+	if err := client.VerifyFileId(ur.fileId()); err != nil {
+		t.Fatalf("VerifyFileId() of an untouched file error = %v", err)
+	}
+	appenderId := mustUpload(t, client.UploadAppenderByBuffer, "head")
+	if err := client.AppendByBuffer(appenderId, []byte(" and more")); err != nil {
+		t.Fatalf("AppendByBuffer() error = %v", err)
+	}
+	if err := client.VerifyFileId(appenderId); err != nil {
+		t.Errorf("VerifyFileId() of a grown appender file error = %v", err)
+	}
+
+	// the storage serves other content, of the same size, under the id
+	c.storage.filesLock.Lock()
+	c.storage.files[ur.RemoteFileId].content = []byte("CONTENT")
+	c.storage.filesLock.Unlock()
+	var mismatch *FileIdMismatchError
+	if err := client.VerifyFileId(ur.fileId()); !errors.As(err, &mismatch) || mismatch.Field != "crc32" {
+		t.Errorf("VerifyFileId() of changed content error = %v, want a crc32 mismatch", err)
+	}
+
+	if err := client.DeleteFile(ur.fileId()); err != nil {
+		t.Fatalf("DeleteFile() error = %v", err)
+	}
+	var errno Errno
+	if err := client.VerifyFileId(ur.fileId()); !errors.As(err, &errno) || errno.status != enoent {
+		t.Errorf("VerifyFileId() of a deleted file error = %v, want ENOENT", err)
+	}
+}
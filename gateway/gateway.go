@@ -0,0 +1,167 @@
+// Package gateway exposes a FastDFSClient as a small REST service:
+//
+//	POST   /[name.ext]   upload the request body, responds with the file id
+//	GET    /<file id>    stream the file, gzip encoded if Gzip is set
+//	DELETE /<file id>    delete the file
+//
+// It lives in its own package so the client library itself doesn't depend
+// on net/http.
+package gateway
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+
+	fastdfs "github.com/agostop/go-fastdfs"
+)
+
+type Handler struct {
+	// Client is shared by all requests.
+	Client *fastdfs.FastDFSClient
+	// Prefix is stripped from the request path before it is used as file id.
+	Prefix string
+	// Gzip compresses downloads of text-like content on the fly for clients
+	// that accept gzip encoding.
+	Gzip bool
+}
+
+func New(client *fastdfs.FastDFSClient) *Handler {
+	return &Handler{Client: client}
+}
+
+func (this *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	remoteFileId := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, this.Prefix), "/")
+
+	switch r.Method {
+	case http.MethodPost, http.MethodPut:
+		this.upload(w, r, remoteFileId)
+	case http.MethodGet, http.MethodHead:
+		this.download(w, r, remoteFileId)
+	case http.MethodDelete:
+		this.delete(w, r, remoteFileId)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST, PUT, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// upload takes the file extension from the "ext" query parameter, or else
+// from the name in the request path.
+func (this *Handler) upload(w http.ResponseWriter, r *http.Request, name string) {
+	fileExtName := r.URL.Query().Get("ext")
+	if fileExtName == "" {
+		fileExtName = strings.TrimPrefix(path.Ext(name), ".")
+	}
+
+	fileBuffer, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ur, err := this.Client.UploadByBuffer(fileBuffer, fileExtName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(ur.GroupName + "/" + ur.RemoteFileId))
+}
+
+func (this *Handler) download(w http.ResponseWriter, r *http.Request, remoteFileId string) {
+	if remoteFileId == "" {
+		http.Error(w, "missing file id", http.StatusBadRequest)
+		return
+	}
+	contentType := fastdfs.ContentTypeForFileId(remoteFileId)
+	w.Header().Set("Content-Type", contentType)
+	useGzip := false
+	if this.Gzip && compressible(contentType) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if acceptsGzip(r) {
+			w.Header().Set("Content-Encoding", "gzip")
+			useGzip = true
+		}
+	}
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	rw := &responseWriter{ResponseWriter: w}
+	var err error
+	if useGzip {
+		gz := gzip.NewWriter(rw)
+		if err = this.Client.DownloadTransform(remoteFileId, nil, gz); err == nil {
+			err = gz.Close()
+		}
+	} else {
+		err = this.Client.DownloadTransform(remoteFileId, nil, rw)
+	}
+	if err != nil && !rw.wroteHeader {
+		w.Header().Del("Content-Encoding")
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	}
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		enc = strings.TrimSpace(enc)
+		if enc == "gzip" || strings.HasPrefix(enc, "gzip;") && !strings.HasSuffix(enc, "q=0") {
+			return true
+		}
+	}
+	return false
+}
+
+// compressible tells text-like content, which gzip shrinks, from media and
+// archives, which are compressed already.
+func compressible(contentType string) bool {
+	if i := strings.IndexByte(contentType, ';'); i >= 0 {
+		contentType = contentType[:i]
+	}
+	switch {
+	case strings.HasPrefix(contentType, "text/"):
+		return true
+	case strings.HasSuffix(contentType, "+json"), strings.HasSuffix(contentType, "+xml"):
+		return true
+	}
+	switch contentType {
+	case "application/json", "application/javascript", "application/xml", "application/wasm":
+		return true
+	}
+	return false
+}
+
+func (this *Handler) delete(w http.ResponseWriter, r *http.Request, remoteFileId string) {
+	if remoteFileId == "" {
+		http.Error(w, "missing file id", http.StatusBadRequest)
+		return
+	}
+	if err := this.Client.DeleteFile(remoteFileId); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// responseWriter remembers whether the response has started, after which
+// a failure can no longer be turned into an error status.
+type responseWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (this *responseWriter) WriteHeader(code int) {
+	this.wroteHeader = true
+	this.ResponseWriter.WriteHeader(code)
+}
+
+func (this *responseWriter) Write(p []byte) (int, error) {
+	this.wroteHeader = true
+	return this.ResponseWriter.Write(p)
+}
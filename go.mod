@@ -1,3 +1,5 @@
 module github.com/agostop/go-fastdfs
 
-go 1.12
+go 1.13
+
+require golang.org/x/net v0.0.0-20210226172049-e18ecbb05110
@@ -0,0 +1,98 @@
+package fastdfs
+
+import (
+	"context"
+	"time"
+)
+
+// healthLoop pings every tracker endpoint each interval and makes the
+// pool avoid the ones that don't answer, until they answer again.
+func (this *FastDFSClient) healthLoop(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		down := make(map[string]bool)
+		for _, endpoint := range this.pool.endpoints {
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			err := this.pingEndpoint(ctx, endpoint)
+			cancel()
+			if err != nil {
+				down[endpoint] = true
+			}
+		}
+		this.setEndpointsDown(down)
+	}
+}
+
+func (this *FastDFSClient) setEndpointsDown(down map[string]bool) {
+	this.healthLock.Lock()
+	defer this.healthLock.Unlock()
+
+	for endpoint := range down {
+		if !this.endpointsDown[endpoint] {
+			this.log.Warnf("tracker %s is down", endpoint)
+		}
+	}
+	for endpoint := range this.endpointsDown {
+		if !down[endpoint] {
+			this.log.Infof("tracker %s is up again", endpoint)
+		}
+	}
+	this.endpointsDown = down
+	this.pool.setDown(down)
+}
+
+// EndpointStatus reports for every tracker endpoint whether the last health
+// check reached it. Without HealthCheckInterval all endpoints are reported
+// up.
+func (this *FastDFSClient) EndpointStatus() map[string]bool {
+	this.healthLock.Lock()
+	defer this.healthLock.Unlock()
+
+	status := make(map[string]bool, len(this.pool.endpoints))
+	for _, endpoint := range this.pool.endpoints {
+		status[endpoint] = !this.endpointsDown[endpoint]
+	}
+	return status
+}
+
+// Ping checks that a tracker answers, by sending ACTIVE_TEST over a pooled
+// tracker connection, e.g. for a readiness probe. A connection that fails
+// the test is closed instead of pooled again.
+func (this *FastDFSClient) Ping() error {
+	return this.PingContext(context.Background())
+}
+
+// PingContext is Ping bound to ctx.
+func (this *FastDFSClient) PingContext(ctx context.Context) error {
+	return this.trackerClientContext(ctx).trackerActiveTest()
+}
+
+// Close stops the client's background work and closes its tracker and
+// storage pools right away, failing operations still in flight; Drain waits
+// for them. Other clients are not affected. Storage operations fail with
+// ErrClosed afterwards.
+func (this *FastDFSClient) Close() {
+	this.closeOnce.Do(func() {
+		if this.stopHealth != nil {
+			close(this.stopHealth)
+		}
+		if this.ownsPool {
+			this.pool.Close()
+		}
+
+		this.storagePoolLock.Lock()
+		storagePools := this.storagePools
+		this.storagePools = nil
+		this.storagePoolLock.Unlock()
+		for _, sp := range storagePools {
+			sp.Close()
+		}
+	})
+}
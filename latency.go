@@ -0,0 +1,64 @@
+package fastdfs
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	latencyAlpha = 0.3
+	// latencyTTL is how long a measurement stays relevant; older ones no
+	// longer say anything about a node and are ignored.
+	latencyTTL = time.Minute
+)
+
+// latencyTracker keeps an exponentially weighted moving average of the
+// response latency of each storage node.
+type latencyTracker struct {
+	lock    sync.Mutex
+	samples map[string]*latencySample
+}
+
+type latencySample struct {
+	ewma float64
+	at   time.Time
+}
+
+func newLatencyTracker() *latencyTracker {
+	return &latencyTracker{samples: make(map[string]*latencySample)}
+}
+
+func (this *latencyTracker) record(addr string, d time.Duration) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	sample, ok := this.samples[addr]
+	if !ok || time.Since(sample.at) > latencyTTL {
+		this.samples[addr] = &latencySample{float64(d), time.Now()}
+		return
+	}
+	sample.ewma = latencyAlpha*float64(d) + (1-latencyAlpha)*sample.ewma
+	sample.at = time.Now()
+}
+
+// fastest returns the candidate with the lowest recent latency, or false if
+// none of them has a recent measurement.
+func (this *latencyTracker) fastest(candidates []*StorageServer) (*StorageServer, bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	var (
+		best     *StorageServer
+		bestEwma float64
+	)
+	for _, storeServ := range candidates {
+		sample, ok := this.samples[storeServ.ipAddr]
+		if !ok || time.Since(sample.at) > latencyTTL {
+			continue
+		}
+		if best == nil || sample.ewma < bestEwma {
+			best, bestEwma = storeServ, sample.ewma
+		}
+	}
+	return best, best != nil
+}
@@ -1,27 +1,59 @@
 package fastdfs
 
 import (
+	"fmt"
 	"log"
 	"os"
 )
 
-type Logger struct {
-	Info *log.Logger
-	Warn *log.Logger
-	Error *log.Logger
+// Logger receives what the client logs, e.g. retries, slow operations and
+// trackers going down. Adapt any logging library to it and set it as
+// Config.Logger.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
 }
 
-func NewLogger() *Logger {
+type nopLogger struct{}
 
-	//errorFile, e := os.OpenFile("error.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
-	//if e != nil {
-	//	fmt.Println("open log file failed. ", e)
-	//}
+func (nopLogger) Debugf(format string, args ...interface{}) {}
+func (nopLogger) Infof(format string, args ...interface{})  {}
+func (nopLogger) Warnf(format string, args ...interface{})  {}
+func (nopLogger) Errorf(format string, args ...interface{}) {}
 
-	return &Logger{
+type stdLogger struct {
+	debug *log.Logger
+	info  *log.Logger
+	warn  *log.Logger
+	error *log.Logger
+}
+
+// NewLogger returns a Logger writing to stdout, and errors to stderr, with
+// the standard library's log package.
+func NewLogger() Logger {
+	return &stdLogger{
+		log.New(os.Stdout, "Debug:", log.Ldate|log.Ltime|log.Lshortfile),
 		log.New(os.Stdout, "Info:", log.Ldate|log.Ltime|log.Lshortfile),
 		log.New(os.Stdout, "Warn:", log.Ldate|log.Ltime|log.Lshortfile),
 		log.New(os.Stderr, "Error:", log.Ldate|log.Ltime|log.Lshortfile),
 	}
+}
+
+// the call depth of 2 makes Lshortfile name the caller of the Logger method
+func (this *stdLogger) Debugf(format string, args ...interface{}) {
+	this.debug.Output(2, fmt.Sprintf(format, args...))
+}
+
+func (this *stdLogger) Infof(format string, args ...interface{}) {
+	this.info.Output(2, fmt.Sprintf(format, args...))
+}
+
+func (this *stdLogger) Warnf(format string, args ...interface{}) {
+	this.warn.Output(2, fmt.Sprintf(format, args...))
+}
 
+func (this *stdLogger) Errorf(format string, args ...interface{}) {
+	this.error.Output(2, fmt.Sprintf(format, args...))
 }
@@ -0,0 +1,64 @@
+package fastdfs
+
+import (
+	"context"
+	"fmt"
+)
+
+// SetMetadata stores meta as the name/value metadata of remoteFileId. With
+// flag STORAGE_SET_METADATA_FLAG_MERGE the names are added to or replace
+// the existing ones, with STORAGE_SET_METADATA_FLAG_OVERWRITE they replace
+// all existing metadata. Names and values longer than the server accepts
+// are cut, at a UTF-8 character boundary.
+func (this *FastDFSClient) SetMetadata(remoteFileId string, meta map[string]string, flag byte) error {
+	if flag != STORAGE_SET_METADATA_FLAG_MERGE && flag != STORAGE_SET_METADATA_FLAG_OVERWRITE {
+		return fmt.Errorf("invalid set metadata flag %q", flag)
+	}
+	if err := this.acquireOp(context.Background()); err != nil {
+		return err
+	}
+	defer this.releaseOp()
+
+	tmp, err := this.splitRemoteFileId(remoteFileId)
+	if err != nil {
+		return err
+	}
+	groupName, remoteFilename := tmp[0], tmp[1]
+
+	tc := this.trackerClient()
+	storeServ, err := tc.trackerQueryStorageUpdate(groupName, remoteFilename)
+	if err != nil {
+		return err
+	}
+	storagePool, err := this.getStoragePool(storeServ.ipAddr)
+	if err != nil {
+		return err
+	}
+	return this.storageClient(storagePool).storageSetMetadata(tc, storeServ, remoteFilename, meta, flag)
+}
+
+// GetMetadata returns the name/value metadata of remoteFileId, empty if it
+// has none.
+func (this *FastDFSClient) GetMetadata(remoteFileId string) (map[string]string, error) {
+	if err := this.acquireOp(context.Background()); err != nil {
+		return nil, err
+	}
+	defer this.releaseOp()
+
+	tmp, err := this.splitRemoteFileId(remoteFileId)
+	if err != nil {
+		return nil, err
+	}
+	groupName, remoteFilename := tmp[0], tmp[1]
+
+	tc := this.trackerClient()
+	storeServ, err := tc.trackerQueryStorageFetch(groupName, remoteFilename)
+	if err != nil {
+		return nil, err
+	}
+	storagePool, err := this.getStoragePool(storeServ.ipAddr)
+	if err != nil {
+		return nil, err
+	}
+	return this.storageClient(storagePool).storageGetMetadata(tc, storeServ, remoteFilename)
+}
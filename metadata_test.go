@@ -0,0 +1,133 @@
+package fastdfs
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMarshalMetadata(t *testing.T) {
+	long := strings.Repeat("值", FDFS_MAX_META_VALUE_LEN)
+	tests := []struct {
+		name string
+		meta map[string]string
+		want string
+		// back is what unmarshalling gives, meta if nil
+		back map[string]string
+	}{
+		{"empty", map[string]string{}, "", nil},
+		{"one", map[string]string{"width": "1024"}, "width\x021024", nil},
+		{"sorted", map[string]string{"width": "1024", "height": "768"}, "height\x02768\x01width\x021024", nil},
+		{"unicode", map[string]string{"作者": "张三", "title": "café ☕"}, "title\x02café ☕\x01作者\x02张三", nil},
+		{"empty value", map[string]string{"tag": ""}, "tag\x02", nil},
+		{"cut value", map[string]string{"v": long}, "v\x02" + long[:255],
+			map[string]string{"v": long[:255]}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := marshalMetadata(tt.meta)
+			if string(data) != tt.want {
+				t.Fatalf("marshalMetadata() = %q, want %q", data, tt.want)
+			}
+			want := tt.back
+			if want == nil {
+				want = tt.meta
+			}
+			if got := unmarshalMetadata(data); !reflect.DeepEqual(got, want) {
+				t.Errorf("unmarshalMetadata() = %q, want %q", got, want)
+			}
+		})
+	}
+
+	// records without a field separator are skipped
+	got := unmarshalMetadata([]byte("broken\x01a\x02b"))
+	if want := map[string]string{"a": "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unmarshalMetadata() = %q, want %q", got, want)
+	}
+}
+
+func TestMetadataRoundTrip(t *testing.T) {
+	c := newFakeCluster(t)
+	defer c.close()
+	client := c.client(t, nil)
+	id := mustUpload(t, client.UploadByBuffer, "content")
+
+	if meta, err := client.GetMetadata(id); err != nil || len(meta) != 0 {
+		t.Fatalf("GetMetadata() without metadata = %q, %v, want none", meta, err)
+	}
+	if err := client.SetMetadata(id, map[string]string{"a": "1"}, 'X'); err == nil {
+		t.Error("SetMetadata() with an invalid flag succeeded")
+	}
+
+	steps := []struct {
+		meta map[string]string
+		flag byte
+		want map[string]string
+	}{
+		{map[string]string{"名称": "测试文件", "emoji": "😀", "size": "7"}, STORAGE_SET_METADATA_FLAG_OVERWRITE,
+			map[string]string{"名称": "测试文件", "emoji": "😀", "size": "7"}},
+		{map[string]string{"size": "8", "语言": "中文"}, STORAGE_SET_METADATA_FLAG_MERGE,
+			map[string]string{"名称": "测试文件", "emoji": "😀", "size": "8", "语言": "中文"}},
+		{map[string]string{"only": "this"}, STORAGE_SET_METADATA_FLAG_OVERWRITE,
+			map[string]string{"only": "this"}},
+	}
+	for _, step := range steps {
+		if err := client.SetMetadata(id, step.meta, step.flag); err != nil {
+			t.Fatalf("SetMetadata(%q, %c) error = %v", step.meta, step.flag, err)
+		}
+		got, err := client.GetMetadata(id)
+		if err != nil {
+			t.Fatalf("GetMetadata() error = %v", err)
+		}
+		if !reflect.DeepEqual(got, step.want) {
+			t.Errorf("GetMetadata() after SetMetadata(%q, %c) = %q, want %q", step.meta, step.flag, got, step.want)
+		}
+	}
+}
+
+// warnLogger records the warnings logged.
+type warnLogger struct {
+	nopLogger
+	lock  sync.Mutex
+	warns []string
+}
+
+func (l *warnLogger) Warnf(format string, args ...interface{}) {
+	l.lock.Lock()
+	l.warns = append(l.warns, fmt.Sprintf(format, args...))
+	l.lock.Unlock()
+}
+
+func TestMetadataLogsSlowCommands(t *testing.T) {
+	c := newFakeCluster(t)
+	defer c.close()
+	log := &warnLogger{}
+	client := c.client(t, func(cfg *Config) {
+		cfg.Logger = log
+		cfg.SlowThreshold = time.Nanosecond
+	})
+	id := mustUpload(t, client.UploadByBuffer, "content")
+
+	if err := client.SetMetadata(id, map[string]string{"a": "1"}, STORAGE_SET_METADATA_FLAG_OVERWRITE); err != nil {
+		t.Fatalf("SetMetadata() error = %v", err)
+	}
+	if _, err := client.GetMetadata(id); err != nil {
+		t.Fatalf("GetMetadata() error = %v", err)
+	}
+
+	log.lock.Lock()
+	defer log.lock.Unlock()
+	for _, op := range []string{"set metadata", "get metadata"} {
+		want := "slow " + op + " on " + c.storage.addr()
+		found := false
+		for _, warn := range log.warns {
+			found = found || strings.HasPrefix(warn, want)
+		}
+		if !found {
+			t.Errorf("no warning %q in %q", want, log.warns)
+		}
+	}
+}
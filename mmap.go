@@ -0,0 +1,43 @@
+package fastdfs
+
+import (
+	"errors"
+	"os"
+)
+
+var ErrMmapUnsupported = errors.New("mmap is not supported on this platform")
+
+// MmapFile is a downloaded file mapped read-only into memory.
+// Bytes stays valid until Close is called.
+type MmapFile struct {
+	filename      string
+	data          []byte
+	removeOnClose bool
+}
+
+func (this *MmapFile) Bytes() []byte {
+	return this.data
+}
+
+func (this *MmapFile) Len() int {
+	return len(this.data)
+}
+
+func (this *MmapFile) Filename() string {
+	return this.filename
+}
+
+func (this *MmapFile) Close() error {
+	var err error
+	if this.data != nil {
+		err = munmapBytes(this.data)
+		this.data = nil
+	}
+	if this.removeOnClose {
+		if rerr := os.Remove(this.filename); rerr != nil && err == nil {
+			err = rerr
+		}
+		this.removeOnClose = false
+	}
+	return err
+}
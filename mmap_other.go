@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd
+
+package fastdfs
+
+func mmapFile(filename string, removeOnClose bool) (*MmapFile, error) {
+	return nil, ErrMmapUnsupported
+}
+
+func munmapBytes(data []byte) error {
+	return ErrMmapUnsupported
+}
@@ -0,0 +1,37 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+// +build linux darwin freebsd netbsd openbsd
+
+package fastdfs
+
+import (
+	"os"
+	"syscall"
+)
+
+func mmapFile(filename string, removeOnClose bool) (*MmapFile, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	mf := &MmapFile{filename: filename, removeOnClose: removeOnClose}
+	if fileInfo.Size() == 0 {
+		return mf, nil
+	}
+
+	mf.data, err = syscall.Mmap(int(file.Fd()), 0, int(fileInfo.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	return mf, nil
+}
+
+func munmapBytes(data []byte) error {
+	return syscall.Munmap(data)
+}
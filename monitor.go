@@ -0,0 +1,132 @@
+package fastdfs
+
+import (
+	"context"
+	"time"
+)
+
+// ListGroups returns the tracker's stats of every group the client may
+// use, e.g. to watch their free space. Unlike the stats behind UploadPolicy
+// they are always queried fresh.
+func (this *FastDFSClient) ListGroups() ([]GroupStat, error) {
+	if err := this.acquireOp(context.Background()); err != nil {
+		return nil, err
+	}
+	defer this.releaseOp()
+
+	groups, err := this.trackerClient().trackerListGroups()
+	if err != nil {
+		return nil, err
+	}
+	return this.filterAllowedGroups(groups), nil
+}
+
+// ListStorages returns the tracker's stats of every storage in groupName,
+// e.g. to find the node that is down: see StatusName and
+// LastHeartBeatTime.
+func (this *FastDFSClient) ListStorages(groupName string) ([]StorageStat, error) {
+	if err := this.acquireOp(context.Background()); err != nil {
+		return nil, err
+	}
+	defer this.releaseOp()
+
+	if !this.groupAllowed(groupName) {
+		return nil, ErrGroupNotAllowed
+	}
+	return this.trackerClient().trackerListStorages(groupName, "")
+}
+
+// StorageInfo returns the tracker's stats of the single storage storageIP
+// (or its storage id) in groupName, without listing the whole group.
+func (this *FastDFSClient) StorageInfo(groupName string, storageIP string) (*StorageStat, error) {
+	if err := this.acquireOp(context.Background()); err != nil {
+		return nil, err
+	}
+	defer this.releaseOp()
+
+	if !this.groupAllowed(groupName) {
+		return nil, ErrGroupNotAllowed
+	}
+	storages, err := this.trackerClient().trackerListStorages(groupName, storageIP)
+	if err != nil {
+		return nil, err
+	}
+	if len(storages) == 0 {
+		return nil, Errno{enoent}
+	}
+	return &storages[0], nil
+}
+
+// ClusterHealthReport is the state of every storage group at one point in
+// time, see ClusterHealth.
+type ClusterHealthReport struct {
+	Groups []GroupHealth
+}
+
+// GroupHealth sums up one storage group. Inactive lists the storages not in
+// FDFS_STORAGE_STATUS_ACTIVE, e.g. offline or still syncing ones.
+type GroupHealth struct {
+	GroupName      string
+	StorageCount   int
+	ActiveCount    int
+	TotalMB        int64
+	FreeMB         int64
+	ReplicationLag time.Duration
+	Inactive       []StorageStat
+}
+
+// Healthy reports whether every storage of every group is active.
+func (this *ClusterHealthReport) Healthy() bool {
+	for _, g := range this.Groups {
+		if len(g.Inactive) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// ClusterHealth lists all groups the client may use and their storages and
+// sums them up in one report, see ReplicationLag for how the lag is
+// estimated. It takes one tracker query per group. Without a deadline on
+// ctx it gives up after 10s.
+func (this *FastDFSClient) ClusterHealth(ctx context.Context) (*ClusterHealthReport, error) {
+	if err := this.acquireOp(ctx); err != nil {
+		return nil, err
+	}
+	defer this.releaseOp()
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+	}
+
+	tc := this.trackerClientContext(ctx)
+	groups, err := tc.trackerListGroups()
+	if err != nil {
+		return nil, err
+	}
+	report := &ClusterHealthReport{}
+	for _, g := range this.filterAllowedGroups(groups) {
+		storages, err := tc.trackerListStorages(g.GroupName, "")
+		if err != nil {
+			return nil, err
+		}
+		gh := GroupHealth{
+			GroupName:      g.GroupName,
+			StorageCount:   len(storages),
+			TotalMB:        g.TotalMB,
+			FreeMB:         g.FreeMB,
+			ReplicationLag: replicationLag(storages),
+		}
+		for _, s := range storages {
+			if s.Status == FDFS_STORAGE_STATUS_ACTIVE {
+				gh.ActiveCount++
+			} else {
+				gh.Inactive = append(gh.Inactive, s)
+			}
+		}
+		report.Groups = append(report.Groups, gh)
+	}
+	return report, nil
+}
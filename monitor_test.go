@@ -0,0 +1,140 @@
+package fastdfs
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+)
+
+// storageStatRecord lays out a storage's stats as a 4.x or 5.x tracker
+// sends them in answer to LIST_STORAGE, with the fields tests look at set.
+func storageStatRecord(status byte, id string, ipAddr string, version string, totalMB, freeMB int64,
+	lastHeartBeat int64, trunk bool) []byte {
+	record := make([]byte, TRACKER_STORAGE_STAT_LEN)
+	record[0] = status
+	copy(record[1:17], id)
+	copy(record[17:33], ipAddr)
+	copy(record[33:161], "storage."+id+".example.com")
+	copy(record[177:183], version)
+	// join_time, up_time, total_mb, free_mb, upload_priority,
+	// store_path_count, subdir_count_per_path, current_write_path,
+	// storage_port, storage_http_port
+	ints := record[183:263]
+	for i, v := range []int64{1600000000, 1600000100, totalMB, freeMB, 10, 1, 256, 0, 23000, 8888} {
+		binary.BigEndian.PutUint64(ints[i*8:], uint64(v))
+	}
+	counters := record[263 : 263+42*8]
+	binary.BigEndian.PutUint64(counters[storageStatSuccessUpload*8:], 42)
+	binary.BigEndian.PutUint64(counters[storageStatLastHeartBeatTime*8:], uint64(lastHeartBeat))
+	if trunk {
+		record[len(record)-1] = 1
+	}
+	return record
+}
+
+func TestListStorages(t *testing.T) {
+	c := newFakeCluster(t)
+	defer c.close()
+	client := c.client(t, nil)
+	c.tracker.setStorages(
+		storageStatRecord(FDFS_STORAGE_STATUS_ACTIVE, "100001", "10.0.0.1", "6.06", 102400, 51200, 1600000200, true),
+		storageStatRecord(FDFS_STORAGE_STATUS_OFFLINE, "100002", "10.0.0.2", "6.06", 102400, 100000, 1600000050, false),
+	)
+
+	storages, err := client.ListStorages("group1")
+	if err != nil {
+		t.Fatalf("ListStorages() error = %v", err)
+	}
+	want := []struct {
+		id, ip, status        string
+		totalMB, freeMB, beat int64
+		trunk                 bool
+	}{
+		{"100001", "10.0.0.1", "ACTIVE", 102400, 51200, 1600000200, true},
+		{"100002", "10.0.0.2", "OFFLINE", 102400, 100000, 1600000050, false},
+	}
+	if len(storages) != len(want) {
+		t.Fatalf("ListStorages() returned %d storages, want %d", len(storages), len(want))
+	}
+	for i, w := range want {
+		s := storages[i]
+		if s.Id != w.id || s.IpAddr != w.ip || s.StatusName() != w.status || s.TotalMB != w.totalMB ||
+			s.FreeMB != w.freeMB || s.LastHeartBeatTime != w.beat || s.IsTrunkServer != w.trunk ||
+			s.Version != "6.06" || s.StoragePort != 23000 || s.HttpAddr() != w.ip+":8888" ||
+			s.SuccessUploadCount != 42 || s.DomainName != "storage."+w.id+".example.com" {
+			t.Errorf("storage %d = %+v, want %+v", i, s, w)
+		}
+	}
+
+	if s, err := client.StorageInfo("group1", "10.0.0.2"); err != nil || s.Id != "100002" {
+		t.Errorf("StorageInfo(10.0.0.2) = %+v, %v, want storage 100002", s, err)
+	}
+	if s, err := client.StorageInfo("group1", "100001"); err != nil || s.IpAddr != "10.0.0.1" {
+		t.Errorf("StorageInfo(100001) = %+v, %v, want storage 10.0.0.1", s, err)
+	}
+	var errno Errno
+	if _, err := client.StorageInfo("group1", "10.0.0.3"); !errors.As(err, &errno) || errno.status != enoent {
+		t.Errorf("StorageInfo() of an unknown storage error = %v, want ENOENT", err)
+	}
+	if _, err := client.ListStorages("group9"); !errors.As(err, &errno) || errno.status != enoent {
+		t.Errorf("ListStorages() of an unknown group error = %v, want ENOENT", err)
+	}
+}
+
+func TestStatusName(t *testing.T) {
+	tests := []struct {
+		status int
+		want   string
+	}{
+		{FDFS_STORAGE_STATUS_INIT, "INIT"},
+		{FDFS_STORAGE_STATUS_WAIT_SYNC, "WAIT_SYNC"},
+		{FDFS_STORAGE_STATUS_SYNCING, "SYNCING"},
+		{FDFS_STORAGE_STATUS_DELETED, "DELETED"},
+		{FDFS_STORAGE_STATUS_OFFLINE, "OFFLINE"},
+		{FDFS_STORAGE_STATUS_ONLINE, "ONLINE"},
+		{FDFS_STORAGE_STATUS_ACTIVE, "ACTIVE"},
+		{FDFS_STORAGE_STATUS_RECOVERY, "RECOVERY"},
+		{8, "UNKNOWN(8)"},
+	}
+	for _, tt := range tests {
+		s := StorageStat{Status: tt.status}
+		if got := s.StatusName(); got != tt.want {
+			t.Errorf("StatusName() of %d = %q, want %q", tt.status, got, tt.want)
+		}
+	}
+}
+
+func TestClusterHealthCancelled(t *testing.T) {
+	c := newFakeCluster(t)
+	defer c.close()
+	client := c.client(t, nil)
+	c.tracker.setStorages(storageStatRecord(FDFS_STORAGE_STATUS_ACTIVE, "100001", "10.0.0.1", "6.06", 100, 50, 0, false))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := client.ClusterHealth(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("ClusterHealth() with a cancelled context error = %v, want %v", err, context.Canceled)
+	}
+
+	// a tracker that stops answering mid-report
+	c.tracker.setFault(TRACKER_PROTO_CMD_SERVER_LIST_STORAGE, faultHang, 1)
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := client.ClusterHealth(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("ClusterHealth() with a hung tracker error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if waited := time.Since(start); waited > time.Second {
+		t.Errorf("ClusterHealth() returned %v after its deadline", waited)
+	}
+
+	report, err := client.ClusterHealth(context.Background())
+	if err != nil {
+		t.Fatalf("ClusterHealth() after the hung query error = %v", err)
+	}
+	if len(report.Groups) != 1 || report.Groups[0].ActiveCount != 1 || !report.Healthy() {
+		t.Errorf("ClusterHealth() = %+v, want one healthy group", report)
+	}
+}
@@ -0,0 +1,98 @@
+package fastdfs
+
+import (
+	"context"
+	"time"
+)
+
+// Defaults is the behavior set once for all calls of a client, through
+// Config.Defaults, instead of passing CallOptions on every call. Each
+// setting resolves as: the CallOption given to the call, else the field of
+// Defaults if it isn't zero, else the package default noted on the field.
+// They apply to the upload, download and delete methods taking a context.
+type Defaults struct {
+	// Timeout bounds a whole operation, tracker queries and retries
+	// included. Package default: none besides the ctx of the call.
+	Timeout time.Duration
+
+	// Retries is how often an upload, download or delete that failed with
+	// a connection error is run again, see Config.MaxRetries. Package
+	// default: Config.MaxRetries.
+	Retries int
+
+	// StallRetries is how often a stalled upload is started over on
+	// another storage, see Config.StallTimeout. Package default:
+	// Config.StallRetries.
+	StallRetries int
+
+	// PreferSource makes downloads read from the storage the file was
+	// uploaded to, rather than the one the tracker picks, so they never
+	// hit a replica that hasn't caught up yet. Package default: false.
+	PreferSource bool
+
+	// Progress is called with the bytes of content sent or received so
+	// far and the total, every time a chunk went over the wire. It runs on
+	// the goroutine doing the transfer, so it should return quickly.
+	// Package default: none.
+	Progress func(transferred, total int64)
+}
+
+// CallOption overrides a setting of Defaults for a single call.
+type CallOption func(*callOptions)
+
+func WithTimeout(timeout time.Duration) CallOption {
+	return func(co *callOptions) { co.timeout = timeout }
+}
+
+func WithRetries(retries int) CallOption {
+	return func(co *callOptions) { co.retries = retries }
+}
+
+func WithStallRetries(stallRetries int) CallOption {
+	return func(co *callOptions) { co.stallRetries = stallRetries }
+}
+
+func WithPreferSource(preferSource bool) CallOption {
+	return func(co *callOptions) { co.preferSource = preferSource }
+}
+
+func WithProgress(progress func(transferred, total int64)) CallOption {
+	return func(co *callOptions) { co.progress = progress }
+}
+
+type callOptions struct {
+	timeout      time.Duration
+	retries      int
+	stallRetries int
+	preferSource bool
+	progress     func(transferred, total int64)
+}
+
+// callOptions resolves the effective settings of a call.
+func (this *FastDFSClient) callOptions(opts []CallOption) callOptions {
+	d := this.cfg.Defaults
+	co := callOptions{
+		timeout:      d.Timeout,
+		retries:      this.cfg.MaxRetries,
+		stallRetries: this.cfg.StallRetries,
+		preferSource: d.PreferSource,
+		progress:     d.Progress,
+	}
+	if d.Retries > 0 {
+		co.retries = d.Retries
+	}
+	if d.StallRetries > 0 {
+		co.stallRetries = d.StallRetries
+	}
+	for _, opt := range opts {
+		opt(&co)
+	}
+	return co
+}
+
+func (this callOptions) context(ctx context.Context) (context.Context, context.CancelFunc) {
+	if this.timeout > 0 {
+		return context.WithTimeout(ctx, this.timeout)
+	}
+	return context.WithCancel(ctx)
+}
@@ -0,0 +1,186 @@
+package fastdfs
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+)
+
+// Pipeline queues storage commands and, on Flush, sends all commands for one
+// storage back-to-back over a single connection before reading the
+// responses in order, so bulk metadata updates or deletes don't pay a round
+// trip each. Storages process the commands of a connection one after the
+// other, so the responses match the queue order. A Pipeline is not safe for
+// concurrent use.
+type Pipeline struct {
+	client *FastDFSClient
+	ops    []pipelineOp
+}
+
+type pipelineOp struct {
+	remoteFileId   string
+	remoteFilename string
+	cmd            int8
+	body           []byte
+	err            error
+}
+
+// NewPipeline returns an empty Pipeline on this client.
+func (this *FastDFSClient) NewPipeline() *Pipeline {
+	return &Pipeline{client: this}
+}
+
+// Len returns the number of queued commands.
+func (this *Pipeline) Len() int {
+	return len(this.ops)
+}
+
+// SetMetadata queues setting the metadata of remoteFileId, merged into the
+// existing metadata or replacing it.
+func (this *Pipeline) SetMetadata(remoteFileId string, meta map[string]string, merge bool) {
+	op := pipelineOp{remoteFileId: remoteFileId, cmd: STORAGE_PROTO_CMD_SET_METADATA}
+	tmp, err := this.client.splitRemoteFileId(remoteFileId)
+	if err == nil {
+		req := &setMetadataRequest{}
+		req.groupName = tmp[0]
+		req.remoteFilename = tmp[1]
+		req.meta = marshalMetadata(meta)
+		req.flag = STORAGE_SET_METADATA_FLAG_OVERWRITE
+		if merge {
+			req.flag = STORAGE_SET_METADATA_FLAG_MERGE
+		}
+		op.remoteFilename = tmp[1]
+		op.body, err = req.marshal()
+	}
+	op.err = err
+	this.ops = append(this.ops, op)
+}
+
+// DeleteFile queues deleting remoteFileId.
+func (this *Pipeline) DeleteFile(remoteFileId string) {
+	op := pipelineOp{remoteFileId: remoteFileId, cmd: STORAGE_PROTO_CMD_DELETE_FILE}
+	tmp, err := this.client.splitRemoteFileId(remoteFileId)
+	if err == nil {
+		req := &deleteFileRequest{}
+		req.groupName = tmp[0]
+		req.remoteFilename = tmp[1]
+		op.remoteFilename = tmp[1]
+		op.body, err = req.marshal()
+	}
+	op.err = err
+	this.ops = append(this.ops, op)
+}
+
+// Flush sends the queued commands, empties the queue and returns one error
+// per command in queue order, nil for those that succeeded. A command the
+// storage rejects doesn't affect the others. If the connection to a
+// storage breaks, that command and all later ones for the storage fail with
+// the same error and the connection is discarded, since it's impossible to
+// tell which of them the storage already executed.
+func (this *Pipeline) Flush() []error {
+	ops := this.ops
+	this.ops = nil
+	errs := make([]error, len(ops))
+	if len(ops) == 0 {
+		return errs
+	}
+
+	if err := this.client.acquireOp(context.Background()); err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+	defer this.client.releaseOp()
+
+	tc := this.client.trackerClient()
+	byStorage := make(map[StorageServer][]int)
+	for i, op := range ops {
+		if op.err != nil {
+			errs[i] = op.err
+			continue
+		}
+		tmp, _ := splitRemoteFileId(op.remoteFileId)
+		storeServ, err := tc.trackerQueryStorageUpdate(tmp[0], op.remoteFilename)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		key := StorageServer{storeServ.ipAddr, storeServ.groupName, 0}
+		byStorage[key] = append(byStorage[key], i)
+	}
+
+	var wg sync.WaitGroup
+	for storeServ, indexes := range byStorage {
+		wg.Add(1)
+		go func(storeServ StorageServer, indexes []int) {
+			defer wg.Done()
+			// each goroutine writes only its own indexes of errs
+			this.flushStorage(&storeServ, ops, indexes, errs)
+		}(storeServ, indexes)
+	}
+	wg.Wait()
+
+	return errs
+}
+
+func (this *Pipeline) flushStorage(storeServ *StorageServer, ops []pipelineOp, indexes []int, errs []error) {
+	failFrom := func(n int, err error) {
+		for _, i := range indexes[n:] {
+			errs[i] = storageError(storeServ, ops[i].cmd, err)
+		}
+	}
+
+	storagePool, err := this.client.getStoragePool(storeServ.ipAddr)
+	if err != nil {
+		failFrom(0, err)
+		return
+	}
+	conn, err := storagePool.Get()
+	if err != nil {
+		failFrom(0, err)
+		return
+	}
+
+	// write concurrently so a storage blocked on sending responses we
+	// haven't read yet can't deadlock with us
+	written := make(chan error, 1)
+	go func() {
+		written <- writePipelined(conn, ops, indexes)
+	}()
+
+	for n, i := range indexes {
+		th := &trackerHeader{}
+		if err = th.recvHeader(conn); err == nil && th.pkgLen > 0 {
+			_, err = io.CopyN(ioutil.Discard, conn, th.pkgLen)
+		}
+		if err != nil {
+			failFrom(n, err)
+			releaseConn(conn, err)
+			<-written
+			return
+		}
+		if th.status != 0 {
+			errs[i] = storageError(storeServ, ops[i].cmd, Errno{int(th.status)})
+		}
+	}
+	err = <-written
+	releaseConn(conn, err)
+}
+
+func writePipelined(conn net.Conn, ops []pipelineOp, indexes []int) error {
+	for _, i := range indexes {
+		th := &trackerHeader{}
+		th.cmd = ops[i].cmd
+		th.pkgLen = int64(len(ops[i].body))
+		if err := th.sendHeader(conn); err != nil {
+			return err
+		}
+		if err := TcpSendData(conn, ops[i].body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package fastdfs
+
+import (
+	"io"
+	"net"
+)
+
+// progressWriter reports the bytes written through it to fn.
+type progressWriter struct {
+	w     io.Writer
+	done  int64
+	total int64
+	fn    func(transferred, total int64)
+}
+
+func (this *progressWriter) Write(p []byte) (int, error) {
+	n, err := this.w.Write(p)
+	if n > 0 {
+		this.done += int64(n)
+		this.fn(this.done, this.total)
+	}
+	return n, err
+}
+
+// progressConn reports the bytes read from the connection to fn.
+type progressConn struct {
+	net.Conn
+	done  int64
+	total int64
+	fn    func(transferred, total int64)
+}
+
+func (this *progressConn) Read(p []byte) (int, error) {
+	n, err := this.Conn.Read(p)
+	if n > 0 {
+		this.done += int64(n)
+		this.fn(this.done, this.total)
+	}
+	return n, err
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (this *countingWriter) Write(p []byte) (int, error) {
+	n, err := this.w.Write(p)
+	this.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,36 @@
+package fastdfs
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// SOCKS5Proxy is a SOCKS5 server to reach trackers and storages through.
+// User and Password are only sent if User is set.
+type SOCKS5Proxy struct {
+	Addr     string
+	User     string
+	Password string
+}
+
+// dialContext returns a dial function connecting through the proxy.
+func (this *SOCKS5Proxy) dialContext(connectTimeout time.Duration) (func(ctx context.Context, network, addr string) (net.Conn, error), error) {
+	var auth *proxy.Auth
+	if this.User != "" {
+		auth = &proxy.Auth{User: this.User, Password: this.Password}
+	}
+	dialer, err := proxy.SOCKS5("tcp", this.Addr, auth, &net.Dialer{Timeout: connectTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("socks5 proxy %s: %w", this.Addr, err)
+	}
+	if cd, ok := dialer.(proxy.ContextDialer); ok {
+		return cd.DialContext, nil
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dialer.Dial(network, addr)
+	}, nil
+}
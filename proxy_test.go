@@ -0,0 +1,219 @@
+package fastdfs
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// fakeSOCKS5 is a SOCKS5 server handling CONNECT, with username and
+// password authentication if user is set.
+type fakeSOCKS5 struct {
+	ln             net.Listener
+	user, password string
+
+	lock    sync.Mutex
+	targets map[string]int
+	wg      sync.WaitGroup
+}
+
+func newFakeSOCKS5(t *testing.T, user string, password string) *fakeSOCKS5 {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &fakeSOCKS5{ln: ln, user: user, password: password, targets: make(map[string]int)}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			p.wg.Add(1)
+			go func() {
+				defer p.wg.Done()
+				defer conn.Close()
+				p.serve(conn)
+			}()
+		}
+	}()
+	return p
+}
+
+// connects returns how many connections went to addr.
+func (p *fakeSOCKS5) connects(addr string) int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.targets[addr]
+}
+
+func (p *fakeSOCKS5) close() {
+	p.ln.Close()
+	p.wg.Wait()
+}
+
+func (p *fakeSOCKS5) serve(conn net.Conn) {
+	// |-ver(1)-nmethods(1)-methods(nmethods)-|
+	buf := make([]byte, 256)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return
+	}
+	methods := buf[2 : 2+int(buf[1])]
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+	method := byte(0x00)
+	if p.user != "" {
+		method = 0x02
+	}
+	offered := false
+	for _, m := range methods {
+		offered = offered || m == method
+	}
+	if !offered {
+		conn.Write([]byte{5, 0xff})
+		return
+	}
+	conn.Write([]byte{5, method})
+
+	if method == 0x02 {
+		// |-ver(1)-ulen(1)-user-plen(1)-password-|
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return
+		}
+		user := make([]byte, buf[1])
+		if _, err := io.ReadFull(conn, user); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return
+		}
+		password := make([]byte, buf[0])
+		if _, err := io.ReadFull(conn, password); err != nil {
+			return
+		}
+		if string(user) != p.user || string(password) != p.password {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+	}
+
+	// |-ver(1)-cmd(1)-rsv(1)-atyp(1)-addr-port(2)-|
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil || buf[1] != 1 {
+		return
+	}
+	var host string
+	switch buf[3] {
+	case 1, 4:
+		ip := make([]byte, 4)
+		if buf[3] == 4 {
+			ip = make([]byte, 16)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return
+		}
+		host = net.IP(ip).String()
+	case 3:
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return
+		}
+		name := make([]byte, buf[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return
+		}
+		host = string(name)
+	default:
+		return
+	}
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(buf[:2]))))
+
+	target, err := net.Dial("tcp", addr)
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer target.Close()
+	p.lock.Lock()
+	p.targets[addr]++
+	p.lock.Unlock()
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+
+	done := make(chan struct{})
+	go func() {
+		io.Copy(target, conn)
+		target.Close()
+		close(done)
+	}()
+	io.Copy(conn, target)
+	conn.Close()
+	<-done
+}
+
+func TestSOCKS5Proxy(t *testing.T) {
+	tests := []struct {
+		name     string
+		auth     bool // the proxy wants user fdfs with password secret
+		proxy    SOCKS5Proxy
+		wantFail bool
+	}{
+		{"no auth", false, SOCKS5Proxy{}, false},
+		{"password", true, SOCKS5Proxy{User: "fdfs", Password: "secret"}, false},
+		{"wrong password", true, SOCKS5Proxy{User: "fdfs", Password: "wrong"}, true},
+		{"no credentials", true, SOCKS5Proxy{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var p *fakeSOCKS5
+			if tt.auth {
+				p = newFakeSOCKS5(t, "fdfs", "secret")
+			} else {
+				p = newFakeSOCKS5(t, "", "")
+			}
+			defer p.close()
+			// a storage of its own, whose pool is dialed through this proxy,
+			// closed first to end the relayed connections
+			c := newFakeCluster(t)
+			defer c.close()
+			tt.proxy.Addr = p.ln.Addr().String()
+
+			client, err := New(Config{
+				Endpoints:   []string{c.tracker.addr()},
+				SOCKS5Proxy: &tt.proxy,
+			})
+			if tt.wantFail {
+				if err == nil {
+					client.Close()
+					t.Fatal("New() through a proxy rejecting the client succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			// close before the proxy, ending the relayed connections
+			defer client.Close()
+
+			ur, err := client.UploadByBuffer([]byte("content"), "txt")
+			if err != nil {
+				t.Fatalf("UploadByBuffer() error = %v", err)
+			}
+			if dr, err := client.DownloadToBuffer(ur.fileId(), 0, 0); err != nil || string(dr.Content.([]byte)) != "content" {
+				t.Fatalf("DownloadToBuffer() = %v, %v", dr, err)
+			}
+			for _, addr := range []string{c.tracker.addr(), c.storage.addr()} {
+				if p.connects(addr) == 0 {
+					t.Errorf("no connection to %s went through the proxy", addr)
+				}
+			}
+		})
+	}
+}
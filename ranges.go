@@ -0,0 +1,83 @@
+package fastdfs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+)
+
+var ErrInvalidRanges = errors.New("byte ranges must be non-empty, ascending and not overlap")
+
+// ByteRange is Length bytes of a file starting at Offset.
+type ByteRange struct {
+	Offset int64
+	Length int64
+}
+
+// DownloadRanges downloads several ranges of one file, e.g. for an HTTP
+// multipart/byteranges response, over a single storage connection. fn is
+// called for each range in order with a reader of its content; whatever fn
+// leaves unread is skipped. The ranges have to be ascending and must not
+// overlap. A range reaching past the end of the file is cut short, and fn
+// gets the actual length, unless StrictDownloadRange is set. An error from
+// fn stops the download and is returned.
+func (this *FastDFSClient) DownloadRanges(remoteFileId string, ranges []ByteRange, fn func(r ByteRange, content io.Reader) error) (err error) {
+	for i, r := range ranges {
+		if r.Offset < 0 || r.Length <= 0 || i > 0 && r.Offset < ranges[i-1].Offset+ranges[i-1].Length {
+			return ErrInvalidRanges
+		}
+	}
+	if err := this.acquireOp(context.Background()); err != nil {
+		return err
+	}
+	defer this.releaseOp()
+
+	tmp, err := this.splitRemoteFileId(remoteFileId)
+	if err != nil {
+		return err
+	}
+	groupName := tmp[0]
+	remoteFilename := tmp[1]
+
+	tc := this.trackerClient()
+	storeServ, err := this.queryFetchStorage(tc, remoteFileId, groupName, remoteFilename)
+	if err != nil {
+		return err
+	}
+	defer func() { this.forgetFailedStorage(remoteFileId, err) }()
+
+	storagePool, err := this.getStoragePool(storeServ.ipAddr)
+	if err != nil {
+		return err
+	}
+	var conn net.Conn
+	if conn, err = storagePool.Get(); err != nil {
+		return storageError(storeServ, STORAGE_PROTO_CMD_DOWNLOAD_FILE, err)
+	}
+	defer func() { releaseConn(conn, err) }()
+
+	for _, r := range ranges {
+		length, err := downloadRangeOnConn(conn, groupName, remoteFilename, r.Offset, r.Length)
+		if err != nil {
+			return storageError(storeServ, STORAGE_PROTO_CMD_DOWNLOAD_FILE, err)
+		}
+		if length < r.Length && this.cfg.StrictDownloadRange {
+			// the content is still on the wire, don't reuse the connection
+			return ErrRangeNotSatisfiable
+		}
+
+		content := io.LimitReader(conn, length)
+		if err = fn(ByteRange{r.Offset, length}, content); err != nil {
+			return err
+		}
+		if _, err = io.Copy(ioutil.Discard, content); err != nil {
+			return storageError(storeServ, STORAGE_PROTO_CMD_DOWNLOAD_FILE, err)
+		}
+		if content.(*io.LimitedReader).N > 0 {
+			return storageError(storeServ, STORAGE_PROTO_CMD_DOWNLOAD_FILE, io.ErrUnexpectedEOF)
+		}
+	}
+	return nil
+}
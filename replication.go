@@ -0,0 +1,53 @@
+package fastdfs
+
+import (
+	"context"
+	"time"
+)
+
+// ReplicationLag estimates how far the storages of groupName are behind
+// each other: for every online storage it compares the newest upload any
+// other storage of the group took as source with the point up to which this
+// storage has synced from the others, and returns the largest difference.
+//
+// FastDFS only reports these timestamps with second precision, and the
+// storages send them with their heartbeats, so the result is coarse and a
+// few seconds stale. It measures time, not backlog: a burst of uploads and a
+// single upload that hasn't been synced for the same time look alike. The
+// clocks of the storages should be in sync, as for FastDFS itself. Offline
+// storages are skipped, so a node that's down doesn't raise the lag until it
+// comes back.
+func (this *FastDFSClient) ReplicationLag(groupName string) (time.Duration, error) {
+	if err := this.acquireOp(context.Background()); err != nil {
+		return 0, err
+	}
+	defer this.releaseOp()
+
+	if !this.groupAllowed(groupName) {
+		return 0, ErrGroupNotAllowed
+	}
+	storages, err := this.trackerClient().trackerListStorages(groupName, "")
+	if err != nil {
+		return 0, err
+	}
+	return replicationLag(storages), nil
+}
+
+func replicationLag(storages []StorageStat) time.Duration {
+	var maxLag int64
+	for i := range storages {
+		s := &storages[i]
+		if s.Status != FDFS_STORAGE_STATUS_ACTIVE && s.Status != FDFS_STORAGE_STATUS_ONLINE {
+			continue
+		}
+		for j := range storages {
+			if i == j {
+				continue
+			}
+			if lag := storages[j].LastSourceUpdate - s.LastSyncedTimestamp; lag > maxLag {
+				maxLag = lag
+			}
+		}
+	}
+	return time.Duration(maxLag) * time.Second
+}
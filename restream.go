@@ -0,0 +1,87 @@
+package fastdfs
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+var ErrSourceChanged = errors.New("source file changed while copying")
+
+// ReStream copies srcRemoteFileId to a new file with extension ext and
+// returns its id. The content is piped from the download straight into the
+// upload, so even huge files are never held in memory or on disk. The size
+// the upload needs up front is queried from the source storage first; if an
+// appender source grows in the meantime the copy is deleted again and
+// ErrSourceChanged returned.
+func (this *FastDFSClient) ReStream(srcRemoteFileId string, ext string) (string, error) {
+	if err := this.acquireOp(context.Background()); err != nil {
+		return "", err
+	}
+	defer this.releaseOp()
+
+	tmp, err := this.splitRemoteFileId(srcRemoteFileId)
+	if err != nil {
+		return "", err
+	}
+	groupName := tmp[0]
+	remoteFilename := tmp[1]
+
+	tc := this.trackerClient()
+	srcServ, err := tc.trackerQueryStorageUpdate(groupName, remoteFilename)
+	if err != nil {
+		return "", err
+	}
+	srcPool, err := this.getStoragePool(srcServ.ipAddr)
+	if err != nil {
+		return "", err
+	}
+	info, err := this.storageClient(srcPool).storageQueryFileInfo(context.Background(), tc, srcServ, remoteFilename)
+	if err != nil {
+		return "", err
+	}
+
+	storeServ, err := this.queryUploadStorage(tc)
+	if err != nil {
+		return "", err
+	}
+	if err = this.checkFreeSpace(tc, storeServ.groupName, info.FileSize); err != nil {
+		return "", err
+	}
+	storagePool, err := this.getStoragePool(storeServ.ipAddr)
+	if err != nil {
+		return "", err
+	}
+	store := this.storageClient(storagePool)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		_, err := this.downloadToWriter(ctx, pw, srcRemoteFileId, 0, 0, this.callOptions(nil))
+		pw.CloseWithError(err)
+		done <- err
+	}()
+
+	ur, err := store.storageUploadByReader(ctx, tc, storeServ, pr, info.FileSize, ext)
+	// the upload read exactly the size it announced; anything the download
+	// still wants to write means the source grew
+	pr.CloseWithError(ErrSourceChanged)
+	if err != nil {
+		cancel()
+		<-done
+		return "", err
+	}
+	if dlErr := <-done; dlErr != nil {
+		if delErr := this.deleteFile(context.Background(), ur.fileId()); delErr != nil {
+			this.log.Warnf("deleting incomplete copy %s error :%s", ur.fileId(), delErr.Error())
+		}
+		if errors.Is(dlErr, io.ErrClosedPipe) || errors.Is(dlErr, ErrSourceChanged) {
+			return "", ErrSourceChanged
+		}
+		return "", dlErr
+	}
+	return ur.fileId(), nil
+}
@@ -0,0 +1,56 @@
+package fastdfs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// retryable reports whether err is a connection level failure that another
+// attempt, possibly on another server, may not hit: a dial, read or write
+// that failed or timed out, or a connection closed by the server. Answers
+// of the server, like a rejected upload, and the end of the call's context
+// are final.
+func retryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var errno Errno
+	if errors.As(err, &errno) {
+		return false
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// retryWait waits before retry number n, counted from zero, giving up
+// early when ctx ends.
+func (this *FastDFSClient) retryWait(ctx context.Context, n int) error {
+	timer := time.NewTimer(this.cfg.RetryBackoff << uint(n))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// withRetries runs op and, while it fails with a retryable error, runs it
+// again up to retries times. op is expected to query the tracker anew on
+// every run. canRetry, if not nil, can veto a retry, e.g. once output was
+// written.
+func (this *FastDFSClient) withRetries(ctx context.Context, retries int, canRetry func() bool, op func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := op()
+		if attempt >= retries || !retryable(err) || canRetry != nil && !canRetry() {
+			return err
+		}
+		this.log.Warnf("retrying after connection error: %v", err)
+		if this.retryWait(ctx, attempt) != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package fastdfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{io.EOF, true},
+		{io.ErrUnexpectedEOF, true},
+		{&net.OpError{Op: "read", Err: errors.New("connection reset")}, true},
+		{fmt.Errorf("query: %w", io.EOF), true},
+		{storageError(&StorageServer{ipAddr: "127.0.0.1:23000"}, STORAGE_PROTO_CMD_UPLOAD_FILE, io.EOF), true},
+		{Errno{28}, false},
+		{storageError(&StorageServer{ipAddr: "127.0.0.1:23000"}, STORAGE_PROTO_CMD_UPLOAD_FILE, Errno{2}), false},
+		{context.Canceled, false},
+		{context.DeadlineExceeded, false},
+		{errors.New("other"), false},
+	}
+	for _, tt := range tests {
+		if got := retryable(tt.err); got != tt.want {
+			t.Errorf("retryable(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestUploadRetries(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxRetries int
+		failures   int
+		wantErr    bool
+		// every attempt dials anew, the failed ones' connections are dropped
+		wantDials int64
+	}{
+		{"no retries", 0, 1, true, 1},
+		{"retried", 2, 2, false, 3},
+		{"retries used up", 2, 3, true, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newFakeCluster(t)
+			defer c.close()
+			client := c.client(t, func(cfg *Config) {
+				cfg.MaxRetries = tt.maxRetries
+				cfg.RetryBackoff = time.Millisecond
+			})
+
+			c.storage.setFault(STORAGE_PROTO_CMD_UPLOAD_FILE, faultClose, tt.failures)
+			ur, err := client.UploadByBuffer([]byte("content"), "txt")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("UploadByBuffer() error = %v, want failure %v", err, tt.wantErr)
+			}
+			if err == nil && string(c.storage.file(ur.RemoteFileId)) != "content" {
+				t.Errorf("uploaded file holds %q", c.storage.file(ur.RemoteFileId))
+			}
+			if got := c.storage.Accepted(); got != tt.wantDials {
+				t.Errorf("storage accepted %d connections, want %d", got, tt.wantDials)
+			}
+		})
+	}
+
+	c := newFakeCluster(t)
+	defer c.close()
+	client := c.client(t, func(cfg *Config) { cfg.MaxRetries = 3 })
+	// a rejection by the storage is final
+	if err := client.DeleteFile("group1/M00/00/00/" + fdfsBase64.EncodeToString(make([]byte, 20)) + ".txt"); err == nil {
+		t.Fatal("DeleteFile() of a missing file succeeded")
+	}
+	if got := c.storage.Accepted(); got != 1 {
+		t.Errorf("storage accepted %d connections for a rejected delete, want 1", got)
+	}
+}
+
+func TestCallRetries(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxRetries int
+		defaults   int
+		opts       []CallOption
+		wantErr    bool
+		// the first attempt reuses the upload's connection, every retry
+		// dials anew
+		wantAttempts int64
+	}{
+		{"Config.MaxRetries", 2, 0, nil, false, 3},
+		{"Defaults.Retries", 0, 2, nil, false, 3},
+		{"WithRetries more", 0, 0, []CallOption{WithRetries(2)}, false, 3},
+		{"WithRetries fewer", 2, 0, []CallOption{WithRetries(1)}, true, 2},
+		{"WithRetries none", 2, 2, []CallOption{WithRetries(0)}, true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newFakeCluster(t)
+			defer c.close()
+			client := c.client(t, func(cfg *Config) {
+				cfg.MaxRetries = tt.maxRetries
+				cfg.RetryBackoff = time.Millisecond
+				cfg.Defaults.Retries = tt.defaults
+			})
+			ur, err := client.UploadByBuffer([]byte("content"), "txt")
+			if err != nil {
+				t.Fatalf("UploadByBuffer() error = %v", err)
+			}
+
+			c.storage.setFault(STORAGE_PROTO_CMD_DOWNLOAD_FILE, faultClose, 2)
+			dr, err := client.DownloadToBufferContext(context.Background(), ur.fileId(), 0, 0, tt.opts...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DownloadToBufferContext() error = %v, want failure %v", err, tt.wantErr)
+			}
+			if err == nil && string(dr.Content.([]byte)) != "content" {
+				t.Errorf("downloaded %q", dr.Content)
+			}
+			if got := c.storage.Accepted(); got != tt.wantAttempts {
+				t.Errorf("storage accepted %d connections, want %d", got, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestRetriesShareDeadline(t *testing.T) {
+	c := newFakeCluster(t)
+	defer c.close()
+	// every attempt on its own could take the 5s Config.Timeout
+	client := c.client(t, func(cfg *Config) {
+		cfg.MaxRetries = 3
+		cfg.RetryBackoff = time.Millisecond
+	})
+	ur, err := client.UploadByBuffer([]byte("content"), "txt")
+	if err != nil {
+		t.Fatalf("UploadByBuffer() error = %v", err)
+	}
+
+	ops := []struct {
+		name string
+		cmd  int8
+		op   func(ctx context.Context) error
+	}{
+		{"upload", STORAGE_PROTO_CMD_UPLOAD_FILE, func(ctx context.Context) error {
+			_, err := client.UploadByBufferContext(ctx, []byte("content"), "txt")
+			return err
+		}},
+		{"download", STORAGE_PROTO_CMD_DOWNLOAD_FILE, func(ctx context.Context) error {
+			_, err := client.DownloadToBufferContext(ctx, ur.fileId(), 0, 0)
+			return err
+		}},
+		{"delete", STORAGE_PROTO_CMD_DELETE_FILE, func(ctx context.Context) error {
+			return client.DeleteFileContext(ctx, ur.fileId())
+		}},
+	}
+	for _, op := range ops {
+		// the storage swallows the requests
+		c.storage.setFault(op.cmd, faultHang, -1)
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		start := time.Now()
+		err := op.op(ctx)
+		elapsed := time.Since(start)
+		cancel()
+		c.storage.setFault(op.cmd, 0, 0)
+
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("%s: error = %v, want %v", op.name, err, context.DeadlineExceeded)
+		}
+		if elapsed > 500*time.Millisecond {
+			t.Errorf("%s: returned after %v, want about 200ms", op.name, elapsed)
+		}
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	client := &FastDFSClient{cfg: Config{RetryBackoff: 10 * time.Millisecond}}
+
+	for n, want := range []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond} {
+		start := time.Now()
+		if err := client.retryWait(context.Background(), n); err != nil {
+			t.Fatalf("retryWait(%d) error = %v", n, err)
+		}
+		if waited := time.Since(start); waited < want {
+			t.Errorf("retryWait(%d) waited %v, want at least %v", n, waited, want)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	if err := client.retryWait(ctx, 10); err != context.Canceled {
+		t.Errorf("retryWait() with a cancelled context error = %v, want %v", err, context.Canceled)
+	}
+	if waited := time.Since(start); waited > time.Second {
+		t.Errorf("retryWait() with a cancelled context waited %v", waited)
+	}
+}
+
+func TestWithRetries(t *testing.T) {
+	client := &FastDFSClient{cfg: Config{RetryBackoff: time.Millisecond}, log: nopLogger{}}
+	tests := []struct {
+		name      string
+		errs      []error
+		canRetry  func() bool
+		cancelled bool
+		wantRuns  int
+		wantErr   error
+	}{
+		{"success", []error{nil}, nil, false, 1, nil},
+		{"retried", []error{io.EOF, io.EOF, nil}, nil, false, 3, nil},
+		{"retries used up", []error{io.EOF, io.EOF, io.EOF, io.EOF, nil}, nil, false, 4, io.EOF},
+		{"final error", []error{Errno{2}, nil}, nil, false, 1, Errno{2}},
+		{"vetoed", []error{io.EOF, nil}, func() bool { return false }, false, 1, io.EOF},
+		{"context ended", []error{io.EOF, nil}, nil, true, 1, io.EOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancelled {
+				cancel()
+			}
+			runs := 0
+			err := client.withRetries(ctx, 3, tt.canRetry, func() error {
+				runs++
+				return tt.errs[runs-1]
+			})
+			if err != tt.wantErr || runs != tt.wantRuns {
+				t.Errorf("withRetries() = %v after %d runs, want %v after %d", err, runs, tt.wantErr, tt.wantRuns)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package fastdfs
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// stickyCache is a small LRU remembering which storage served a file id
+// last, so repeated downloads hit the same node and its page cache.
+type stickyCache struct {
+	lock  sync.Mutex
+	size  int
+	ttl   time.Duration
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type stickyEntry struct {
+	fileId string
+	addr   string
+	at     time.Time
+}
+
+func newStickyCache(size int, ttl time.Duration) *stickyCache {
+	return &stickyCache{
+		size:  size,
+		ttl:   ttl,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+func (this *stickyCache) get(fileId string) (string, bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	elem, ok := this.items[fileId]
+	if !ok {
+		return "", false
+	}
+	entry := elem.Value.(*stickyEntry)
+	if time.Since(entry.at) > this.ttl {
+		this.ll.Remove(elem)
+		delete(this.items, fileId)
+		return "", false
+	}
+	this.ll.MoveToFront(elem)
+	return entry.addr, true
+}
+
+func (this *stickyCache) put(fileId string, addr string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if elem, ok := this.items[fileId]; ok {
+		entry := elem.Value.(*stickyEntry)
+		entry.addr = addr
+		entry.at = time.Now()
+		this.ll.MoveToFront(elem)
+		return
+	}
+	this.items[fileId] = this.ll.PushFront(&stickyEntry{fileId, addr, time.Now()})
+	for this.ll.Len() > this.size {
+		oldest := this.ll.Back()
+		this.ll.Remove(oldest)
+		delete(this.items, oldest.Value.(*stickyEntry).fileId)
+	}
+}
+
+func (this *stickyCache) remove(fileId string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if elem, ok := this.items[fileId]; ok {
+		this.ll.Remove(elem)
+		delete(this.items, fileId)
+	}
+}
@@ -1,17 +1,53 @@
 package fastdfs
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
+	"time"
 )
 
+// uploadChunkSize is how much of a reader is sent to the storage at once.
+const uploadChunkSize = 256 << 10
+
+var ErrShortUpload = errors.New("reader ended before the declared upload size")
+
 type StorageClient struct {
-	pool *ConnectionPool
+	pool          *ConnectionPool
+	stallTimeout  time.Duration
+	slowThreshold time.Duration
+	latency       *latencyTracker
+	// strictRange fails downloads the file is too short for, instead of
+	// returning what there is
+	strictRange bool
+	// budget bounds the memory of concurrent buffer downloads, nil if
+	// unlimited
+	budget *byteBudget
+	// progress is told about every chunk of content sent or received
+	progress func(transferred, total int64)
+	log      Logger
+}
+
+// release is TrackerClient.release for a storage command bound to ctx.
+func (this *StorageClient) release(ctx context.Context, conn net.Conn, err *error) func() {
+	stop := watchConn(ctx, conn)
+	return func() {
+		if stop() {
+			if *err != nil {
+				*err = ctx.Err()
+			}
+			if pc, ok := conn.(*pConn); ok {
+				pc.MarkUnusable()
+			}
+		}
+		releaseConn(conn, *err)
+	}
 }
 
-func (this *StorageClient) storageUploadByFilename(tc *TrackerClient,
+func (this *StorageClient) storageUploadByFilename(ctx context.Context, tc *TrackerClient,
 	storeServ *StorageServer, filename string) (*UploadFileResponse, error) {
 	fileInfo, err := os.Stat(filename)
 	if err != nil {
@@ -21,19 +57,26 @@ func (this *StorageClient) storageUploadByFilename(tc *TrackerClient,
 	fileSize := fileInfo.Size()
 	fileExtName := getFileExt(filename)
 
-	return this.storageUploadFile(tc, storeServ, filename, int64(fileSize), FDFS_UPLOAD_BY_FILENAME,
+	return this.storageUploadFile(ctx, tc, storeServ, filename, int64(fileSize), FDFS_UPLOAD_BY_FILENAME,
 		STORAGE_PROTO_CMD_UPLOAD_FILE, "", "", fileExtName)
 }
 
-func (this *StorageClient) storageUploadByBuffer(tc *TrackerClient,
+func (this *StorageClient) storageUploadByBuffer(ctx context.Context, tc *TrackerClient,
 	storeServ *StorageServer, fileBuffer []byte, fileExtName string) (*UploadFileResponse, error) {
 	bufferSize := len(fileBuffer)
 
-	return this.storageUploadFile(tc, storeServ, fileBuffer, int64(bufferSize), FDFS_UPLOAD_BY_BUFFER,
+	return this.storageUploadFile(ctx, tc, storeServ, fileBuffer, int64(bufferSize), FDFS_UPLOAD_BY_BUFFER,
 		STORAGE_PROTO_CMD_UPLOAD_FILE, "", "", fileExtName)
 }
 
-func (this *StorageClient) storageUploadSlaveByFilename(tc *TrackerClient,
+// storageUploadByReader uploads exactly fileSize bytes read from r.
+func (this *StorageClient) storageUploadByReader(ctx context.Context, tc *TrackerClient,
+	storeServ *StorageServer, r io.Reader, fileSize int64, fileExtName string) (*UploadFileResponse, error) {
+	return this.storageUploadFile(ctx, tc, storeServ, r, fileSize, FDFS_UPLOAD_BY_READER,
+		STORAGE_PROTO_CMD_UPLOAD_FILE, "", "", fileExtName)
+}
+
+func (this *StorageClient) storageUploadSlaveByFilename(ctx context.Context, tc *TrackerClient,
 	storeServ *StorageServer, filename string, prefixName string, remoteFileId string) (*UploadFileResponse, error) {
 	fileInfo, err := os.Stat(filename)
 	if err != nil {
@@ -43,19 +86,19 @@ func (this *StorageClient) storageUploadSlaveByFilename(tc *TrackerClient,
 	fileSize := fileInfo.Size()
 	fileExtName := getFileExt(filename)
 
-	return this.storageUploadFile(tc, storeServ, filename, int64(fileSize), FDFS_UPLOAD_BY_FILENAME,
+	return this.storageUploadFile(ctx, tc, storeServ, filename, int64(fileSize), FDFS_UPLOAD_BY_FILENAME,
 		STORAGE_PROTO_CMD_UPLOAD_SLAVE_FILE, remoteFileId, prefixName, fileExtName)
 }
 
-func (this *StorageClient) storageUploadSlaveByBuffer(tc *TrackerClient,
-	storeServ *StorageServer, fileBuffer []byte, remoteFileId string, fileExtName string) (*UploadFileResponse, error) {
+func (this *StorageClient) storageUploadSlaveByBuffer(ctx context.Context, tc *TrackerClient,
+	storeServ *StorageServer, fileBuffer []byte, prefixName string, remoteFileId string, fileExtName string) (*UploadFileResponse, error) {
 	bufferSize := len(fileBuffer)
 
-	return this.storageUploadFile(tc, storeServ, fileBuffer, int64(bufferSize), FDFS_UPLOAD_BY_BUFFER,
-		STORAGE_PROTO_CMD_UPLOAD_SLAVE_FILE, "", remoteFileId, fileExtName)
+	return this.storageUploadFile(ctx, tc, storeServ, fileBuffer, int64(bufferSize), FDFS_UPLOAD_BY_BUFFER,
+		STORAGE_PROTO_CMD_UPLOAD_SLAVE_FILE, remoteFileId, prefixName, fileExtName)
 }
 
-func (this *StorageClient) storageUploadAppenderByFilename(tc *TrackerClient,
+func (this *StorageClient) storageUploadAppenderByFilename(ctx context.Context, tc *TrackerClient,
 	storeServ *StorageServer, filename string) (*UploadFileResponse, error) {
 	fileInfo, err := os.Stat(filename)
 	if err != nil {
@@ -65,35 +108,41 @@ func (this *StorageClient) storageUploadAppenderByFilename(tc *TrackerClient,
 	fileSize := fileInfo.Size()
 	fileExtName := getFileExt(filename)
 
-	return this.storageUploadFile(tc, storeServ, filename, int64(fileSize), FDFS_UPLOAD_BY_FILENAME,
+	return this.storageUploadFile(ctx, tc, storeServ, filename, int64(fileSize), FDFS_UPLOAD_BY_FILENAME,
 		STORAGE_PROTO_CMD_UPLOAD_APPENDER_FILE, "", "", fileExtName)
 }
 
-func (this *StorageClient) storageUploadAppenderByBuffer(tc *TrackerClient,
+func (this *StorageClient) storageUploadAppenderByBuffer(ctx context.Context, tc *TrackerClient,
 	storeServ *StorageServer, fileBuffer []byte, fileExtName string) (*UploadFileResponse, error) {
 	bufferSize := len(fileBuffer)
 
-	return this.storageUploadFile(tc, storeServ, fileBuffer, int64(bufferSize), FDFS_UPLOAD_BY_BUFFER,
+	return this.storageUploadFile(ctx, tc, storeServ, fileBuffer, int64(bufferSize), FDFS_UPLOAD_BY_BUFFER,
 		STORAGE_PROTO_CMD_UPLOAD_APPENDER_FILE, "", "", fileExtName)
 }
 
-func (this *StorageClient) storageUploadFile(tc *TrackerClient,
+func (this *StorageClient) storageUploadFile(ctx context.Context, tc *TrackerClient,
 	storeServ *StorageServer, fileContent interface{}, fileSize int64, uploadType int,
-	cmd int8, masterFilename string, prefixName string, fileExtName string) (*UploadFileResponse, error) {
+	cmd int8, masterFilename string, prefixName string, fileExtName string) (ur *UploadFileResponse, err error) {
 
 	var (
 		conn        net.Conn
 		uploadSlave bool
 		headerLen   int64 = 15
 		reqBuf      []byte
-		err         error
 	)
 
-	conn, err = this.pool.Get()
+	defer func() { err = storageError(storeServ, cmd, err) }()
+
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+	conn, err = this.pool.GetContext(ctx)
 	if err != nil {
 		return nil, err
 	}
-	defer conn.Close()
+	defer logSlow(this.log, this.slowThreshold, "upload", conn.RemoteAddr().String(), time.Now())
+	// a cancelled upload leaves the connection mid-stream, never pool it
+	defer this.release(ctx, conn, &err)()
 
 	masterFilenameLen := int64(len(masterFilename))
 	if len(storeServ.groupName) > 0 && len(masterFilename) > 0 {
@@ -103,11 +152,14 @@ func (this *StorageClient) storageUploadFile(tc *TrackerClient,
 		headerLen = int64(38) + masterFilenameLen
 	}
 
+	start := time.Now()
 	th := &trackerHeader{}
 	th.pkgLen = headerLen
 	th.pkgLen += int64(fileSize)
 	th.cmd = cmd
-	th.sendHeader(conn)
+	if err = th.sendHeader(conn); err != nil {
+		return nil, err
+	}
 
 	if uploadSlave {
 		req := &uploadSlaveFileRequest{}
@@ -125,99 +177,140 @@ func (this *StorageClient) storageUploadFile(tc *TrackerClient,
 		reqBuf, err = req.marshal()
 	}
 	if err != nil {
-		logger.Warn.Println("uploadFileRequest.marshal error :%s", err.Error())
+		this.log.Warnf("uploadFileRequest.marshal error :%s", err.Error())
+		return nil, err
+	}
+	if err = TcpSendData(conn, reqBuf); err != nil {
 		return nil, err
 	}
-	TcpSendData(conn, reqBuf)
 
+	var w io.Writer = conn
+	if this.stallTimeout > 0 {
+		w = &stallWriter{ctx: ctx, conn: conn, timeout: this.stallTimeout}
+	}
+	if this.progress != nil {
+		w = &progressWriter{w: w, total: fileSize, fn: this.progress}
+	}
 	switch uploadType {
 	case FDFS_UPLOAD_BY_FILENAME:
 		if filename, ok := fileContent.(string); ok {
-			err = TcpSendFile(conn, filename)
+			err = sendFile(w, filename, fileSize)
 		}
-	case FDFS_DOWNLOAD_TO_BUFFER:
+	case FDFS_UPLOAD_BY_BUFFER:
 		if fileBuffer, ok := fileContent.([]byte); ok {
-			err = TcpSendData(conn, fileBuffer)
+			_, err = w.Write(fileBuffer)
+		}
+	case FDFS_UPLOAD_BY_READER:
+		if r, ok := fileContent.(io.Reader); ok {
+			// on a short read the connection is dropped, so the storage
+			// discards the partial file
+			err = sendContent(w, r, fileSize)
 		}
 	}
 	if err != nil {
-		logger.Warn.Println(err.Error())
+		this.log.Warnf("%v", err)
 		return nil, err
 	}
 
-	th.recvHeader(conn)
+	if err = th.recvHeader(conn); err != nil {
+		return nil, err
+	}
 	if th.status != 0 {
 		return nil, Errno{int(th.status)}
 	}
 	recvBuff, recvSize, err := TcpRecvResponse(conn, th.pkgLen)
+	if err != nil {
+		return nil, err
+	}
 	if recvSize <= int64(FDFS_GROUP_NAME_MAX_LEN) {
 		errmsg := "[-] Error: Storage response length is not match, "
 		errmsg += fmt.Sprintf("expect: %d, actual: %d", th.pkgLen, recvSize)
-		logger.Warn.Println(errmsg)
+		this.log.Warnf("%s", errmsg)
 		return nil, errors.New(errmsg)
 	}
-	ur := &UploadFileResponse{}
+	ur = &UploadFileResponse{}
 	err = ur.unmarshal(recvBuff)
 	if err != nil {
 		errmsg := fmt.Sprintf("recvBuf can not unmarshal :%s", err.Error())
-		logger.Warn.Println(errmsg)
+		this.log.Warnf("%s", errmsg)
 		return nil, errors.New(errmsg)
 	}
+	ur.UploadSize = fileSize
+	ur.Duration = time.Since(start)
 
 	return ur, nil
 }
 
-func (this *StorageClient) storageDeleteFile(tc *TrackerClient, storeServ *StorageServer, remoteFilename string) error {
+func (this *StorageClient) storageDeleteFile(ctx context.Context, tc *TrackerClient, storeServ *StorageServer, remoteFilename string) (err error) {
 	var (
 		conn   net.Conn
 		reqBuf []byte
-		err    error
 	)
 
-	conn, err = this.pool.Get()
-	defer conn.Close()
+	defer func() { err = storageError(storeServ, STORAGE_PROTO_CMD_DELETE_FILE, err) }()
+
+	conn, err = this.pool.GetContext(ctx)
 	if err != nil {
 		return err
 	}
+	defer logSlow(this.log, this.slowThreshold, "delete", conn.RemoteAddr().String(), time.Now())
+	defer this.release(ctx, conn, &err)()
 
 	th := &trackerHeader{}
 	th.cmd = STORAGE_PROTO_CMD_DELETE_FILE
 	fileNameLen := len(remoteFilename)
 	th.pkgLen = int64(FDFS_GROUP_NAME_MAX_LEN + fileNameLen)
-	th.sendHeader(conn)
+	if err = th.sendHeader(conn); err != nil {
+		return err
+	}
 
 	req := &deleteFileRequest{}
 	req.groupName = storeServ.groupName
 	req.remoteFilename = remoteFilename
 	reqBuf, err = req.marshal()
 	if err != nil {
-		logger.Warn.Println("deleteFileRequest.marshal error :%s", err.Error())
+		this.log.Warnf("deleteFileRequest.marshal error :%s", err.Error())
+		return err
+	}
+	if err = TcpSendData(conn, reqBuf); err != nil {
 		return err
 	}
-	TcpSendData(conn, reqBuf)
 
-	th.recvHeader(conn)
+	if err = th.recvHeader(conn); err != nil {
+		return err
+	}
 	if th.status != 0 {
 		return Errno{int(th.status)}
 	}
 	return nil
 }
 
-func (this *StorageClient) storageDownloadToFile(tc *TrackerClient,
+func (this *StorageClient) storageDownloadToFile(ctx context.Context, tc *TrackerClient,
 	storeServ *StorageServer, localFilename string, offset int64,
 	downloadSize int64, remoteFilename string) (*DownloadFileResponse, error) {
-	return this.storageDownloadFile(tc, storeServ, localFilename, offset, downloadSize, FDFS_DOWNLOAD_TO_FILE, remoteFilename)
+	return this.storageDownloadFile(ctx, tc, storeServ, localFilename, offset, downloadSize, FDFS_DOWNLOAD_TO_FILE, remoteFilename)
+}
+
+// storageDownloadToBuffer returns the content in the response's Content,
+// in a buffer sized to what the storage sends.
+func (this *StorageClient) storageDownloadToBuffer(ctx context.Context, tc *TrackerClient,
+	storeServ *StorageServer, offset int64,
+	downloadSize int64, remoteFilename string) (*DownloadFileResponse, error) {
+	return this.storageDownloadFile(ctx, tc, storeServ, nil, offset, downloadSize, FDFS_DOWNLOAD_TO_BUFFER, remoteFilename)
 }
 
-func (this *StorageClient) storageDownloadToBuffer(tc *TrackerClient,
-	storeServ *StorageServer, fileBuffer []byte, offset int64,
+// storageDownloadToWriter streams the file into w. If w fails, e.g. because
+// the consumer went away, copying stops right there, the storage connection
+// is closed rather than pooled mid-stream and w's error is returned.
+func (this *StorageClient) storageDownloadToWriter(ctx context.Context, tc *TrackerClient,
+	storeServ *StorageServer, w io.Writer, offset int64,
 	downloadSize int64, remoteFilename string) (*DownloadFileResponse, error) {
-	return this.storageDownloadFile(tc, storeServ, fileBuffer, offset, downloadSize, FDFS_DOWNLOAD_TO_BUFFER, remoteFilename)
+	return this.storageDownloadFile(ctx, tc, storeServ, w, offset, downloadSize, FDFS_DOWNLOAD_TO_WRITER, remoteFilename)
 }
 
-func (this *StorageClient) storageDownloadFile(tc *TrackerClient,
+func (this *StorageClient) storageDownloadFile(ctx context.Context, tc *TrackerClient,
 	storeServ *StorageServer, fileContent interface{}, offset int64, downloadSize int64,
-	downloadType int, remoteFilename string) (*DownloadFileResponse, error) {
+	downloadType int, remoteFilename string) (dr *DownloadFileResponse, err error) {
 
 	var (
 		conn          net.Conn
@@ -225,20 +318,32 @@ func (this *StorageClient) storageDownloadFile(tc *TrackerClient,
 		localFilename string
 		recvBuff      []byte
 		recvSize      int64
-		err           error
 	)
 
-	conn, err = this.pool.Get()
-	defer conn.Close()
+	defer func() { err = storageError(storeServ, STORAGE_PROTO_CMD_DOWNLOAD_FILE, err) }()
+
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+	conn, err = this.pool.GetContext(ctx)
 	if err != nil {
 		return nil, err
 	}
+	defer logSlow(this.log, this.slowThreshold, "download", conn.RemoteAddr().String(), time.Now())
+	defer this.release(ctx, conn, &err)()
 
+	start := time.Now()
 	th := &trackerHeader{}
 	th.cmd = STORAGE_PROTO_CMD_DOWNLOAD_FILE
 	th.pkgLen = int64(FDFS_PROTO_PKG_LEN_SIZE*2 + FDFS_GROUP_NAME_MAX_LEN + len(remoteFilename))
-	th.sendHeader(conn)
+	if err = th.sendHeader(conn); err != nil {
+		return nil, err
+	}
 
+	// the protocol reads a size of 0 as "up to the end of the file"
+	if downloadSize < 0 {
+		downloadSize = 0
+	}
 	req := &downloadFileRequest{}
 	req.offset = offset
 	req.downloadSize = downloadSize
@@ -246,44 +351,500 @@ func (this *StorageClient) storageDownloadFile(tc *TrackerClient,
 	req.remoteFilename = remoteFilename
 	reqBuf, err = req.marshal()
 	if err != nil {
-		logger.Warn.Println("downloadFileRequest.marshal error :%s", err.Error())
+		this.log.Warnf("downloadFileRequest.marshal error :%s", err.Error())
+		return nil, err
+	}
+	if err = TcpSendData(conn, reqBuf); err != nil {
 		return nil, err
 	}
-	TcpSendData(conn, reqBuf)
 
-	th.recvHeader(conn)
+	sent := time.Now()
+	if err = th.recvHeader(conn); err != nil {
+		return nil, err
+	}
+	if this.latency != nil {
+		this.latency.record(storeServ.ipAddr, time.Since(sent))
+	}
 	if th.status != 0 {
+		if th.status == einval && offset > 0 {
+			return nil, ErrOffsetBeyondEOF
+		}
 		return nil, Errno{int(th.status)}
 	}
+	if this.strictRange && th.pkgLen < downloadSize {
+		return nil, ErrRangeNotSatisfiable
+	}
 
+	body := conn
+	if this.progress != nil {
+		body = &progressConn{Conn: conn, total: th.pkgLen, fn: this.progress}
+	}
 	switch downloadType {
 	case FDFS_DOWNLOAD_TO_FILE:
 		if localFilename, ok := fileContent.(string); ok {
-			recvSize, err = TcpRecvFile(conn, localFilename, th.pkgLen)
+			recvSize, err = TcpRecvFile(body, localFilename, th.pkgLen)
 		}
 	case FDFS_DOWNLOAD_TO_BUFFER:
-		if _, ok := fileContent.([]byte); ok {
-			recvBuff, recvSize, err = TcpRecvResponse(conn, th.pkgLen)
+		if this.budget != nil {
+			// on failure the unread content makes releaseConn drop the
+			// connection
+			if err = this.budget.acquire(ctx, th.pkgLen); err != nil {
+				return nil, err
+			}
+			defer this.budget.release(th.pkgLen)
+		}
+		b := &fixedBuffer{buf: make([]byte, 0, th.pkgLen)}
+		recvSize, err = copyContent(b, body, th.pkgLen)
+		recvBuff = b.buf
+	case FDFS_DOWNLOAD_TO_WRITER:
+		if w, ok := fileContent.(io.Writer); ok {
+			recvSize, err = copyContent(w, body, th.pkgLen)
 		}
 	}
 	if err != nil {
-		logger.Warn.Println(err.Error())
+		this.log.Warnf("%v", err)
 		return nil, err
 	}
-	if recvSize < downloadSize {
+	if recvSize < th.pkgLen {
 		errmsg := "[-] Error: Storage response length is not match, "
 		errmsg += fmt.Sprintf("expect: %d, actual: %d", th.pkgLen, recvSize)
-		logger.Warn.Println(errmsg)
+		this.log.Warnf("%s", errmsg)
 		return nil, errors.New(errmsg)
 	}
 
-	dr := &DownloadFileResponse{}
+	dr = &DownloadFileResponse{}
 	dr.RemoteFileId = storeServ.groupName + string(os.PathSeparator) + remoteFilename
-	if downloadType == FDFS_DOWNLOAD_TO_FILE {
+	switch downloadType {
+	case FDFS_DOWNLOAD_TO_FILE:
 		dr.Content = localFilename
-	} else {
+	case FDFS_DOWNLOAD_TO_BUFFER:
 		dr.Content = recvBuff
 	}
 	dr.DownloadSize = recvSize
+	dr.Duration = time.Since(start)
 	return dr, nil
 }
+
+// sendContent sends exactly size bytes read from r, in chunks.
+func sendContent(w io.Writer, r io.Reader, size int64) error {
+	bp := chunkBufPool.Get().(*[]byte)
+	defer chunkBufPool.Put(bp)
+	n, err := io.CopyBuffer(w, io.LimitReader(r, size), *bp)
+	if err == nil && n < size {
+		err = fmt.Errorf("%w: got %d of %d bytes", ErrShortUpload, n, size)
+	}
+	return err
+}
+
+// copyContent copies the n bytes of content following a response header
+// from conn to w, chunk by chunk.
+func copyContent(w io.Writer, conn io.Reader, n int64) (int64, error) {
+	written, err := io.CopyN(w, conn, n)
+	if err == io.EOF {
+		err = fmt.Errorf("connection closed after %d of %d bytes: %w", written, n, io.ErrUnexpectedEOF)
+	}
+	return written, err
+}
+
+// fixedBuffer collects content into buf without ever growing it, so a
+// download holds no more memory than the content size it announced.
+type fixedBuffer struct {
+	buf []byte
+}
+
+func (this *fixedBuffer) Write(p []byte) (int, error) {
+	if len(p) > cap(this.buf)-len(this.buf) {
+		return 0, io.ErrShortWrite
+	}
+	this.buf = append(this.buf, p...)
+	return len(p), nil
+}
+
+func (this *StorageClient) storageTruncateFile(ctx context.Context, tc *TrackerClient,
+	storeServ *StorageServer, appenderFilename string, truncatedFileSize int64) (err error) {
+	var (
+		conn   net.Conn
+		reqBuf []byte
+	)
+
+	defer func() { err = storageError(storeServ, STORAGE_PROTO_CMD_TRUNCATE_FILE, err) }()
+
+	conn, err = this.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer logSlow(this.log, this.slowThreshold, "truncate", conn.RemoteAddr().String(), time.Now())
+	defer this.release(ctx, conn, &err)()
+
+	req := &truncateFileRequest{}
+	req.appenderFilename = appenderFilename
+	req.truncatedFileSize = truncatedFileSize
+	reqBuf, err = req.marshal()
+	if err != nil {
+		this.log.Warnf("truncateFileRequest.marshal error :%s", err.Error())
+		return err
+	}
+
+	th := &trackerHeader{}
+	th.cmd = STORAGE_PROTO_CMD_TRUNCATE_FILE
+	th.pkgLen = int64(len(reqBuf))
+	if err = th.sendHeader(conn); err != nil {
+		return err
+	}
+	if err = TcpSendData(conn, reqBuf); err != nil {
+		return err
+	}
+
+	if err = th.recvHeader(conn); err != nil {
+		return err
+	}
+	if th.status != 0 {
+		return Errno{int(th.status)}
+	}
+	return nil
+}
+
+// storageRegenerateAppenderFile turns an appender file into a normal file
+// under a newly generated name, which is returned.
+func (this *StorageClient) storageRegenerateAppenderFile(ctx context.Context, tc *TrackerClient,
+	storeServ *StorageServer, appenderFilename string) (ur *UploadFileResponse, err error) {
+	var (
+		conn     net.Conn
+		recvBuff []byte
+	)
+
+	defer func() { err = storageError(storeServ, STORAGE_PROTO_CMD_REGENERATE_APPENDER_FILENAME, err) }()
+
+	conn, err = this.pool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer logSlow(this.log, this.slowThreshold, "regenerate", conn.RemoteAddr().String(), time.Now())
+	defer this.release(ctx, conn, &err)()
+
+	// #regenerate_fmt: |-appender_filename(len)-|
+	th := &trackerHeader{}
+	th.cmd = STORAGE_PROTO_CMD_REGENERATE_APPENDER_FILENAME
+	th.pkgLen = int64(len(appenderFilename))
+	if err = th.sendHeader(conn); err != nil {
+		return nil, err
+	}
+	if err = TcpSendData(conn, []byte(appenderFilename)); err != nil {
+		return nil, err
+	}
+
+	if err = th.recvHeader(conn); err != nil {
+		return nil, err
+	}
+	if th.status != 0 {
+		return nil, Errno{int(th.status)}
+	}
+	recvBuff, _, err = TcpRecvResponse(conn, th.pkgLen)
+	if err != nil {
+		return nil, err
+	}
+	if len(recvBuff) <= FDFS_GROUP_NAME_MAX_LEN {
+		return nil, fmt.Errorf("regenerate response length %d is invalid", len(recvBuff))
+	}
+	ur = &UploadFileResponse{}
+	if err = ur.unmarshal(recvBuff); err != nil {
+		return nil, err
+	}
+	return ur, nil
+}
+
+// storageAppendFile appends size bytes read from r to the appender file.
+func (this *StorageClient) storageAppendFile(ctx context.Context, tc *TrackerClient,
+	storeServ *StorageServer, appenderFilename string, r io.Reader, size int64) (err error) {
+	var (
+		conn   net.Conn
+		reqBuf []byte
+	)
+
+	defer func() { err = storageError(storeServ, STORAGE_PROTO_CMD_APPEND_FILE, err) }()
+
+	conn, err = this.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer logSlow(this.log, this.slowThreshold, "append", conn.RemoteAddr().String(), time.Now())
+	defer this.release(ctx, conn, &err)()
+
+	req := &appendFileRequest{}
+	req.appenderFilename = appenderFilename
+	req.fileSize = size
+	reqBuf, err = req.marshal()
+	if err != nil {
+		this.log.Warnf("appendFileRequest.marshal error :%s", err.Error())
+		return err
+	}
+
+	th := &trackerHeader{}
+	th.cmd = STORAGE_PROTO_CMD_APPEND_FILE
+	th.pkgLen = int64(len(reqBuf)) + req.fileSize
+	if err = th.sendHeader(conn); err != nil {
+		return err
+	}
+	if err = TcpSendData(conn, reqBuf); err != nil {
+		return err
+	}
+	if err = sendContent(conn, r, size); err != nil {
+		return err
+	}
+
+	if err = th.recvHeader(conn); err != nil {
+		return err
+	}
+	if th.status != 0 {
+		return Errno{int(th.status)}
+	}
+	return nil
+}
+
+// storageModifyFile overwrites size bytes of the appender file at
+// fileOffset with bytes read from r.
+func (this *StorageClient) storageModifyFile(ctx context.Context, tc *TrackerClient,
+	storeServ *StorageServer, appenderFilename string, fileOffset int64, r io.Reader, size int64) (err error) {
+	var (
+		conn   net.Conn
+		reqBuf []byte
+	)
+
+	defer func() { err = storageError(storeServ, STORAGE_PROTO_CMD_MODIFY_FILE, err) }()
+
+	conn, err = this.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer logSlow(this.log, this.slowThreshold, "modify", conn.RemoteAddr().String(), time.Now())
+	defer this.release(ctx, conn, &err)()
+
+	req := &modifyFileRequest{}
+	req.appenderFilename = appenderFilename
+	req.fileOffset = fileOffset
+	req.fileSize = size
+	reqBuf, err = req.marshal()
+	if err != nil {
+		this.log.Warnf("modifyFileRequest.marshal error :%s", err.Error())
+		return err
+	}
+
+	th := &trackerHeader{}
+	th.cmd = STORAGE_PROTO_CMD_MODIFY_FILE
+	th.pkgLen = int64(len(reqBuf)) + req.fileSize
+	if err = th.sendHeader(conn); err != nil {
+		return err
+	}
+	if err = TcpSendData(conn, reqBuf); err != nil {
+		return err
+	}
+	if err = sendContent(conn, r, size); err != nil {
+		return err
+	}
+
+	if err = th.recvHeader(conn); err != nil {
+		return err
+	}
+	if th.status != 0 {
+		return Errno{int(th.status)}
+	}
+	return nil
+}
+
+func (this *StorageClient) storageSetMetadata(tc *TrackerClient, storeServ *StorageServer,
+	remoteFilename string, meta map[string]string, flag byte) (err error) {
+	var conn net.Conn
+
+	defer func() { err = storageError(storeServ, STORAGE_PROTO_CMD_SET_METADATA, err) }()
+
+	conn, err = this.pool.Get()
+	if err != nil {
+		return err
+	}
+	defer logSlow(this.log, this.slowThreshold, "set metadata", conn.RemoteAddr().String(), time.Now())
+	defer func() { releaseConn(conn, err) }()
+
+	return setMetadataOnConn(conn, storeServ.groupName, remoteFilename, meta, flag)
+}
+
+func (this *StorageClient) storageGetMetadata(tc *TrackerClient, storeServ *StorageServer,
+	remoteFilename string) (meta map[string]string, err error) {
+	var (
+		conn     net.Conn
+		reqBuf   []byte
+		recvBuff []byte
+	)
+
+	defer func() { err = storageError(storeServ, STORAGE_PROTO_CMD_GET_METADATA, err) }()
+
+	conn, err = this.pool.Get()
+	if err != nil {
+		return nil, err
+	}
+	defer logSlow(this.log, this.slowThreshold, "get metadata", conn.RemoteAddr().String(), time.Now())
+	defer func() { releaseConn(conn, err) }()
+
+	// same |-group_name(16)-filename(len)-| body as delete
+	req := &deleteFileRequest{}
+	req.groupName = storeServ.groupName
+	req.remoteFilename = remoteFilename
+	reqBuf, err = req.marshal()
+	if err != nil {
+		this.log.Warnf("deleteFileRequest.marshal error :%s", err.Error())
+		return nil, err
+	}
+
+	th := &trackerHeader{}
+	th.cmd = STORAGE_PROTO_CMD_GET_METADATA
+	th.pkgLen = int64(len(reqBuf))
+	if err = th.sendHeader(conn); err != nil {
+		return nil, err
+	}
+	if err = TcpSendData(conn, reqBuf); err != nil {
+		return nil, err
+	}
+
+	if err = th.recvHeader(conn); err != nil {
+		return nil, err
+	}
+	if th.status != 0 {
+		return nil, Errno{int(th.status)}
+	}
+	if th.pkgLen == 0 {
+		return unmarshalMetadata(nil), nil
+	}
+	recvBuff, _, err = TcpRecvResponse(conn, th.pkgLen)
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalMetadata(recvBuff), nil
+}
+
+// setMetadataOnConn runs SET_METADATA on a connection the caller owns, so a
+// batch of updates to one storage can share a single connection.
+func setMetadataOnConn(conn net.Conn, groupName string, remoteFilename string,
+	meta map[string]string, flag byte) error {
+	req := &setMetadataRequest{}
+	req.groupName = groupName
+	req.remoteFilename = remoteFilename
+	req.meta = marshalMetadata(meta)
+	req.flag = flag
+	reqBuf, err := req.marshal()
+	if err != nil {
+		return err
+	}
+
+	th := &trackerHeader{}
+	th.cmd = STORAGE_PROTO_CMD_SET_METADATA
+	th.pkgLen = int64(len(reqBuf))
+	if err = th.sendHeader(conn); err != nil {
+		return err
+	}
+	if err = TcpSendData(conn, reqBuf); err != nil {
+		return err
+	}
+
+	if err = th.recvHeader(conn); err != nil {
+		return err
+	}
+	if th.status != 0 {
+		return Errno{int(th.status)}
+	}
+	return nil
+}
+
+func (this *StorageClient) storageQueryFileInfo(ctx context.Context, tc *TrackerClient,
+	storeServ *StorageServer, remoteFilename string) (info *FileInfo, err error) {
+	var (
+		conn     net.Conn
+		reqBuf   []byte
+		recvBuff []byte
+	)
+
+	defer func() { err = storageError(storeServ, STORAGE_PROTO_CMD_QUERY_FILE_INFO, err) }()
+
+	conn, err = this.pool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer logSlow(this.log, this.slowThreshold, "query file info", conn.RemoteAddr().String(), time.Now())
+	defer this.release(ctx, conn, &err)()
+
+	// same |-group_name(16)-filename(len)-| body as delete
+	req := &deleteFileRequest{}
+	req.groupName = storeServ.groupName
+	req.remoteFilename = remoteFilename
+	reqBuf, err = req.marshal()
+	if err != nil {
+		this.log.Warnf("deleteFileRequest.marshal error :%s", err.Error())
+		return nil, err
+	}
+
+	th := &trackerHeader{}
+	th.cmd = STORAGE_PROTO_CMD_QUERY_FILE_INFO
+	th.pkgLen = int64(len(reqBuf))
+	if err = th.sendHeader(conn); err != nil {
+		return nil, err
+	}
+	if err = TcpSendData(conn, reqBuf); err != nil {
+		return nil, err
+	}
+
+	if err = th.recvHeader(conn); err != nil {
+		return nil, err
+	}
+	if th.status != 0 {
+		return nil, Errno{int(th.status)}
+	}
+	recvBuff, _, err = TcpRecvResponse(conn, th.pkgLen)
+	if err != nil {
+		return nil, err
+	}
+
+	info = &FileInfo{}
+	if err = info.unmarshal(recvBuff); err != nil {
+		return nil, err
+	}
+	if meta, err := DecodeFileIdMeta(storeServ.groupName + "/" + remoteFilename); err == nil {
+		info.Trunk = meta.Trunk
+	}
+	return info, nil
+}
+
+// downloadRangeOnConn starts a download of downloadSize bytes at offset on
+// a connection the caller owns and returns the length of the content that
+// follows on conn, which the caller has to read completely before reusing
+// the connection.
+func downloadRangeOnConn(conn net.Conn, groupName string, remoteFilename string,
+	offset int64, downloadSize int64) (int64, error) {
+	req := &downloadFileRequest{}
+	req.offset = offset
+	req.downloadSize = downloadSize
+	req.groupName = groupName
+	req.remoteFilename = remoteFilename
+	reqBuf, err := req.marshal()
+	if err != nil {
+		return 0, err
+	}
+
+	th := &trackerHeader{}
+	th.cmd = STORAGE_PROTO_CMD_DOWNLOAD_FILE
+	th.pkgLen = int64(len(reqBuf))
+	if err = th.sendHeader(conn); err != nil {
+		return 0, err
+	}
+	if err = TcpSendData(conn, reqBuf); err != nil {
+		return 0, err
+	}
+
+	if err = th.recvHeader(conn); err != nil {
+		return 0, err
+	}
+	if th.status != 0 {
+		if th.status == einval && offset > 0 {
+			return 0, ErrOffsetBeyondEOF
+		}
+		return 0, Errno{int(th.status)}
+	}
+	return th.pkgLen, nil
+}
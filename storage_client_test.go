@@ -0,0 +1,47 @@
+package fastdfs
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+)
+
+// The allocations reported include those of the fake storage, which reads
+// every request into a new buffer.
+func BenchmarkUploadByBuffer(b *testing.B) {
+	for _, size := range []int{1 << 10, 64 << 10, 1 << 20} {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			c := newFakeCluster(b)
+			defer c.close()
+			c.storage.discardFiles()
+			client := c.client(b, nil)
+			buffer := make([]byte, size)
+
+			b.ReportAllocs()
+			b.SetBytes(int64(size))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := client.UploadByBuffer(buffer, "bin"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkUploadByReader(b *testing.B) {
+	c := newFakeCluster(b)
+	defer c.close()
+	c.storage.discardFiles()
+	client := c.client(b, nil)
+	buffer := make([]byte, 1<<20)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(buffer)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := client.UploadByReader(bytes.NewReader(buffer), int64(len(buffer)), "bin"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package fastdfs
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGenerateToken(t *testing.T) {
+	tests := []struct {
+		remoteFilename string
+		secretKey      string
+		timestamp      int64
+		want           string
+		wantErr        bool
+	}{
+		// md5 of the file name, the key and the decimal timestamp, as
+		// fdfs_http_gen_token computes it
+		{"M00/00/00/wKgAAV7gKXuAQrDTAAAAB1Z4YlU123.jpg", "FastDFS1234567890", 1600000000,
+			"27cac87784a5ea1fb9f2751b3bfd9846", false},
+		{"M00/00/00/wKgAAV7gKXuAQrDTAAAAB1Z4YlU123.jpg", "FastDFS1234567890", 1600000001,
+			"119e22496bd1699c10206823f1d658f6", false},
+		{"M01/0A/FF/CgAAAl9Uy8CAZ2xRAAAAAAAAAAA.txt", "secret", 0,
+			"9c38553d930e110ffb6c2dfbdf1b07ec", false},
+		{"", "secret", 0, "", true},
+		{"M00/00/00/wKgAAV7gKXuAQrDTAAAAB1Z4YlU123.jpg", "", 0, "", true},
+		{"M00/00/00/wKgAAV7gKXuAQrDTAAAAB1Z4YlU123.jpg", strings.Repeat("k", 300), 0, "", true},
+	}
+	for _, tt := range tests {
+		got, err := GenerateToken(tt.remoteFilename, tt.secretKey, tt.timestamp)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("GenerateToken(%q, %q, %d) = %q, %v, want %q, failure %v",
+				tt.remoteFilename, tt.secretKey, tt.timestamp, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestBuildDownloadURL(t *testing.T) {
+	tests := []struct {
+		baseURL string
+		ttl     time.Duration
+	}{
+		{"http://img.example.com", time.Hour},
+		{"http://img.example.com/", 0},
+		{"https://img.example.com:8443/fdfs//", 10 * time.Minute},
+	}
+	for _, tt := range tests {
+		before := time.Now().Add(tt.ttl).Unix()
+		got, err := BuildDownloadURL(tt.baseURL, testMasterFileId, "FastDFS1234567890", tt.ttl)
+		after := time.Now().Add(tt.ttl).Unix()
+		if err != nil {
+			t.Fatalf("BuildDownloadURL(%q) error = %v", tt.baseURL, err)
+		}
+
+		prefix := strings.TrimRight(tt.baseURL, "/") + "/" + testMasterFileId + "?"
+		if !strings.HasPrefix(got, prefix) {
+			t.Fatalf("BuildDownloadURL(%q) = %q, want it to start with %q", tt.baseURL, got, prefix)
+		}
+		query, err := url.ParseQuery(strings.TrimPrefix(got, prefix))
+		if err != nil {
+			t.Fatalf("BuildDownloadURL(%q) = %q: %v", tt.baseURL, got, err)
+		}
+		ts, err := strconv.ParseInt(query.Get("ts"), 10, 64)
+		if err != nil || ts < before || ts > after {
+			t.Errorf("BuildDownloadURL(%q) ts = %q, want between %d and %d", tt.baseURL, query.Get("ts"), before, after)
+		}
+		want, _ := GenerateToken(strings.TrimPrefix(testMasterFileId, "group1/"), "FastDFS1234567890", ts)
+		if query.Get("token") != want {
+			t.Errorf("BuildDownloadURL(%q) token = %q, want %q", tt.baseURL, query.Get("token"), want)
+		}
+	}
+
+	if _, err := BuildDownloadURL("http://img.example.com", "not-a-file-id", "key", time.Hour); err == nil {
+		t.Error("BuildDownloadURL() of an invalid file id succeeded")
+	}
+}
@@ -2,74 +2,107 @@ package fastdfs
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"net"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type TrackerClient struct {
-	pool *ConnectionPool
+	pool          *ConnectionPool
+	slowThreshold time.Duration
+	// ctx bounds every query, nil means no limit
+	ctx context.Context
+	log Logger
 }
 
-func (this *TrackerClient) trackerQueryStorageStorWithoutGroup() (*StorageServer, error) {
+func (this *TrackerClient) context() context.Context {
+	if this.ctx == nil {
+		return context.Background()
+	}
+	return this.ctx
+}
+
+// release ties conn to the client's context and returns the func to defer
+// to give conn back: a cancelled query reports the context's error, and
+// connections of failed or cancelled queries aren't pooled again.
+func (this *TrackerClient) release(conn net.Conn, err *error) func() {
+	ctx := this.context()
+	stop := watchConn(ctx, conn)
+	return func() {
+		if stop() {
+			if *err != nil {
+				*err = ctx.Err()
+			}
+			if pc, ok := conn.(*pConn); ok {
+				pc.MarkUnusable()
+			}
+		}
+		releaseConn(conn, *err)
+	}
+}
+
+func (this *TrackerClient) trackerQueryStorageStorWithoutGroup() (storeServ *StorageServer, err error) {
 	var (
 		conn     net.Conn
 		recvBuff []byte
-		err      error
 	)
 
-	conn, err = this.pool.Get()
+	defer func() { err = trackerError(conn, TRACKER_PROTO_CMD_SERVICE_QUERY_STORE_WITHOUT_GROUP_ONE, err) }()
+
+	conn, err = this.pool.GetContext(this.context())
 	if err != nil {
 		return nil, err
 	}
-	defer conn.Close()
+	defer logSlow(this.log, this.slowThreshold, "query store", conn.RemoteAddr().String(), time.Now())
+	defer this.release(conn, &err)()
 
 	th := &trackerHeader{}
 	th.cmd = TRACKER_PROTO_CMD_SERVICE_QUERY_STORE_WITHOUT_GROUP_ONE
-	th.sendHeader(conn)
+	if err = th.sendHeader(conn); err != nil {
+		return nil, err
+	}
 
-	th.recvHeader(conn)
+	if err = th.recvHeader(conn); err != nil {
+		return nil, err
+	}
 	if th.status != 0 {
 		return nil, Errno{int(th.status)}
 	}
 
-	var (
-		groupName      string
-		ipAddr         string
-		port           int64
-		storePathIndex uint8
-	)
 	recvBuff, _, err = TcpRecvResponse(conn, th.pkgLen)
 	if err != nil {
-		logger.Warn.Println("TcpRecvResponse error :%s", err.Error())
+		this.log.Warnf("TcpRecvResponse error :%s", err.Error())
 		return nil, err
 	}
-	buff := bytes.NewBuffer(recvBuff)
-	// #recv_fmt |-group_name(16)-ipaddr(16-1)-port(8)-store_path_index(1)|
-	groupName, err = readCstr(buff, FDFS_GROUP_NAME_MAX_LEN)
-	ipAddr, err = readCstr(buff, IP_ADDRESS_SIZE-1)
-	binary.Read(buff, binary.BigEndian, &port)
-	binary.Read(buff, binary.BigEndian, &storePathIndex)
-	return &StorageServer{fmt.Sprintf("%s:%d", ipAddr, port), groupName, int(storePathIndex)}, nil
+	return parseStoreBody(recvBuff)
 }
 
-func (this *TrackerClient) trackerQueryStorageStorWithGroup(groupName string) (*StorageServer, error) {
+func (this *TrackerClient) trackerQueryStorageStorWithGroup(groupName string) (storeServ *StorageServer, err error) {
 	var (
 		conn     net.Conn
 		recvBuff []byte
-		err      error
 	)
 
-	conn, err = this.pool.Get()
-	defer conn.Close()
+	defer func() { err = trackerError(conn, TRACKER_PROTO_CMD_SERVICE_QUERY_STORE_WITH_GROUP_ONE, err) }()
+
+	conn, err = this.pool.GetContext(this.context())
 	if err != nil {
 		return nil, err
 	}
+	defer logSlow(this.log, this.slowThreshold, "query store", conn.RemoteAddr().String(), time.Now())
+	defer this.release(conn, &err)()
 
 	th := &trackerHeader{}
 	th.cmd = TRACKER_PROTO_CMD_SERVICE_QUERY_STORE_WITH_GROUP_ONE
 	th.pkgLen = int64(FDFS_GROUP_NAME_MAX_LEN)
-	th.sendHeader(conn)
+	if err = th.sendHeader(conn); err != nil {
+		return nil, err
+	}
 
 	groupBuffer := new(bytes.Buffer)
 	// 16 bit groupName
@@ -88,29 +121,20 @@ func (this *TrackerClient) trackerQueryStorageStorWithGroup(groupName string) (*
 		return nil, err
 	}
 
-	th.recvHeader(conn)
+	if err = th.recvHeader(conn); err != nil {
+		return nil, err
+	}
 	if th.status != 0 {
-		logger.Warn.Println("recvHeader error [%d]", th.status)
+		this.log.Warnf("recvHeader error [%d]", th.status)
 		return nil, Errno{int(th.status)}
 	}
 
-	var (
-		ipAddr         string
-		port           int64
-		storePathIndex uint8
-	)
 	recvBuff, _, err = TcpRecvResponse(conn, th.pkgLen)
 	if err != nil {
-		logger.Warn.Println("TcpRecvResponse error :%s", err.Error())
+		this.log.Warnf("TcpRecvResponse error :%s", err.Error())
 		return nil, err
 	}
-	buff := bytes.NewBuffer(recvBuff)
-	// #recv_fmt |-group_name(16)-ipaddr(16-1)-port(8)-store_path_index(1)|
-	groupName, err = readCstr(buff, FDFS_GROUP_NAME_MAX_LEN)
-	ipAddr, err = readCstr(buff, IP_ADDRESS_SIZE-1)
-	binary.Read(buff, binary.BigEndian, &port)
-	binary.Read(buff, binary.BigEndian, &storePathIndex)
-	return &StorageServer{fmt.Sprintf("%s:%d", ipAddr, port), groupName, int(storePathIndex)}, nil
+	return parseStoreBody(recvBuff)
 }
 
 func (this *TrackerClient) trackerQueryStorageUpdate(groupName string, remoteFilename string) (*StorageServer, error) {
@@ -121,23 +145,27 @@ func (this *TrackerClient) trackerQueryStorageFetch(groupName string, remoteFile
 	return this.trackerQueryStorage(groupName, remoteFilename, TRACKER_PROTO_CMD_SERVICE_QUERY_FETCH_ONE)
 }
 
-func (this *TrackerClient) trackerQueryStorage(groupName string, remoteFilename string, cmd int8) (*StorageServer, error) {
+func (this *TrackerClient) trackerQueryStorage(groupName string, remoteFilename string, cmd int8) (storeServ *StorageServer, err error) {
 	var (
 		conn     net.Conn
 		recvBuff []byte
-		err      error
 	)
 
-	conn, err = this.pool.Get()
-	defer conn.Close()
+	defer func() { err = trackerError(conn, cmd, err) }()
+
+	conn, err = this.pool.GetContext(this.context())
 	if err != nil {
 		return nil, err
 	}
+	defer logSlow(this.log, this.slowThreshold, "query storage", conn.RemoteAddr().String(), time.Now())
+	defer this.release(conn, &err)()
 
 	th := &trackerHeader{}
 	th.pkgLen = int64(FDFS_GROUP_NAME_MAX_LEN + len(remoteFilename))
 	th.cmd = cmd
-	th.sendHeader(conn)
+	if err = th.sendHeader(conn); err != nil {
+		return nil, err
+	}
 
 	// #query_fmt: |-group_name(16)-filename(file_name_len)-|
 	queryBuffer := new(bytes.Buffer)
@@ -160,27 +188,338 @@ func (this *TrackerClient) trackerQueryStorage(groupName string, remoteFilename
 		return nil, err
 	}
 
-	th.recvHeader(conn)
+	if err = th.recvHeader(conn); err != nil {
+		return nil, err
+	}
 	if th.status != 0 {
-		logger.Warn.Println("recvHeader error [%d]", th.status)
+		this.log.Warnf("recvHeader error [%d]", th.status)
 		return nil, Errno{int(th.status)}
 	}
 
+	recvBuff, _, err = TcpRecvResponse(conn, th.pkgLen)
+	if err != nil {
+		this.log.Warnf("TcpRecvResponse error :%s", err.Error())
+		return nil, err
+	}
+	return parseStoreBody(recvBuff)
+}
+
+func (this *TrackerClient) trackerListGroups() (stats []GroupStat, err error) {
 	var (
-		ipAddr         string
-		port           int64
-		storePathIndex uint8
+		conn     net.Conn
+		recvBuff []byte
 	)
+
+	defer func() { err = trackerError(conn, TRACKER_PROTO_CMD_SERVER_LIST_ALL_GROUPS, err) }()
+
+	conn, err = this.pool.GetContext(this.context())
+	if err != nil {
+		return nil, err
+	}
+	defer logSlow(this.log, this.slowThreshold, "list groups", conn.RemoteAddr().String(), time.Now())
+	defer this.release(conn, &err)()
+
+	th := &trackerHeader{}
+	th.cmd = TRACKER_PROTO_CMD_SERVER_LIST_ALL_GROUPS
+	if err = th.sendHeader(conn); err != nil {
+		return nil, err
+	}
+
+	if err = th.recvHeader(conn); err != nil {
+		return nil, err
+	}
+	if th.status != 0 {
+		this.log.Warnf("recvHeader error [%d]", th.status)
+		return nil, Errno{int(th.status)}
+	}
+
 	recvBuff, _, err = TcpRecvResponse(conn, th.pkgLen)
 	if err != nil {
-		logger.Warn.Println("TcpRecvResponse error :%s", err.Error())
+		this.log.Warnf("TcpRecvResponse error :%s", err.Error())
+		return nil, err
+	}
+	if len(recvBuff)%TRACKER_GROUP_STAT_LEN != 0 {
+		return nil, fmt.Errorf("group stat response length %d is not a multiple of %d",
+			len(recvBuff), TRACKER_GROUP_STAT_LEN)
+	}
+
+	groups := make([]GroupStat, len(recvBuff)/TRACKER_GROUP_STAT_LEN)
+	for i := range groups {
+		data := recvBuff[i*TRACKER_GROUP_STAT_LEN : (i+1)*TRACKER_GROUP_STAT_LEN]
+		if err = groups[i].unmarshal(data); err != nil {
+			return nil, err
+		}
+	}
+	return groups, nil
+}
+
+// trackerQueryStorageFetchAll returns every storage that can serve the file,
+// the one the tracker would pick first.
+func (this *TrackerClient) trackerQueryStorageFetchAll(groupName string, remoteFilename string) (servers []*StorageServer, err error) {
+	var (
+		conn     net.Conn
+		recvBuff []byte
+	)
+
+	defer func() { err = trackerError(conn, TRACKER_PROTO_CMD_SERVICE_QUERY_FETCH_ALL, err) }()
+
+	conn, err = this.pool.GetContext(this.context())
+	if err != nil {
 		return nil, err
 	}
+	defer logSlow(this.log, this.slowThreshold, "query fetch all", conn.RemoteAddr().String(), time.Now())
+	defer this.release(conn, &err)()
+
+	th := &trackerHeader{}
+	th.pkgLen = int64(FDFS_GROUP_NAME_MAX_LEN + len(remoteFilename))
+	th.cmd = TRACKER_PROTO_CMD_SERVICE_QUERY_FETCH_ALL
+	if err = th.sendHeader(conn); err != nil {
+		return nil, err
+	}
+
+	// #query_fmt: |-group_name(16)-filename(file_name_len)-|
+	queryBuffer := new(bytes.Buffer)
+	groupNameBytes := bytes.NewBufferString(groupName).Bytes()
+	for i := 0; i < 16; i++ {
+		if i >= len(groupNameBytes) {
+			queryBuffer.WriteByte(byte(0))
+		} else {
+			queryBuffer.WriteByte(groupNameBytes[i])
+		}
+	}
+	queryBuffer.WriteString(remoteFilename)
+	err = TcpSendData(conn, queryBuffer.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	if err = th.recvHeader(conn); err != nil {
+		return nil, err
+	}
+	if th.status != 0 {
+		this.log.Warnf("recvHeader error [%d]", th.status)
+		return nil, Errno{int(th.status)}
+	}
+
+	recvBuff, _, err = TcpRecvResponse(conn, th.pkgLen)
+	if err != nil {
+		this.log.Warnf("TcpRecvResponse error :%s", err.Error())
+		return nil, err
+	}
+	// #recv_fmt |-group_name(16)-ipaddr(16-1)-port(8)-ipaddr(16-1)*n-|
+	if len(recvBuff) < TRACKER_QUERY_STORAGE_FETCH_BODY_LEN ||
+		(len(recvBuff)-TRACKER_QUERY_STORAGE_FETCH_BODY_LEN)%(IP_ADDRESS_SIZE-1) != 0 {
+		return nil, fmt.Errorf("fetch all response length %d is invalid", len(recvBuff))
+	}
+
+	var (
+		ipAddr string
+		port   int64
+	)
 	buff := bytes.NewBuffer(recvBuff)
+	if groupName, err = readCstr(buff, FDFS_GROUP_NAME_MAX_LEN); err != nil {
+		return nil, err
+	}
+	if ipAddr, err = readStorageIp(buff); err != nil {
+		return nil, err
+	}
+	binary.Read(buff, binary.BigEndian, &port)
+
+	storeServs := []*StorageServer{{storageAddr(ipAddr, port), groupName, 0}}
+	for buff.Len() > 0 {
+		if ipAddr, err = readStorageIp(buff); err != nil {
+			return nil, err
+		}
+		storeServs = append(storeServs, &StorageServer{storageAddr(ipAddr, port), groupName, 0})
+	}
+	return storeServs, nil
+}
+
+// trackerListStorages lists the storages of groupName, or only the one
+// with storageId (its id or ip address) if that isn't empty.
+func (this *TrackerClient) trackerListStorages(groupName string, storageId string) (stats []StorageStat, err error) {
+	var (
+		conn     net.Conn
+		recvBuff []byte
+	)
+
+	defer func() { err = trackerError(conn, TRACKER_PROTO_CMD_SERVER_LIST_STORAGE, err) }()
+
+	conn, err = this.pool.GetContext(this.context())
+	if err != nil {
+		return nil, err
+	}
+	defer logSlow(this.log, this.slowThreshold, "list storages", conn.RemoteAddr().String(), time.Now())
+	defer this.release(conn, &err)()
+
+	// #list_fmt: |-group_name(16)-storage_id(up to 15, optional)-|
+	queryBuffer := new(bytes.Buffer)
+	groupNameBytes := bytes.NewBufferString(groupName).Bytes()
+	for i := 0; i < FDFS_GROUP_NAME_MAX_LEN; i++ {
+		if i >= len(groupNameBytes) {
+			queryBuffer.WriteByte(byte(0))
+		} else {
+			queryBuffer.WriteByte(groupNameBytes[i])
+		}
+	}
+	// the tracker only accepts a body shorter than group and a padded id
+	if len(storageId) >= FDFS_STORAGE_ID_MAX_SIZE {
+		storageId = storageId[:FDFS_STORAGE_ID_MAX_SIZE-1]
+	}
+	queryBuffer.WriteString(storageId)
+
+	th := &trackerHeader{}
+	th.pkgLen = int64(queryBuffer.Len())
+	th.cmd = TRACKER_PROTO_CMD_SERVER_LIST_STORAGE
+	if err = th.sendHeader(conn); err != nil {
+		return nil, err
+	}
+	if err = TcpSendData(conn, queryBuffer.Bytes()); err != nil {
+		return nil, err
+	}
+
+	if err = th.recvHeader(conn); err != nil {
+		return nil, err
+	}
+	if th.status != 0 {
+		this.log.Warnf("recvHeader error [%d]", th.status)
+		return nil, Errno{int(th.status)}
+	}
+
+	recvBuff, _, err = TcpRecvResponse(conn, th.pkgLen)
+	if err != nil {
+		this.log.Warnf("TcpRecvResponse error :%s", err.Error())
+		return nil, err
+	}
+	if len(recvBuff)%TRACKER_STORAGE_STAT_LEN != 0 {
+		return nil, fmt.Errorf("storage stat response length %d is not a multiple of %d",
+			len(recvBuff), TRACKER_STORAGE_STAT_LEN)
+	}
+
+	storages := make([]StorageStat, len(recvBuff)/TRACKER_STORAGE_STAT_LEN)
+	for i := range storages {
+		data := recvBuff[i*TRACKER_STORAGE_STAT_LEN : (i+1)*TRACKER_STORAGE_STAT_LEN]
+		if err = storages[i].unmarshal(data); err != nil {
+			return nil, err
+		}
+	}
+	return storages, nil
+}
+
+func (this *TrackerClient) trackerDeleteStorage(groupName string, storageId string) (err error) {
+	var (
+		conn net.Conn
+	)
+
+	defer func() { err = trackerError(conn, TRACKER_PROTO_CMD_SERVER_DELETE_STORAGE, err) }()
+
+	conn, err = this.pool.GetContext(this.context())
+	if err != nil {
+		return err
+	}
+	defer logSlow(this.log, this.slowThreshold, "delete storage", conn.RemoteAddr().String(), time.Now())
+	defer this.release(conn, &err)()
+
+	// #delete_storage_fmt: |-group_name(16)-storage_id(16)-|
+	queryBuffer := new(bytes.Buffer)
+	groupNameBytes := bytes.NewBufferString(groupName).Bytes()
+	for i := 0; i < FDFS_GROUP_NAME_MAX_LEN; i++ {
+		if i >= len(groupNameBytes) {
+			queryBuffer.WriteByte(byte(0))
+		} else {
+			queryBuffer.WriteByte(groupNameBytes[i])
+		}
+	}
+	queryBuffer.WriteString(storageId)
+
+	th := &trackerHeader{}
+	th.pkgLen = int64(queryBuffer.Len())
+	th.cmd = TRACKER_PROTO_CMD_SERVER_DELETE_STORAGE
+	if err = th.sendHeader(conn); err != nil {
+		return err
+	}
+	if err = TcpSendData(conn, queryBuffer.Bytes()); err != nil {
+		return err
+	}
+
+	if err = th.recvHeader(conn); err != nil {
+		return err
+	}
+	if th.status != 0 {
+		return Errno{int(th.status)}
+	}
+	return nil
+}
+
+func (this *TrackerClient) trackerActiveTest() (err error) {
+	var conn net.Conn
+
+	defer func() { err = trackerError(conn, FDFS_PROTO_CMD_ACTIVE_TEST, err) }()
+
+	conn, err = this.pool.GetContext(this.context())
+	if err != nil {
+		return err
+	}
+	defer this.release(conn, &err)()
+
+	th := &trackerHeader{}
+	th.cmd = FDFS_PROTO_CMD_ACTIVE_TEST
+	if err = th.sendHeader(conn); err != nil {
+		return err
+	}
+	if err = th.recvHeader(conn); err != nil {
+		return err
+	}
+	if th.status != 0 {
+		return Errno{int(th.status)}
+	}
+	return nil
+}
+
+// parseStoreBody reads the storage a tracker query answered with.
+func parseStoreBody(recvBuff []byte) (*StorageServer, error) {
 	// #recv_fmt |-group_name(16)-ipaddr(16-1)-port(8)-store_path_index(1)|
-	groupName, err = readCstr(buff, FDFS_GROUP_NAME_MAX_LEN)
-	ipAddr, err = readCstr(buff, IP_ADDRESS_SIZE-1)
+	// fetch and update queries get the same without store_path_index
+	if len(recvBuff) != TRACKER_QUERY_STORAGE_STORE_BODY_LEN && len(recvBuff) != TRACKER_QUERY_STORAGE_FETCH_BODY_LEN {
+		return nil, fmt.Errorf("query storage response length %d is invalid", len(recvBuff))
+	}
+	var (
+		port           int64
+		storePathIndex uint8
+	)
+	buff := bytes.NewBuffer(recvBuff)
+	groupName, err := readCstr(buff, FDFS_GROUP_NAME_MAX_LEN)
+	if err != nil {
+		return nil, err
+	}
+	ipAddr, err := readStorageIp(buff)
+	if err != nil {
+		return nil, err
+	}
 	binary.Read(buff, binary.BigEndian, &port)
-	binary.Read(buff, binary.BigEndian, &storePathIndex)
-	return &StorageServer{fmt.Sprintf("%s:%d", ipAddr, port), groupName, int(storePathIndex)}, nil
+	if buff.Len() > 0 {
+		storePathIndex, _ = buff.ReadByte()
+	}
+	return &StorageServer{storageAddr(ipAddr, port), groupName, int(storePathIndex)}, nil
+}
+
+// readStorageIp reads a storage ip from the 15 byte field of tracker
+// answers. A full field has no terminating NUL, so an address filling it
+// may have been cut off: it is only accepted if it is a whole IPv4
+// address. IPv6 addresses of storages have to fit in 14 bytes.
+func readStorageIp(buff io.Reader) (string, error) {
+	ipAddr, err := readCstr(buff, IP_ADDRESS_SIZE-1)
+	if err != nil {
+		return "", err
+	}
+	if len(ipAddr) == IP_ADDRESS_SIZE-1 && (strings.Contains(ipAddr, ":") || net.ParseIP(ipAddr) == nil) {
+		return "", fmt.Errorf("storage ip %q fills the %d byte field of the tracker protocol, the address may be cut off", ipAddr, IP_ADDRESS_SIZE-1)
+	}
+	return ipAddr, nil
+}
+
+// storageAddr joins the ip and port reported by the tracker into a dial
+// address, bracketing IPv6 addresses.
+func storageAddr(ipAddr string, port int64) string {
+	return net.JoinHostPort(ipAddr, strconv.FormatInt(port, 10))
 }
@@ -0,0 +1,64 @@
+package fastdfs
+
+import (
+	"net"
+	"strconv"
+	"testing"
+)
+
+func TestParseStoreBody(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     []byte
+		want     StorageServer
+		wantFail bool
+	}{
+		{"store", storeBody("group1", "10.0.1.70", 23000, 2), StorageServer{"10.0.1.70:23000", "group1", 2}, false},
+		{"fetch", storeBody("group1", "10.0.1.70", 23000, -1), StorageServer{"10.0.1.70:23000", "group1", 0}, false},
+		{"ipv6", storeBody("group2", "::1", 23001, 0), StorageServer{"[::1]:23001", "group2", 0}, false},
+		{"full ipv4", storeBody("group1", "192.168.100.200", 23000, 0), StorageServer{"192.168.100.200:23000", "group1", 0}, false},
+		{"ipv6 cut off", storeBody("group1", "fe80::1ff:fe23:4567:890a", 23000, 0), StorageServer{}, true},
+		{"empty", nil, StorageServer{}, true},
+		{"short", storeBody("group1", "10.0.1.70", 23000, -1)[:30], StorageServer{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseStoreBody(tt.body)
+			if tt.wantFail {
+				if err == nil {
+					t.Fatalf("parseStoreBody() = %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseStoreBody() error = %v", err)
+			}
+			if *got != tt.want {
+				t.Errorf("parseStoreBody() = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStorageAddr(t *testing.T) {
+	tests := []struct {
+		ipAddr string
+		port   int64
+		want   string
+	}{
+		{"10.0.1.70", 23000, "10.0.1.70:23000"},
+		{"::1", 23000, "[::1]:23000"},
+		{"2001:db8::1", 23001, "[2001:db8::1]:23001"},
+		{"fe80::1%eth0", 23000, "[fe80::1%eth0]:23000"},
+	}
+	for _, tt := range tests {
+		got := storageAddr(tt.ipAddr, tt.port)
+		if got != tt.want {
+			t.Errorf("storageAddr(%q, %d) = %q, want %q", tt.ipAddr, tt.port, got, tt.want)
+		}
+		host, port, err := net.SplitHostPort(got)
+		if err != nil || host != tt.ipAddr || port != strconv.FormatInt(tt.port, 10) {
+			t.Errorf("SplitHostPort(%q) = %q, %q, %v, want %q, %d", got, host, port, err, tt.ipAddr, tt.port)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package fastdfs
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+var ErrNoGroupAvailable = errors.New("no storage group available for upload")
+
+// UploadPolicy picks the group that uploads without an explicit group go to.
+// It is consulted with the client's cached group stats.
+type UploadPolicy interface {
+	SelectGroup(groups []GroupStat) (string, error)
+}
+
+type mostFreeSpacePolicy struct{}
+
+// MostFreeSpace uploads to the active group with the most free space.
+func MostFreeSpace() UploadPolicy {
+	return mostFreeSpacePolicy{}
+}
+
+func (mostFreeSpacePolicy) SelectGroup(groups []GroupStat) (string, error) {
+	var best *GroupStat
+	for i := range groups {
+		g := &groups[i]
+		if g.ActiveCount <= 0 {
+			continue
+		}
+		if best == nil || g.FreeMB > best.FreeMB {
+			best = g
+		}
+	}
+	if best == nil {
+		return "", ErrNoGroupAvailable
+	}
+	return best.GroupName, nil
+}
+
+type roundRobinPolicy struct {
+	next uint32
+}
+
+// RoundRobin spreads uploads evenly over the active groups.
+func RoundRobin() UploadPolicy {
+	return &roundRobinPolicy{}
+}
+
+func (this *roundRobinPolicy) SelectGroup(groups []GroupStat) (string, error) {
+	active := make([]string, 0, len(groups))
+	for _, g := range groups {
+		if g.ActiveCount > 0 {
+			active = append(active, g.GroupName)
+		}
+	}
+	if len(active) == 0 {
+		return "", ErrNoGroupAvailable
+	}
+	n := atomic.AddUint32(&this.next, 1) - 1
+	return active[int(n%uint32(len(active)))], nil
+}
+
+type pinnedPolicy struct {
+	groupName string
+}
+
+// Pinned sends every upload to groupName.
+func Pinned(groupName string) UploadPolicy {
+	return pinnedPolicy{groupName}
+}
+
+func (this pinnedPolicy) SelectGroup(groups []GroupStat) (string, error) {
+	return this.groupName, nil
+}
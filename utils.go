@@ -1,26 +1,191 @@
 package fastdfs
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"os"
+	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 )
 
+// enoent is the status a storage answers for a file it doesn't have.
+const enoent = 2
+
+// enospc is the status a tracker answers when no storage of a group has
+// room for an upload.
+const enospc = 28
+
+// einval is the status for invalid arguments, e.g. a download offset past
+// the end of the file.
+const einval = 22
+
 type Errno struct {
 	status int
 }
 
+// errnoNames are the Linux errno values FastDFS servers answer with.
+var errnoNames = map[int]string{
+	1:   "EPERM",
+	2:   "ENOENT",
+	5:   "EIO",
+	11:  "EAGAIN",
+	12:  "ENOMEM",
+	13:  "EACCES",
+	16:  "EBUSY",
+	17:  "EEXIST",
+	22:  "EINVAL",
+	24:  "EMFILE",
+	28:  "ENOSPC",
+	36:  "ENAMETOOLONG",
+	95:  "EOPNOTSUPP",
+	110: "ETIMEDOUT",
+	111: "ECONNREFUSED",
+	116: "ESTALE",
+}
+
 func (e Errno) Error() string {
-	errmsg := fmt.Sprintf("errno [%d] ", e.status)
-	switch e.status {
-	case 17:
-		errmsg += "File Exist"
-	case 22:
-		errmsg += "Argument Invlid"
+	return fmt.Sprintf("errno [%d] %s", e.status, e.String())
+}
+
+// String is the name of the errno, like "ENOENT".
+func (e Errno) String() string {
+	if name, ok := errnoNames[e.status]; ok {
+		return name
 	}
-	return errmsg
+	return "E" + strconv.Itoa(e.status)
+}
+
+var (
+	// ErrFileNotFound matches errors of storages that don't have the file.
+	ErrFileNotFound = errors.New("file not found")
+	// ErrNoStorageAvailable matches errors of trackers that have no
+	// storage to serve a request, e.g. because the group doesn't exist or
+	// none of its storages is active or has room.
+	ErrNoStorageAvailable = errors.New("no storage available")
+	// ErrConnTimeout matches a tracker or storage operation whose
+	// connection timed out, see Config.Timeout and Config.ConnectTimeout.
+	// The end of the context of a call is reported as the context's error
+	// instead.
+	ErrConnTimeout = errors.New("connection timed out")
+)
+
+// ProtocolError is the non-zero status a tracker or storage answered Cmd
+// with, an errno like ENOENT. It is wrapped in a StorageError or
+// TrackerError, and matches ErrFileNotFound or ErrNoStorageAvailable with
+// errors.Is where its status means that.
+type ProtocolError struct {
+	Cmd    int8
+	Status byte
+}
+
+func (e *ProtocolError) Error() string {
+	return Errno{int(e.Status)}.Error()
+}
+
+// String is the name of the status, like "ENOENT" or "EBUSY".
+func (e *ProtocolError) String() string {
+	return Errno{int(e.Status)}.String()
+}
+
+func (e *ProtocolError) Unwrap() error {
+	return Errno{int(e.Status)}
+}
+
+func (e *ProtocolError) Is(target error) bool {
+	switch target {
+	case ErrFileNotFound:
+		return e.Status == enoent && !isTrackerQuery(e.Cmd)
+	case ErrNoStorageAvailable:
+		return (e.Status == enoent || e.Status == enospc) && isTrackerQuery(e.Cmd)
+	}
+	return false
+}
+
+// isTrackerQuery tells the commands asking a tracker for a storage, whose
+// ENOENT means there is none rather than that a file is missing.
+func isTrackerQuery(cmd int8) bool {
+	return cmd >= TRACKER_PROTO_CMD_SERVICE_QUERY_STORE_WITHOUT_GROUP_ONE &&
+		cmd <= TRACKER_PROTO_CMD_SERVICE_QUERY_STORE_WITH_GROUP_ALL
+}
+
+// protocolError turns a raw status into a ProtocolError of cmd.
+func protocolError(cmd int8, err error) error {
+	if errno, ok := err.(Errno); ok {
+		return &ProtocolError{cmd, byte(errno.status)}
+	}
+	return err
+}
+
+// isConnTimeout reports a read, write or dial that timed out, as opposed
+// to a context that ended.
+func isConnTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout() && !errors.Is(err, context.DeadlineExceeded)
+}
+
+// StorageError names the storage node and the command behind a failed
+// storage operation. The underlying error is available through errors.Is
+// and errors.As.
+type StorageError struct {
+	Addr string
+	Cmd  int8
+	Err  error
+}
+
+func (e *StorageError) Error() string {
+	return fmt.Sprintf("storage %s cmd %d: %v", e.Addr, e.Cmd, e.Err)
+}
+
+func (e *StorageError) Unwrap() error {
+	return e.Err
+}
+
+func (e *StorageError) Is(target error) bool {
+	return target == ErrConnTimeout && isConnTimeout(e.Err)
+}
+
+func storageError(storeServ *StorageServer, cmd int8, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &StorageError{storeServ.ipAddr, cmd, protocolError(cmd, err)}
+}
+
+// TrackerError names the tracker and the command behind a failed tracker
+// query, telling it apart from a failure of the storage transfer that
+// follows.
+type TrackerError struct {
+	Addr string
+	Cmd  int8
+	Err  error
+}
+
+func (e *TrackerError) Error() string {
+	return fmt.Sprintf("tracker %s cmd %d: %v", e.Addr, e.Cmd, e.Err)
+}
+
+func (e *TrackerError) Unwrap() error {
+	return e.Err
+}
+
+func (e *TrackerError) Is(target error) bool {
+	return target == ErrConnTimeout && isConnTimeout(e.Err)
+}
+
+func trackerError(conn net.Conn, cmd int8, err error) error {
+	if err == nil {
+		return nil
+	}
+	addr := ""
+	if conn != nil {
+		addr = conn.RemoteAddr().String()
+	}
+	return &TrackerError{addr, cmd, protocolError(cmd, err)}
 }
 
 type FdfsConfigParser struct{}
@@ -32,6 +197,15 @@ func fdfsCheckFile(filename string) error {
 	return nil
 }
 
+// fileSizeOf returns the size of filename, or -1 if it can't be stat'ed.
+func fileSizeOf(filename string) int64 {
+	fileInfo, err := os.Stat(filename)
+	if err != nil {
+		return -1
+	}
+	return fileInfo.Size()
+}
+
 func readCstr(buff io.Reader, length int) (string, error) {
 	str := make([]byte, length)
 	n, err := buff.Read(str)
@@ -55,10 +229,33 @@ func getFileExt(filename string) string {
 	return ""
 }
 
+// truncateUtf8 cuts s to at most n bytes without splitting a multibyte
+// UTF-8 sequence, so non-ASCII names never reach the server half encoded.
+func truncateUtf8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
 func splitRemoteFileId(remoteFileId string) ([]string, error) {
-	parts := strings.SplitN(remoteFileId, "/", 2)
-	if len(parts) < 2 {
-		return nil, errors.New("error remoteFileId")
+	groupName, remoteFilename, err := ParseFileId(remoteFileId)
+	if err != nil {
+		return nil, err
+	}
+	return []string{groupName, remoteFilename}, nil
+}
+
+// logSlow warns about an operation on target that took longer than
+// threshold. A zero threshold disables it.
+func logSlow(log Logger, threshold time.Duration, op string, target string, start time.Time) {
+	if threshold <= 0 {
+		return
+	}
+	if elapsed := time.Since(start); elapsed > threshold {
+		log.Warnf("slow %s on %s took %v", op, target, elapsed)
 	}
-	return parts, nil
 }
@@ -0,0 +1,25 @@
+package fastdfs
+
+import "testing"
+
+func TestTruncateUtf8(t *testing.T) {
+	tests := []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{"jpg", 6, "jpg"},
+		{"abcdefgh", 6, "abcdef"},
+		{"图片", 6, "图片"},
+		{"图片文件", 6, "图片"},
+		{"a图片", 6, "a图"},
+		{"ab图片", 6, "ab图"},
+		{"图", 2, ""},
+		{"", 6, ""},
+	}
+	for _, tt := range tests {
+		if got := truncateUtf8(tt.s, tt.n); got != tt.want {
+			t.Errorf("truncateUtf8(%q, %d) = %q, want %q", tt.s, tt.n, got, tt.want)
+		}
+	}
+}
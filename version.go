@@ -0,0 +1,137 @@
+package fastdfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ServerVersion is a FastDFS release like "6.07" or "6.9.5".
+type ServerVersion struct {
+	Major int
+	Minor int
+	Patch int
+}
+
+func parseServerVersion(s string) (ServerVersion, bool) {
+	var v ServerVersion
+	parts := strings.Split(strings.TrimSpace(s), ".")
+	if len(parts) < 2 || len(parts) > 3 {
+		return v, false
+	}
+	fields := []*int{&v.Major, &v.Minor, &v.Patch}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return v, false
+		}
+		*fields[i] = n
+	}
+	return v, true
+}
+
+func (v ServerVersion) String() string {
+	return fmt.Sprintf("%d.%02d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// AtLeast reports whether v is major.minor or later.
+func (v ServerVersion) AtLeast(major, minor int) bool {
+	return v.Major > major || v.Major == major && v.Minor >= minor
+}
+
+func (v ServerVersion) less(o ServerVersion) bool {
+	if v.Major != o.Major {
+		return v.Major < o.Major
+	}
+	if v.Minor != o.Minor {
+		return v.Minor < o.Minor
+	}
+	return v.Patch < o.Patch
+}
+
+// Capabilities tells which version dependent features the cluster
+// supports, going by the oldest storage in it.
+type Capabilities struct {
+	Version ServerVersion
+	// Trunk storage, since 3.00
+	Trunk bool
+	// Modify and truncate of appender files, since 3.08
+	ModifyTruncate bool
+	// Regenerate of appender files into normal files, since 6.02
+	Regenerate bool
+}
+
+func newCapabilities(v ServerVersion) *Capabilities {
+	return &Capabilities{
+		Version:        v,
+		Trunk:          v.AtLeast(3, 0),
+		ModifyTruncate: v.AtLeast(3, 8),
+		Regenerate:     v.AtLeast(6, 2),
+	}
+}
+
+// Capabilities returns the version of the oldest storage of the groups the
+// client may use, and the features it supports. The tracker protocol
+// carries no version itself, but the tracker reports the version of every
+// storage, and the storages implement the version dependent commands. The
+// result is cached after the first successful query, so restart or
+// recreate the client after upgrading the cluster.
+func (this *FastDFSClient) Capabilities() (*Capabilities, error) {
+	this.capsLock.Lock()
+	caps := this.caps
+	this.capsLock.Unlock()
+	if caps != nil {
+		return caps, nil
+	}
+
+	// probe without the lock, so a slow storage doesn't hold up every other
+	// caller; concurrent first calls may each probe, the first result stays
+	caps, err := this.probeCapabilities()
+	if err != nil {
+		return nil, err
+	}
+	this.capsLock.Lock()
+	defer this.capsLock.Unlock()
+	if this.caps == nil {
+		this.caps = caps
+	}
+	return this.caps, nil
+}
+
+func (this *FastDFSClient) probeCapabilities() (*Capabilities, error) {
+	if err := this.acquireOp(context.Background()); err != nil {
+		return nil, err
+	}
+	defer this.releaseOp()
+
+	tc := this.trackerClient()
+	groups, err := tc.trackerListGroups()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		oldest ServerVersion
+		found  bool
+	)
+	for _, g := range this.filterAllowedGroups(groups) {
+		storages, err := tc.trackerListStorages(g.GroupName, "")
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range storages {
+			v, ok := parseServerVersion(s.Version)
+			if !ok {
+				continue
+			}
+			if !found || v.less(oldest) {
+				oldest, found = v, true
+			}
+		}
+	}
+	if !found {
+		return nil, errors.New("no storage reported a version")
+	}
+	return newCapabilities(oldest), nil
+}
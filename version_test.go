@@ -0,0 +1,44 @@
+package fastdfs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCapabilitiesProbeDoesNotBlockOthers(t *testing.T) {
+	c := newFakeCluster(t)
+	defer c.close()
+	c.tracker.setStorages(storageStatRecord(FDFS_STORAGE_STATUS_ACTIVE, "100001", "10.0.0.1", "6.06", 100, 50, 0, false))
+	client := c.client(t, func(cfg *Config) { cfg.Timeout = time.Second })
+
+	// the first probe hangs on a tracker that stops answering
+	c.tracker.setFault(TRACKER_PROTO_CMD_SERVER_LIST_STORAGE, faultHang, 1)
+	hung := make(chan error, 1)
+	go func() {
+		_, err := client.Capabilities()
+		hung <- err
+	}()
+	if !waitFor(func() bool {
+		s := c.tracker.fakeServer
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		return s.faults[TRACKER_PROTO_CMD_SERVER_LIST_STORAGE] == 0
+	}) {
+		t.Fatal("the first probe never reached the tracker")
+	}
+
+	start := time.Now()
+	caps, err := client.Capabilities()
+	if err != nil {
+		t.Fatalf("Capabilities() during a hung probe error = %v", err)
+	}
+	if waited := time.Since(start); waited > 500*time.Millisecond {
+		t.Errorf("Capabilities() waited %v for the hung probe", waited)
+	}
+	if caps.Version != (ServerVersion{6, 6, 0}) || !caps.Regenerate {
+		t.Errorf("Capabilities() = %+v, want version 6.06", caps)
+	}
+	if err := <-hung; err == nil {
+		t.Error("Capabilities() on a hung tracker succeeded")
+	}
+}
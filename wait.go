@@ -0,0 +1,81 @@
+package fastdfs
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// WaitReadable blocks until every replica of remoteFileId other than the
+// source storage it was uploaded to can serve it, so load-balanced reads
+// right after an upload don't hit the replication lag window. In a group
+// with a single storage the source itself has to answer. Replicas are
+// polled with ReadablePollInterval, backing off up to
+// ReadablePollMaxInterval. It returns nil once readable, or ctx's error.
+func (this *FastDFSClient) WaitReadable(ctx context.Context, remoteFileId string) error {
+	if err := this.acquireOp(ctx); err != nil {
+		return err
+	}
+	defer this.releaseOp()
+
+	tmp, err := this.splitRemoteFileId(remoteFileId)
+	if err != nil {
+		return err
+	}
+	meta, err := DecodeFileIdMeta(remoteFileId)
+	if err != nil {
+		return err
+	}
+	groupName, remoteFilename := tmp[0], tmp[1]
+
+	tc := this.trackerClient()
+	interval := this.cfg.ReadablePollInterval
+	for {
+		if this.replicasReadable(tc, meta.SourceIpAddr, groupName, remoteFilename) {
+			return nil
+		}
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		if interval *= 2; interval > this.cfg.ReadablePollMaxInterval {
+			interval = this.cfg.ReadablePollMaxInterval
+		}
+	}
+}
+
+func (this *FastDFSClient) replicasReadable(tc *TrackerClient, sourceIpAddr string, groupName string, remoteFilename string) bool {
+	storeServs, err := tc.trackerQueryStorageFetchAll(groupName, remoteFilename)
+	if err != nil {
+		this.log.Warnf("query fetch all for %s/%s error :%s", groupName, remoteFilename, err.Error())
+		return false
+	}
+
+	replicas := make([]*StorageServer, 0, len(storeServs))
+	for _, storeServ := range storeServs {
+		host, _, err := net.SplitHostPort(storeServ.ipAddr)
+		if err == nil && host == sourceIpAddr {
+			continue
+		}
+		replicas = append(replicas, storeServ)
+	}
+	if len(replicas) == 0 {
+		replicas = storeServs
+	}
+
+	for _, storeServ := range replicas {
+		storagePool, err := this.getStoragePool(storeServ.ipAddr)
+		if err != nil {
+			return false
+		}
+		store := this.storageClient(storagePool)
+		if _, err = store.storageQueryFileInfo(context.Background(), tc, storeServ, remoteFilename); err != nil {
+			return false
+		}
+	}
+	return true
+}